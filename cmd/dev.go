@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	az "github.com/simongdavies/cnab-custom-resource-handler/pkg/azure"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/settings"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// devDrivers are the porter drivers that run bundles without Azure
+var devDrivers = map[string]bool{
+	"docker": true,
+	"debug":  true,
+}
+
+var devBundleFiles []string
+var devResourceType string
+var devPort int
+var devStateDir string
+var devDriver string
+
+var devCmd = &cobra.Command{
+	Use:   "dev",
+	Short: "Runs the handler on localhost without Azure using a local state store and local bundle files",
+	Long: `Runs the handler on localhost without Azure so that the ARM flows can be developed and demoed on a laptop.
+State is kept in a file in --state-dir, Azure login and storage account keys are not used, bundles are read from the files given with --bundle-file and actions are run with a local porter driver.
+Set IS_RPAAS and a providermapping.yaml to handle more than one resource type, bundles without a file in --bundle-file are pulled from their registry`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+		if err := setupLogging(); err != nil {
+			return err
+		}
+		if !devDrivers[devDriver] {
+			return fmt.Errorf("Unknown driver %s, expected docker or debug", devDriver)
+		}
+		localBundles, err := settings.ParseBundleFiles(devBundleFiles)
+		if err != nil {
+			return err
+		}
+		settings.LocalBundleFiles = localBundles
+		settings.DevMode = true
+
+		// the settings are read from the environment so the flags are applied by setting the variables they are read from
+		env := map[string]string{
+			"CNAB_DRIVER":   devDriver,
+			"LISTENER_PORT": strconv.Itoa(devPort),
+		}
+		if cmd.Flags().Changed("resource-type") || len(os.Getenv("RESOURCE_TYPE")) == 0 {
+			env["RESOURCE_TYPE"] = devResourceType
+		}
+		for name, value := range env {
+			if err := os.Setenv(name, value); err != nil {
+				return err
+			}
+		}
+		for name, value := range map[string]string{
+			settings.RequiredSettings["StateTable"]:   "state",
+			settings.RequiredSettings["AsyncOpTable"]: "asyncoperations",
+		} {
+			if len(os.Getenv(name)) == 0 {
+				if err := os.Setenv(name, value); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := os.MkdirAll(devStateDir, 0700); err != nil {
+			return fmt.Errorf("Failed to create state directory %s: %v", devStateDir, err)
+		}
+		stateFile := filepath.Join(devStateDir, "state.json")
+		store, err := az.NewLocalStateStore(stateFile)
+		if err != nil {
+			return err
+		}
+		az.UseStateStore(store)
+		log.Infof("Running in dev mode with driver %s and state in %s", devDriver, stateFile)
+		return runServer("127.0.0.1")
+	},
+}
+
+func init() {
+	devCmd.Flags().StringArrayVar(&devBundleFiles, "bundle-file", nil, "local bundle.json to run instead of pulling the bundle, in the form provider/type=path or path for the Custom RP resource type, can be repeated")
+	devCmd.Flags().StringVar(&devResourceType, "resource-type", "cnab", "the Custom RP resource type that the bundle is handled as")
+	devCmd.Flags().IntVar(&devPort, "port", 8080, "port to listen on, the handler only listens on localhost")
+	devCmd.Flags().StringVar(&devStateDir, "state-dir", ".cnabrp-dev", "directory the resource state is saved in, delete it to start again")
+	devCmd.Flags().StringVar(&devDriver, "driver", "docker", "porter driver used to run bundle actions, docker or debug")
+	rootCmd.AddCommand(devCmd)
+}
@@ -1,76 +1,214 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/go-chi/chi"
-	"github.com/go-chi/chi/middleware"
 	"github.com/simongdavies/cnab-custom-resource-handler/pkg"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/admin"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/auth"
 	az "github.com/simongdavies/cnab-custom-resource-handler/pkg/azure"
-	"github.com/simongdavies/cnab-custom-resource-handler/pkg/handlers"
-
 	"github.com/simongdavies/cnab-custom-resource-handler/pkg/jobs"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/logging"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/redact"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/server"
 	"github.com/simongdavies/cnab-custom-resource-handler/pkg/settings"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/tracing"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
+// serverShutdownTimeout is the part of the shutdown grace period that is kept back from draining the jobs for the servers to finish their requests
+const serverShutdownTimeout = 3 * time.Second
+
 var debug bool
+var logFormat string
 var rootCmd = &cobra.Command{
 	Use:   "cnabcustomrphandler",
 	Short: "Launches a web server that provides ARM RPC compliant CRUD endpoints for a CNAB Bundle",
 	Long:  `Launches a web server that provides ARM RPC compliant CRUD endpoints for a CNAB Bundle which can be used as an ARM Custom resource provider implementation for CNAB`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		cmd.SilenceUsage = true
-		logFormatter := new(log.TextFormatter)
-		logFormatter.TimestampFormat = "2006-01-02 15:04:05"
-		logFormatter.FullTimestamp = true
-		log.SetFormatter(logFormatter)
-		log.SetReportCaller(true)
-		if debug {
-			log.SetLevel(log.DebugLevel)
-			settings.Debug = true
+		if err := setupLogging(); err != nil {
+			return err
 		}
-		log.Debugf("Commit:%s Version:%s", pkg.Commit, pkg.Version)
-		port, exists := os.LookupEnv("LISTENER_PORT")
-		if !exists {
-			port = "8080"
+		return runServer("")
+	},
+}
+
+// runServer loads the bundles and serves the ARM endpoints until it receives SIGTERM or SIGINT, host is the interface to listen on and is empty to listen on all interfaces. In dev mode the Azure environment, credentials and storage are not used and TLS is not configured
+func runServer(host string) error {
+	log.Debugf("Commit:%s Version:%s", pkg.Commit, pkg.Version)
+	port, exists := os.LookupEnv("LISTENER_PORT")
+	if !exists {
+		port = "8080"
+	}
+	if err := settings.Load(); err != nil {
+		log.Errorf("Error loading settings %v", err)
+		return err
+	}
+
+	if err := redact.Configure(settings.OptionalSettings["RedactPatterns"].(string)); err != nil {
+		log.Errorf("Error configuring redaction %v", err)
+		return err
+	}
+
+	shutdownTracing, err := tracing.Configure(settings.OptionalSettings["TracingExporter"].(string))
+	if err != nil {
+		log.Errorf("Error configuring tracing %v", err)
+		return err
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			log.Errorf("Error flushing traces %v", err)
 		}
-		if err := settings.Load(); err != nil {
-			log.Errorf("Error loading settings %v", err)
+	}()
+
+	if !settings.DevMode {
+		if err := az.InitialiseEnvironment(); err != nil {
+			log.Errorf("Error setting Azure environment %v", err)
 			return err
 		}
 
+		if az.CredentialsRequired() {
+			if err := az.InitialiseCredentials(); err != nil {
+				log.Errorf("Error logging in to Azure %v", err)
+				return err
+			}
+		}
+
 		if err := az.SetAzureStorageInfo(); err != nil {
 			log.Errorf("Error setting storage connection settings %v", err)
 			return err
 		}
+	}
 
-		jobs.Start()
-		log.Debug("Creating Router")
-		router := chi.NewRouter()
-		router.Use(az.LogRequestBody)
-		router.Use(az.LogResponseBody)
-		router.Use(az.RequestId)
-		router.Use(middleware.RealIP)
-		router.Use(middleware.Logger)
-		router.Use(az.Login)
-		router.Use(middleware.Timeout(10 * time.Minute))
-		router.Use(middleware.Recoverer)
-		log.Debug("Creating Handler")
-		router.Handle("/*", handlers.NewCustomResourceHandler())
-		log.Infof("Starting to listen on port  %s", port)
-		err := http.ListenAndServe(fmt.Sprintf(":%s", port), router)
+	tlsConfig := server.TLSConfigFromSettings()
+	authConfig := auth.ConfigFromSettings()
+	authConfig.NativeTLS = tlsConfig.Enabled() && !settings.DevMode
+	authenticate, err := auth.New(authConfig)
+	if err != nil {
+		log.Errorf("Error configuring authentication %v", err)
+		return err
+	}
+
+	httpServer := &http.Server{
+		Addr: fmt.Sprintf("%s:%s", host, port),
+	}
+	if authConfig.NativeTLS {
+		reloader, err := server.NewCertificateReloader(tlsConfig.CertFile, tlsConfig.KeyFile)
 		if err != nil {
-			log.Errorf("Error running HTTP Server %v", err)
+			log.Errorf("Error loading TLS certificate %v", err)
+			return err
+		}
+		defer reloader.Close()
+		tlsConfig.RequestClientCert = authConfig.Mode == auth.ModeClientCert
+		if httpServer.TLSConfig, err = server.NewTLSConfig(tlsConfig, reloader); err != nil {
+			log.Errorf("Error configuring TLS %v", err)
+			return err
+		}
+	}
+
+	var adminServer *http.Server
+	if adminConfig := admin.ConfigFromSettings(); adminConfig.Enabled() {
+		if adminServer, err = admin.NewServer(adminConfig); err != nil {
+			log.Errorf("Error configuring admin API %v", err)
 			return err
 		}
+	}
+
+	if settings.IsRPaaS {
+		mappingReloader, err := settings.NewMappingReloader(jobs.HasJobs)
+		if err != nil {
+			log.Errorf("Error watching provider mappings %v", err)
+			return err
+		}
+		defer mappingReloader.Close()
+	}
+
+	jobs.Start()
+	httpServer.Handler = server.NewHandler(authenticate)
+	serverErr := make(chan error, 1)
+	if adminServer != nil {
+		go func() {
+			log.Infof("Starting admin API on %s", adminServer.Addr)
+			if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Errorf("Error running admin Server %v", err)
+			}
+		}()
+	}
+	var redirectServer *http.Server
+	if httpServer.TLSConfig != nil && len(tlsConfig.RedirectPort) > 0 {
+		redirectServer = &http.Server{
+			Addr:    fmt.Sprintf(":%s", tlsConfig.RedirectPort),
+			Handler: server.RedirectHandler(port),
+		}
+		go func() {
+			log.Infof("Starting to redirect HTTP on port %s to HTTPS", tlsConfig.RedirectPort)
+			if err := redirectServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Errorf("Error running HTTP redirect Server %v", err)
+			}
+		}()
+	}
+	go func() {
+		if httpServer.TLSConfig != nil {
+			log.Infof("Starting to listen for HTTPS on port  %s", port)
+			serverErr <- httpServer.ListenAndServeTLS("", "")
+		} else {
+			log.Infof("Starting to listen on port  %s", port)
+			serverErr <- httpServer.ListenAndServe()
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-serverErr:
+		log.Errorf("Error running HTTP Server %v", err)
 		jobs.Stop()
-		return nil
-	},
+		return err
+	case sig := <-stop:
+		log.Infof("Received %v, draining jobs before shutting down", sig)
+	}
+
+	// The server keeps running while the jobs drain so that ARM can poll the operations, requests that would start a job are rejected.
+	// Draining and shutting down the servers share the grace period so that the handler exits within it, the servers have whatever time the jobs did not use
+	ctx, cancel := context.WithTimeout(context.Background(), settings.ShutdownGracePeriod)
+	defer cancel()
+	jobs.Drain(settings.ShutdownGracePeriod - serverShutdownTimeout)
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Errorf("Error shutting down HTTP Server %v", err)
+	}
+	if adminServer != nil {
+		if err := adminServer.Shutdown(ctx); err != nil {
+			log.Errorf("Error shutting down admin Server %v", err)
+		}
+	}
+	if redirectServer != nil {
+		if err := redirectServer.Shutdown(ctx); err != nil {
+			log.Errorf("Error shutting down HTTP redirect Server %v", err)
+		}
+	}
+	jobs.Stop()
+	log.Info("Shut down")
+	return nil
+}
+
+func setupLogging() error {
+	if err := logging.Configure(logFormat); err != nil {
+		return err
+	}
+	log.SetReportCaller(true)
+	if debug {
+		log.SetLevel(log.DebugLevel)
+		settings.Debug = true
+	}
+	return nil
 }
 
 func main() {
@@ -80,5 +218,6 @@ func main() {
 }
 
 func init() {
-	rootCmd.Flags().BoolVarP(&debug, "debug", "d", false, "specifies if debug output should be produced")
+	rootCmd.PersistentFlags().BoolVarP(&debug, "debug", "d", false, "specifies if debug output should be produced")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", os.Getenv("LOG_FORMAT"), "specifies the log format, text or json, defaults to the LOG_FORMAT environment variable")
 }
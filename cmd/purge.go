@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/jobs"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/settings"
+	"github.com/spf13/cobra"
+)
+
+var retentionDays int
+var retentionCount int
+var purgeCmd = &cobra.Command{
+	Use:   "purge-operations",
+	Short: "Deletes completed async operation records that are outside of the retention policy",
+	Long:  `Deletes completed async operation records that are outside of the retention policy, the policy is read from ASYNC_OP_RETENTION_DAYS and ASYNC_OP_RETENTION_COUNT unless it is set using flags`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+		if err := setupLogging(); err != nil {
+			return err
+		}
+		if err := initialiseStateStore(); err != nil {
+			return err
+		}
+
+		if !cmd.Flags().Changed("retention-days") {
+			retentionDays = settings.AsyncOpRetentionDays
+		}
+		if !cmd.Flags().Changed("retention-count") {
+			retentionCount = settings.AsyncOpRetentionCount
+		}
+
+		purged, err := jobs.PurgeAsyncOps(context.Background(), retentionDays, retentionCount)
+		fmt.Printf("Purged %d async operation records\n", purged)
+		return err
+	},
+}
+
+func init() {
+	purgeCmd.Flags().IntVar(&retentionDays, "retention-days", 0, "number of days to keep completed operations for, 0 disables the age rule")
+	purgeCmd.Flags().IntVar(&retentionCount, "retention-count", 0, "number of completed operations to keep for each resource, 0 disables the count rule")
+	rootCmd.AddCommand(purgeCmd)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/conformance"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/helpers"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/simulator"
+	"github.com/spf13/cobra"
+)
+
+var simulateConfig simulator.Config
+var simulateTemplate string
+var simulateParameters []string
+var simulateOverrides []string
+var simulateResource string
+var simulatePostBody string
+var simulateAction string
+
+var simulateCmd = &cobra.Command{
+	Use:   "simulate",
+	Short: "Sends requests to the handler the way ARM does and checks the responses against the ARM RPC contract",
+	Long: `Sends PUT, GET, POST, DELETE and LIST requests to the handler with the headers that ARM adds, follows the Location and Azure-AsyncOperation headers honouring Retry-After and checks every response against the ARM RPC contract.
+The resource is read from a deployment template such as deploy/createInstance.json, template parameters are set with --parameter and properties that use functions that cannot be evaluated outside of ARM are set with --set.
+The command exits with an error if any response does not follow the contract`,
+}
+
+func init() {
+	flags := simulateCmd.PersistentFlags()
+	flags.StringVar(&simulateConfig.Endpoint, "endpoint", "http://localhost:8080", "base URL of the handler")
+	flags.StringVar(&simulateConfig.SubscriptionId, "subscription", "00000000-0000-0000-0000-000000000000", "subscription id used in resource ids")
+	flags.StringVar(&simulateConfig.ResourceGroup, "resource-group", "simulator-rg", "resource group used in resource ids")
+	flags.StringVar(&simulateConfig.Location, "location", "eastus", "location of the resource group")
+	flags.StringVar(&simulateConfig.APIVersion, "api-version", helpers.APIVersion, "api-version sent with each request")
+	flags.BoolVar(&simulateConfig.RPaaS, "rpaas", false, "send the headers that RPaaS sends instead of the headers that Custom Providers send")
+	flags.StringVar(&simulateConfig.APIKey, "api-key", "", "API key sent with each request when the handler uses API key authentication")
+	flags.StringVar(&simulateConfig.BearerToken, "bearer-token", "", "bearer token sent with each request when the handler uses JWT authentication")
+	flags.DurationVar(&simulateConfig.MaxRetryAfter, "max-retry-after", 0, "maximum time to wait between polls, zero honours the Retry-After header")
+	flags.DurationVar(&simulateConfig.Timeout, "timeout", 30*time.Minute, "how long to poll an operation for")
+	flags.StringVarP(&simulateTemplate, "file", "f", "deploy/createInstance.json", "deployment template the resource is read from")
+	flags.StringArrayVar(&simulateParameters, "parameter", nil, "template parameter in the form name=value, can be repeated")
+	flags.StringArrayVar(&simulateOverrides, "set", nil, "resource property in the form path=value where path is dotted such as credentials.kubeconfig, value is parsed as JSON if it is valid JSON and read from a file if it starts with @, can be repeated")
+	flags.StringVar(&simulateResource, "resource", "", "name of the resource in the template, required if the template has more than one resource")
+
+	simulatePostCmd.Flags().StringVar(&simulatePostBody, "body", "", "file containing the JSON body of the action request")
+	simulateConformanceCmd.Flags().StringVar(&simulateAction, "action", "", "custom action to invoke on the resource, no action is invoked if it is not set")
+	simulateConformanceCmd.Flags().StringVar(&simulatePostBody, "body", "", "file containing the JSON body of the action request")
+
+	simulateCmd.AddCommand(
+		simulateCommand("put", "Creates or updates the resource and polls the operation until it finishes", func(ctx context.Context, s *simulator.Simulator, r simulator.Resource) (*simulator.Result, error) {
+			return s.Put(ctx, r)
+		}),
+		simulateCommand("get", "Gets the resource", func(ctx context.Context, s *simulator.Simulator, r simulator.Resource) (*simulator.Result, error) {
+			return s.Get(ctx, r)
+		}),
+		simulateCommand("list", "Lists the resources of the same type in the resource group", func(ctx context.Context, s *simulator.Simulator, r simulator.Resource) (*simulator.Result, error) {
+			return s.List(ctx, r)
+		}),
+		simulateCommand("delete", "Deletes the resource, polls the operation until it finishes and checks that the resource is not found", func(ctx context.Context, s *simulator.Simulator, r simulator.Resource) (*simulator.Result, error) {
+			return s.Delete(ctx, r)
+		}),
+		simulateCommand("lifecycle", "Gets a missing resource, creates, gets, lists and deletes the resource", func(ctx context.Context, s *simulator.Simulator, r simulator.Resource) (*simulator.Result, error) {
+			return s.Lifecycle(ctx, r)
+		}),
+		simulatePostCmd,
+		simulateConformanceCmd,
+	)
+	rootCmd.AddCommand(simulateCmd)
+}
+
+var simulatePostCmd = &cobra.Command{
+	Use:   "post ACTION",
+	Short: "Invokes an action on the resource and polls the operation until it finishes",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		body, err := readPostBody()
+		if err != nil {
+			return err
+		}
+		return runSimulation(cmd, func(ctx context.Context, s *simulator.Simulator, r simulator.Resource) (*simulator.Result, error) {
+			return s.Post(ctx, r, args[0], body)
+		})
+	},
+}
+
+var simulateConformanceCmd = &cobra.Command{
+	Use:   "conformance",
+	Short: "Checks that the handler follows the ARM RPC rules by creating, updating, listing and deleting the resource",
+	Long: `Checks that the handler follows the ARM RPC rules by creating, getting, updating, listing and deleting the resource, the resource must not exist before the checks are run.
+The command exits with an error if any check fails`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+		if err := setupLogging(); err != nil {
+			return err
+		}
+		resource, err := simulateResourceFromTemplate()
+		if err != nil {
+			return err
+		}
+		body, err := readPostBody()
+		if err != nil {
+			return err
+		}
+		config := simulateConfig
+		config.Log = os.Stdout
+		suite := conformance.New(simulator.NewClient(config), conformance.Config{
+			Resource:   resource,
+			Action:     simulateAction,
+			ActionBody: body,
+		})
+		report := suite.Run(context.Background())
+		report.Print(os.Stdout)
+		if report.Failed() {
+			return fmt.Errorf("The handler does not conform to the ARM RPC rules")
+		}
+		return nil
+	},
+}
+
+type simulation func(ctx context.Context, s *simulator.Simulator, r simulator.Resource) (*simulator.Result, error)
+
+func simulateCommand(use string, short string, run simulation) *cobra.Command {
+	return &cobra.Command{
+		Use:   use,
+		Short: short,
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runSimulation(cmd, run)
+		},
+	}
+}
+
+func runSimulation(cmd *cobra.Command, run simulation) error {
+	cmd.SilenceUsage = true
+	if err := setupLogging(); err != nil {
+		return err
+	}
+	resource, err := simulateResourceFromTemplate()
+	if err != nil {
+		return err
+	}
+	config := simulateConfig
+	config.Log = os.Stdout
+	s := simulator.New(simulator.NewClient(config))
+	result, err := run(context.Background(), s, resource)
+	if result != nil {
+		for _, v := range result.Violations {
+			fmt.Printf("VIOLATION %s\n", v)
+		}
+		fmt.Printf("Status: %s\n", result.Status)
+	}
+	if err != nil {
+		return err
+	}
+	if len(result.Violations) > 0 {
+		return fmt.Errorf("%d responses did not follow the ARM RPC contract", len(result.Violations))
+	}
+	return nil
+}
+
+func simulateResourceFromTemplate() (simulator.Resource, error) {
+	values := simulator.TemplateValues{
+		Parameters:     map[string]string{},
+		Overrides:      map[string]interface{}{},
+		ResourceGroup:  simulateConfig.ResourceGroup,
+		Location:       simulateConfig.Location,
+		SubscriptionId: simulateConfig.SubscriptionId,
+	}
+	for _, p := range simulateParameters {
+		name, value, err := splitAssignment(p, "--parameter")
+		if err != nil {
+			return simulator.Resource{}, err
+		}
+		values.Parameters[name] = value
+	}
+	for _, o := range simulateOverrides {
+		path, value, err := splitAssignment(o, "--set")
+		if err != nil {
+			return simulator.Resource{}, err
+		}
+		override, err := overrideValue(value)
+		if err != nil {
+			return simulator.Resource{}, err
+		}
+		values.Overrides[path] = override
+	}
+	resources, err := simulator.ReadResources(simulateTemplate, values)
+	if err != nil {
+		return simulator.Resource{}, err
+	}
+	if len(simulateResource) > 0 {
+		for _, r := range resources {
+			if strings.EqualFold(r.Name, simulateResource) {
+				return r, nil
+			}
+		}
+		return simulator.Resource{}, fmt.Errorf("Resource %s not found in %s", simulateResource, simulateTemplate)
+	}
+	if len(resources) != 1 {
+		return simulator.Resource{}, fmt.Errorf("%s contains %d resources, use --resource to select one", simulateTemplate, len(resources))
+	}
+	return resources[0], nil
+}
+
+// readPostBody reads the JSON body of an action request from the file set with --body, it returns nil if no file is set
+func readPostBody() (interface{}, error) {
+	if len(simulatePostBody) == 0 {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(simulatePostBody)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read body %s: %w", simulatePostBody, err)
+	}
+	var body interface{}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, fmt.Errorf("Body %s is not valid JSON: %w", simulatePostBody, err)
+	}
+	return body, nil
+}
+
+func splitAssignment(s string, flag string) (string, string, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 {
+		return "", "", fmt.Errorf("Invalid %s %s, expected name=value", flag, s)
+	}
+	return parts[0], parts[1], nil
+}
+
+// overrideValue reads the value from a file if it starts with @ and decodes it if it is JSON, otherwise it is a string
+func overrideValue(value string) (interface{}, error) {
+	if strings.HasPrefix(value, "@") {
+		data, err := ioutil.ReadFile(value[1:])
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read %s: %w", value[1:], err)
+		}
+		value = string(data)
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(value), &v); err == nil {
+		return v, nil
+	}
+	return value, nil
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	autorestazure "github.com/Azure/go-autorest/autorest/azure"
+	az "github.com/simongdavies/cnab-custom-resource-handler/pkg/azure"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/helpers"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/redact"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/settings"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var stateSubscriptionId string
+var stateResourceType string
+var stateProvisioningState string
+var stateDryRun bool
+var stateFile string
+var stateClearStatus bool
+
+var provisioningStates = []string{
+	helpers.ProvisioningStateSucceeded,
+	helpers.ProvisioningStateFailed,
+	helpers.ProvisioningStateDeleting,
+	helpers.ProvisioningStateUpdating,
+	helpers.ProvisioningStateCreated,
+	helpers.ProvisioningStateAccepted,
+}
+
+var stateCmd = &cobra.Command{
+	Use:   "state",
+	Short: "Inspects and repairs the resource state table",
+	Long: `Inspects and repairs the resource state table using the storage settings from the environment.
+Commands that change state accept resource ids as arguments, or select resources using the --subscription, --type and --provisioning-state filters when no ids are given`,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+		if err := setupLogging(); err != nil {
+			return err
+		}
+		return initialiseStateStore()
+	},
+}
+
+var stateListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists the resources in the state table that match the filters",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		entities, err := queryState(false)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "RESOURCE ID\tTYPE\tPROVISIONING STATE\tSTATUS\tOPERATION ID")
+		for _, entity := range entities {
+			fmt.Fprintf(w, "%s\t%s/%s\t%s\t%s\t%s\n", az.GetResourceIdFromRowKey(entity.RowKey), property(entity, "ResourceProvider"), property(entity, "ResourceType"), property(entity, "ProvisioningState"), property(entity, "Status"), property(entity, "OperationId"))
+		}
+		return w.Flush()
+	},
+}
+
+var stateShowCmd = &cobra.Command{
+	Use:   "show RESOURCE_ID",
+	Short: "Shows the state row for a resource, credentials are masked",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		subscriptionId, err := getSubscriptionId(args[0])
+		if err != nil {
+			return err
+		}
+		entity, err := az.GetRPStateEntity(context.Background(), subscriptionId, args[0])
+		if err != nil {
+			if az.IsNotFoundError(err) {
+				return fmt.Errorf("Resource %s not found", args[0])
+			}
+			return err
+		}
+		body, err := json.MarshalIndent(entity, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(append(redact.Body(body), '\n'))
+		return err
+	},
+}
+
+var stateSetProvisioningStateCmd = &cobra.Command{
+	Use:   "set-provisioning-state PROVISIONING_STATE [RESOURCE_ID...]",
+	Short: "Sets the provisioning state of resources",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		provisioningState, ok := findProvisioningState(args[0])
+		if !ok {
+			return fmt.Errorf("Unknown provisioning state %s, expected one of %s", args[0], strings.Join(provisioningStates, ", "))
+		}
+		entities, err := selectState(args[1:])
+		if err != nil {
+			return err
+		}
+		for _, entity := range entities {
+			resourceId := az.GetResourceIdFromRowKey(entity.RowKey)
+			fmt.Printf("%s: %s -> %s\n", resourceId, property(entity, "ProvisioningState"), provisioningState)
+			if stateDryRun {
+				continue
+			}
+			if err := az.UpdateRPProvisioningState(context.Background(), entity.PartitionKey, resourceId, provisioningState); err != nil {
+				return err
+			}
+			if stateClearStatus && len(property(entity, "Status")) > 0 {
+				if err := az.UpdateRPStatus(context.Background(), entity.PartitionKey, resourceId, "", "", ""); err != nil {
+					return err
+				}
+			}
+		}
+		printSummary("Updated", len(entities))
+		return nil
+	},
+}
+
+var stateDeleteCmd = &cobra.Command{
+	Use:   "delete [RESOURCE_ID...]",
+	Short: "Deletes the state rows of resources, the installations are not uninstalled",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		entities, err := selectState(args)
+		if err != nil {
+			return err
+		}
+		for _, entity := range entities {
+			resourceId := az.GetResourceIdFromRowKey(entity.RowKey)
+			fmt.Printf("%s: deleting state in provisioning state %s\n", resourceId, property(entity, "ProvisioningState"))
+			if stateDryRun {
+				continue
+			}
+			if err := az.DeleteRPState(context.Background(), entity.PartitionKey, resourceId); err != nil {
+				return err
+			}
+		}
+		printSummary("Deleted", len(entities))
+		return nil
+	},
+}
+
+var stateExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Exports the state rows that match the filters as JSON lines, the export contains credentials so it should be stored securely",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		entities, err := queryState(false)
+		if err != nil {
+			return err
+		}
+		out := os.Stdout
+		if len(stateFile) > 0 && stateFile != "-" {
+			if out, err = os.OpenFile(stateFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600); err != nil {
+				return err
+			}
+			defer out.Close()
+		}
+		encoder := json.NewEncoder(out)
+		for _, entity := range entities {
+			if err := encoder.Encode(entity); err != nil {
+				return err
+			}
+		}
+		log.Infof("Exported %d resources", len(entities))
+		return nil
+	},
+}
+
+var stateImportCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Imports state rows written by export, existing rows are replaced, rows that do not match the filters are skipped",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		filter, err := stateFilter()
+		if err != nil {
+			return err
+		}
+		var in io.Reader = os.Stdin
+		if len(stateFile) > 0 && stateFile != "-" {
+			file, err := os.Open(stateFile)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			in = file
+		}
+		imported := 0
+		scanner := bufio.NewScanner(in)
+		scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			if len(strings.TrimSpace(scanner.Text())) == 0 {
+				continue
+			}
+			entity := storage.Entity{}
+			if err := json.Unmarshal(scanner.Bytes(), &entity); err != nil {
+				return fmt.Errorf("Failed to parse line %d: %v", line, err)
+			}
+			if len(entity.PartitionKey) == 0 || len(entity.RowKey) == 0 {
+				return fmt.Errorf("Line %d does not have a PartitionKey and RowKey", line)
+			}
+			if !filter.Matches(&entity) {
+				continue
+			}
+			fmt.Printf("%s: importing state in provisioning state %s\n", az.GetResourceIdFromRowKey(entity.RowKey), property(&entity, "ProvisioningState"))
+			imported++
+			if stateDryRun {
+				continue
+			}
+			if err := az.ImportRPStateEntity(context.Background(), &entity); err != nil {
+				return err
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		printSummary("Imported", imported)
+		return nil
+	},
+}
+
+// initialiseStateStore loads the settings needed to reach the state tables without loading any bundles, an Azure credential is only needed when the storage account key is looked up with ARM
+func initialiseStateStore() error {
+	if err := settings.LoadEnvironment(); err != nil {
+		log.Errorf("Error loading settings %v", err)
+		return err
+	}
+
+	if err := az.InitialiseEnvironment(); err != nil {
+		log.Errorf("Error setting Azure environment %v", err)
+		return err
+	}
+
+	if az.CredentialsRequired() {
+		if err := az.InitialiseCredentials(); err != nil {
+			log.Errorf("Error logging in to Azure %v", err)
+			return err
+		}
+	}
+
+	if err := az.SetAzureStorageInfo(); err != nil {
+		log.Errorf("Error setting storage connection settings %v", err)
+		return err
+	}
+	return nil
+}
+
+// stateFilter returns the filter from the flags, the provisioning state is matched ignoring case and converted to the case it is stored in so that a typo is rejected rather than selecting nothing
+func stateFilter() (az.RPStateFilter, error) {
+	filter := az.RPStateFilter{
+		SubscriptionId: stateSubscriptionId,
+	}
+	if len(stateProvisioningState) > 0 {
+		provisioningState, ok := findProvisioningState(stateProvisioningState)
+		if !ok {
+			return filter, fmt.Errorf("Unknown provisioning state %s, expected one of %s", stateProvisioningState, strings.Join(provisioningStates, ", "))
+		}
+		filter.ProvisioningState = provisioningState
+	}
+	if len(stateResourceType) > 0 {
+		parts := strings.SplitN(stateResourceType, "/", 2)
+		filter.ResourceProvider = parts[0]
+		if len(parts) == 2 {
+			filter.ResourceType = parts[1]
+		}
+	}
+	return filter, nil
+}
+
+// queryState returns the rows that match the filters, requireFilter stops commands that change state from selecting every row by mistake
+func queryState(requireFilter bool) ([]*storage.Entity, error) {
+	filter, err := stateFilter()
+	if err != nil {
+		return nil, err
+	}
+	if requireFilter && filter == (az.RPStateFilter{}) {
+		return nil, errors.New("Resource ids or at least one of --subscription, --type or --provisioning-state should be set")
+	}
+	return az.QueryRPState(context.Background(), filter)
+}
+
+// selectState returns the rows for the resource ids, or the rows that match the filters if there are no resource ids
+func selectState(resourceIds []string) ([]*storage.Entity, error) {
+	if len(resourceIds) == 0 {
+		return queryState(true)
+	}
+	entities := make([]*storage.Entity, 0, len(resourceIds))
+	for _, resourceId := range resourceIds {
+		subscriptionId, err := getSubscriptionId(resourceId)
+		if err != nil {
+			return nil, err
+		}
+		entity, err := az.GetRPStateEntity(context.Background(), subscriptionId, resourceId)
+		if err != nil {
+			if az.IsNotFoundError(err) {
+				return nil, fmt.Errorf("Resource %s not found", resourceId)
+			}
+			return nil, err
+		}
+		entities = append(entities, entity)
+	}
+	return entities, nil
+}
+
+func getSubscriptionId(resourceId string) (string, error) {
+	resource, err := autorestazure.ParseResourceID(resourceId)
+	if err != nil {
+		return "", fmt.Errorf("Failed to parse resource id %s: %v", resourceId, err)
+	}
+	return resource.SubscriptionID, nil
+}
+
+func findProvisioningState(name string) (string, bool) {
+	for _, s := range provisioningStates {
+		if strings.EqualFold(s, name) {
+			return s, true
+		}
+	}
+	return "", false
+}
+
+func property(entity *storage.Entity, name string) string {
+	value, _ := entity.Properties[name].(string)
+	return value
+}
+
+func printSummary(verb string, count int) {
+	if stateDryRun {
+		fmt.Printf("Dry run, %d resources would be %s\n", count, strings.ToLower(verb))
+		return
+	}
+	fmt.Printf("%s %d resources\n", verb, count)
+}
+
+func init() {
+	stateCmd.PersistentFlags().StringVar(&stateSubscriptionId, "subscription", "", "only select resources in this subscription")
+	stateCmd.PersistentFlags().StringVar(&stateResourceType, "type", "", "only select resources of this type in the form provider/type, or provider for every type of the provider, the type is matched ignoring case")
+	stateCmd.PersistentFlags().StringVar(&stateProvisioningState, "provisioning-state", "", "only select resources in this provisioning state")
+	stateCmd.PersistentFlags().BoolVar(&stateDryRun, "dry-run", false, "print the changes that would be made without making them")
+	stateSetProvisioningStateCmd.Flags().BoolVar(&stateClearStatus, "clear-status", false, "also clear the status of an action that is recorded as running")
+	stateExportCmd.Flags().StringVarP(&stateFile, "file", "f", "", "file to write the export to, defaults to stdout")
+	stateImportCmd.Flags().StringVarP(&stateFile, "file", "f", "", "file to read the import from, defaults to stdin")
+	stateCmd.AddCommand(stateListCmd, stateShowCmd, stateSetProvisioningStateCmd, stateDeleteCmd, stateExportCmd, stateImportCmd)
+	rootCmd.AddCommand(stateCmd)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/cnabio/cnab-go/bundle"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/helpers"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/settings"
+	"github.com/spf13/cobra"
+)
+
+const (
+	levelOK      = "OK"
+	levelWarning = "WARNING"
+	levelError   = "ERROR"
+)
+
+// scalarTypes are the JSON schema types that can be passed to porter as a parameter value
+var scalarTypes = map[string]bool{
+	"string":  true,
+	"integer": true,
+	"number":  true,
+	"boolean": true,
+	"null":    true,
+}
+
+var mappingFile string
+var bundleFiles []string
+
+var validateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Validates the environment settings, the bundle mappings and the tools needed to run bundles",
+	Long: `Validates the environment settings, the bundle mappings and the tools needed to run bundles without starting the server.
+Each bundle is pulled from its registry unless a local bundle.json is given with --bundle-file, the command exits with an error if any check fails`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+		if err := setupLogging(); err != nil {
+			return err
+		}
+		localBundles, err := settings.ParseBundleFiles(bundleFiles)
+		if err != nil {
+			return err
+		}
+		settings.LocalBundleFiles = localBundles
+		report := &validationReport{}
+		validateEnvironment(report)
+		mappings := validateMappings(report)
+		for _, m := range mappings {
+			validateBundle(report, m)
+		}
+		validateTools(context.Background(), report)
+		report.print(os.Stdout)
+		if report.errors > 0 {
+			return fmt.Errorf("Validation failed with %d errors", report.errors)
+		}
+		return nil
+	},
+}
+
+type validationResult struct {
+	level   string
+	check   string
+	message string
+}
+
+type validationReport struct {
+	results  []validationResult
+	errors   int
+	warnings int
+}
+
+func (r *validationReport) add(level string, check string, format string, args ...interface{}) {
+	r.results = append(r.results, validationResult{
+		level:   level,
+		check:   check,
+		message: fmt.Sprintf(format, args...),
+	})
+	switch level {
+	case levelError:
+		r.errors++
+	case levelWarning:
+		r.warnings++
+	}
+}
+
+func (r *validationReport) print(w io.Writer) {
+	for _, result := range r.results {
+		fmt.Fprintf(w, "%-8s %s: %s\n", result.level, result.check, result.message)
+	}
+	fmt.Fprintf(w, "%d errors, %d warnings\n", r.errors, r.warnings)
+}
+
+func validateEnvironment(report *validationReport) {
+	errs := settings.CheckEnvironment()
+	for _, err := range errs {
+		report.add(levelError, "environment", "%v", err)
+	}
+	// the optional settings are loaded even if a required setting is missing so that the mappings can still be checked
+	_ = settings.LoadEnvironment()
+	if len(errs) == 0 {
+		report.add(levelOK, "environment", "required settings are set")
+	}
+}
+
+// validateMappings returns the mappings that can be checked further, each provider/type pair must only be mapped once
+func validateMappings(report *validationReport) []settings.Mapping {
+	mappings, err := settings.ConfiguredMappings(mappingFile)
+	if err != nil {
+		report.add(levelError, "mappings", "failed to read mapping file: %v", err)
+		return nil
+	}
+	if len(mappings) == 0 {
+		report.add(levelError, "mappings", "no resource types are mapped")
+		return nil
+	}
+	var valid []settings.Mapping
+	seen := make(map[string]bool)
+	for i, m := range mappings {
+		check := fmt.Sprintf("mapping %d", i+1)
+		if len(m.Provider) == 0 || len(m.Type) == 0 {
+			report.add(levelError, check, "provider and type should be set, got provider: %q type: %q", m.Provider, m.Type)
+			continue
+		}
+		// a bundle read from a local file is given a tag if the mapping does not have one
+		if _, ok := settings.LocalBundleFile(m); !ok && len(m.Tag) == 0 {
+			report.add(levelError, check, "tag should be set for %s unless a bundle file is given with --bundle-file", settings.GetRPName(m.Provider, m.Type))
+			continue
+		}
+		rpType := strings.ToLower(settings.GetRPName(m.Provider, m.Type))
+		if seen[rpType] {
+			report.add(levelError, check, "%s is mapped more than once", settings.GetRPName(m.Provider, m.Type))
+			continue
+		}
+		seen[rpType] = true
+		valid = append(valid, m)
+	}
+	report.add(levelOK, "mappings", "%d resource types are mapped", len(valid))
+	return valid
+}
+
+func validateBundle(report *validationReport, m settings.Mapping) {
+	rpType := settings.GetRPName(m.Provider, m.Type)
+	bundleInfo, err := settings.LoadBundleInformation(m)
+	if err != nil {
+		report.add(levelError, rpType, "failed to load bundle %s: %v", m.Tag, err)
+		return
+	}
+	report.add(levelOK, rpType, "loaded bundle %s digest %s", bundleInfo.BundlePullOptions.Tag, bundleInfo.BundleDigest)
+	validateParameterDefinitions(report, rpType, bundleInfo.RPBundle)
+}
+
+// validateParameterDefinitions checks that every parameter has a definition with a type that can be passed to porter, parameter values are passed as strings so objects and arrays cannot be represented
+func validateParameterDefinitions(report *validationReport, rpType string, rpBundle *bundle.Bundle) {
+	names := make([]string, 0, len(rpBundle.Parameters))
+	for name := range rpBundle.Parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		param := rpBundle.Parameters[name]
+		check := fmt.Sprintf("%s parameter %s", rpType, name)
+		if param.Destination == nil {
+			report.add(levelError, check, "parameter has no destination")
+			continue
+		}
+		definition, ok := rpBundle.Definitions[param.Definition]
+		if !ok {
+			report.add(levelError, check, "definition %s does not exist", param.Definition)
+			continue
+		}
+		types, ok := schemaTypes(definition.Type)
+		if !ok {
+			report.add(levelError, check, "definition %s has an invalid type %v", param.Definition, definition.Type)
+			continue
+		}
+		if len(types) == 0 {
+			report.add(levelWarning, check, "definition %s has no type, the value is passed as a string", param.Definition)
+			continue
+		}
+		for _, t := range types {
+			if !scalarTypes[t] {
+				report.add(levelError, check, "definition %s has type %s which cannot be passed as a parameter value", param.Definition, t)
+				break
+			}
+		}
+	}
+}
+
+// schemaTypes returns the types in a JSON schema type which can be a single type or a list of types
+func schemaTypes(schemaType interface{}) ([]string, bool) {
+	switch t := schemaType.(type) {
+	case nil:
+		return nil, true
+	case string:
+		return []string{t}, true
+	case []interface{}:
+		types := make([]string, 0, len(t))
+		for _, v := range t {
+			s, ok := v.(string)
+			if !ok {
+				return nil, false
+			}
+			types = append(types, s)
+		}
+		return types, true
+	default:
+		return nil, false
+	}
+}
+
+// validateTools checks porter and the plugins it needs, the Azure CNAB driver is only checked when it is the driver configured in CNAB_DRIVER
+func validateTools(ctx context.Context, report *validationReport) {
+	if err := helpers.CheckPorter(ctx); err != nil {
+		report.add(levelError, "porter", "%v", err)
+	} else {
+		report.add(levelOK, "porter", "porter and the plugins it needs are installed")
+	}
+	if len(settings.Driver) > 0 && settings.Driver != settings.DefaultDriver {
+		report.add(levelOK, "driver", "bundle actions are run with the %s driver, the azure driver is not needed", settings.Driver)
+		return
+	}
+	if err := helpers.CheckAzureDriver(); err != nil {
+		report.add(levelError, "driver", "%v", err)
+	} else {
+		report.add(levelOK, "driver", "azure driver is installed")
+	}
+}
+
+func init() {
+	validateCmd.Flags().StringVar(&mappingFile, "mapping-file", "", "path to the provider mapping file, defaults to providermapping.yaml in $HOME/.cnabrp or the current directory")
+	validateCmd.Flags().StringArrayVar(&bundleFiles, "bundle-file", nil, "local bundle.json to validate instead of pulling the bundle, in the form provider/type=path or path for the Custom RP resource type, can be repeated")
+	rootCmd.AddCommand(validateCmd)
+}
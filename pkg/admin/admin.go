@@ -0,0 +1,147 @@
+// Package admin provides an HTTP API for operators to inspect the job queues, resource state and bundle mappings and to repair stuck resources
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/go-chi/render"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/auth"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/azure"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/helpers"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/jobs"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/redact"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/settings"
+	log "github.com/sirupsen/logrus"
+)
+
+// Config contains the settings for the admin API
+type Config struct {
+	// Address is the address the admin API listens on such as 127.0.0.1:9090, the admin API is not started if it is empty
+	Address string
+	APIKey  string
+}
+
+// ConfigFromSettings returns the admin API config from the environment settings
+func ConfigFromSettings() Config {
+	return Config{
+		Address: settings.OptionalSettings["AdminAddress"].(string),
+		APIKey:  settings.OptionalSettings["AdminAPIKey"].(string),
+	}
+}
+
+// Enabled returns true if an address has been configured for the admin API
+func (c Config) Enabled() bool {
+	return len(c.Address) > 0
+}
+
+// NewServer returns a server for the admin API, requests are authenticated with the API key in the X-Api-Key header
+func NewServer(config Config) (*http.Server, error) {
+	if len(config.APIKey) == 0 {
+		return nil, errors.New("ADMIN_API_KEY should be set when ADMIN_ADDRESS is set")
+	}
+	authenticate, err := auth.New(auth.Config{
+		Mode:   auth.ModeAPIKey,
+		APIKey: config.APIKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &http.Server{
+		Addr:    config.Address,
+		Handler: NewHandler(authenticate),
+	}, nil
+}
+
+// NewHandler returns the router for the admin API, resources are identified by the id query parameter which is the ARM resource id
+func NewHandler(authenticate func(http.Handler) http.Handler) chi.Router {
+	router := chi.NewRouter()
+	// RequestId sets the correlation fields that are logged for the request and passed to requeued jobs
+	router.Use(azure.RequestId)
+	router.Use(middleware.Logger)
+	router.Use(authenticate)
+	router.Use(middleware.Recoverer)
+	router.Get("/jobs", listJobsHandler)
+	router.Get("/mappings", listMappingsHandler)
+	router.Get("/resource", getResourceHandler)
+	router.Post("/resource/fail", failResourceHandler)
+	router.Post("/resource/requeue", requeueResourceHandler)
+	return router
+}
+
+type jobsResponse struct {
+	Draining bool                        `json:"draining"`
+	Queues   map[string]jobs.QueueStatus `json:"queues"`
+	Jobs     map[string][]jobs.JobInfo   `json:"jobs"`
+	// Interrupted are the operations whose jobs were interrupted by a shutdown and have not been requeued, interrupted actions stay here until they are failed
+	Interrupted []*azure.AsyncOperationState `json:"interrupted"`
+}
+
+func listJobsHandler(w http.ResponseWriter, r *http.Request) {
+	interrupted, err := azure.ListInterruptedAsyncOps(r.Context())
+	if err != nil {
+		_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(fmt.Errorf("Failed to list interrupted operations: %v", err)))
+		return
+	}
+	writeJSON(w, r, http.StatusOK, jobsResponse{
+		Draining:    jobs.Draining(),
+		Queues:      jobs.Status(),
+		Jobs:        jobs.List(),
+		Interrupted: interrupted,
+	})
+}
+
+type mapping struct {
+	ResourceType     string `json:"resourceType"`
+	Provider         string `json:"provider"`
+	Type             string `json:"type"`
+	Tag              string `json:"tag"`
+	TrimmedBundleTag string `json:"trimmedBundleTag"`
+	BundleDigest     string `json:"bundleDigest"`
+	Loaded           bool   `json:"loaded"`
+	// Draining is true if the resource type was removed from the provider mappings and new requests are rejected
+	Draining bool `json:"draining,omitempty"`
+}
+
+func listMappingsHandler(w http.ResponseWriter, r *http.Request) {
+	mappings := make([]mapping, 0)
+	for _, providers := range []map[string]*settings.BundleInformation{settings.Providers(), settings.RemovedProviders()} {
+		for rpType, bundleInfo := range providers {
+			m := mapping{
+				ResourceType:     rpType,
+				Provider:         bundleInfo.ResourceProvider,
+				Type:             bundleInfo.ResourceType,
+				TrimmedBundleTag: bundleInfo.TrimmedBundleTag,
+				BundleDigest:     bundleInfo.BundleDigest,
+				Loaded:           bundleInfo.RPBundle != nil,
+				Draining:         settings.IsRemoved(bundleInfo),
+			}
+			if bundleInfo.BundlePullOptions != nil {
+				m.Tag = bundleInfo.BundlePullOptions.Tag
+			}
+			mappings = append(mappings, m)
+		}
+	}
+	sort.Slice(mappings, func(i, j int) bool {
+		return mappings[i].ResourceType < mappings[j].ResourceType
+	})
+	writeJSON(w, r, http.StatusOK, mappings)
+}
+
+// writeJSON writes the response with credentials and sensitive parameters masked
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Errorf("Failed to serialise admin response: %v", err)
+		_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(redact.Body(body))
+}
@@ -0,0 +1,222 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	az "github.com/Azure/go-autorest/autorest/azure"
+	"github.com/go-chi/render"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/azure"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/helpers"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/jobs"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/logging"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/models"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/settings"
+	log "github.com/sirupsen/logrus"
+)
+
+// ForceFailedMessage is the error recorded against a resource that an operator has failed
+const ForceFailedMessage = "The operation was failed by an administrator"
+
+type resourceResponse struct {
+	ResourceId        string                       `json:"resourceId"`
+	SubscriptionId    string                       `json:"subscriptionId"`
+	InstallationName  string                       `json:"installationName"`
+	BundleTag         string                       `json:"bundleTag"`
+	ProvisioningState string                       `json:"provisioningState"`
+	OperationId       string                       `json:"operationId,omitempty"`
+	Status            string                       `json:"status,omitempty"`
+	ActionOperationId string                       `json:"actionOperationId,omitempty"`
+	Error             *helpers.ErrorResponse       `json:"error,omitempty"`
+	Parameters        map[string]interface{}       `json:"parameters,omitempty"`
+	Credentials       map[string]interface{}       `json:"credentials,omitempty"`
+	Job               *jobs.JobInfo                `json:"job,omitempty"`
+	AsyncOperations   []*azure.AsyncOperationState `json:"asyncOperations"`
+}
+
+// resource is the state of the resource in the id query parameter
+type resource struct {
+	id               string
+	subscriptionId   string
+	name             string
+	bundleInfo       *settings.BundleInformation
+	installationName string
+	properties       *models.BundleCommandProperties
+}
+
+// loadResource reads the state of the resource in the id query parameter, it renders an error response and returns nil if the state cannot be read
+func loadResource(w http.ResponseWriter, r *http.Request) *resource {
+	id := r.URL.Query().Get("id")
+	if len(id) == 0 {
+		_ = render.Render(w, r, helpers.ErrorInvalidRequest("id query parameter should be set to the resource id"))
+		return nil
+	}
+	parsed, err := az.ParseResourceID(id)
+	if err != nil {
+		_ = render.Render(w, r, helpers.ErrorInvalidRequest(fmt.Sprintf("Failed to parse resource id %s: %v", id, err)))
+		return nil
+	}
+	bundleInfo, err := azure.GetBundleInformation(id)
+	if err != nil {
+		_ = render.Render(w, r, helpers.ErrorInvalidRequestFromError(err))
+		return nil
+	}
+	properties, err := azure.GetRPState(r.Context(), parsed.SubscriptionID, id)
+	if err != nil {
+		if azure.IsNotFoundError(err) {
+			_ = render.Render(w, r, helpers.ErrorNotFound())
+			return nil
+		}
+		_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(fmt.Errorf("Failed to get RPState: %v", err)))
+		return nil
+	}
+	properties.BundleInformation = bundleInfo
+	return &resource{
+		id:               id,
+		subscriptionId:   parsed.SubscriptionID,
+		name:             parsed.ResourceName,
+		bundleInfo:       bundleInfo,
+		installationName: helpers.GetInstallationName(bundleInfo.TrimmedBundleTag, id),
+		properties:       properties,
+	}
+}
+
+func getResourceHandler(w http.ResponseWriter, r *http.Request) {
+	res := loadResource(w, r)
+	if res == nil {
+		return
+	}
+	operations, err := azure.ListAsyncOps(r.Context(), res.subscriptionId, res.id)
+	if err != nil {
+		_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(fmt.Errorf("Failed to list async operations: %v", err)))
+		return
+	}
+	response := resourceResponse{
+		ResourceId:        res.id,
+		SubscriptionId:    res.subscriptionId,
+		InstallationName:  res.installationName,
+		BundleTag:         res.bundleInfo.BundlePullOptions.Tag,
+		ProvisioningState: res.properties.ProvisioningState,
+		OperationId:       res.properties.OperationId,
+		Status:            res.properties.Status,
+		ActionOperationId: res.properties.ActionOperationId,
+		Error:             res.properties.ErrorResponse,
+		Parameters:        res.properties.Parameters,
+		Credentials:       res.properties.Credentials,
+		AsyncOperations:   operations,
+	}
+	if job, ok := jobs.FindByResource(res.subscriptionId, res.id); ok {
+		response.Job = job
+	}
+	writeJSON(w, r, http.StatusOK, response)
+}
+
+// failResourceHandler moves a resource that is stuck in a non terminal state to Failed and fails its running operations so that ARM stops polling and the request can be retried
+func failResourceHandler(w http.ResponseWriter, r *http.Request) {
+	res := loadResource(w, r)
+	if res == nil {
+		return
+	}
+	if job, ok := jobs.FindByResource(res.subscriptionId, res.id); ok {
+		_ = render.Render(w, r, helpers.ErrorConflict(fmt.Sprintf("Resource has a %s %s job for operation %s", job.State, job.Queue, job.OperationId)))
+		return
+	}
+	failProvisioning := !azure.IsTerminalProvisioningState(res.properties.ProvisioningState)
+	failAction := len(res.properties.Status) > 0
+	if !failProvisioning && !failAction {
+		_ = render.Render(w, r, helpers.ErrorConflict(fmt.Sprintf("Resource Provisioning State is: %s and no action is running", res.properties.ProvisioningState)))
+		return
+	}
+
+	logging.FromContext(r.Context()).Infof("Failing resource %s in provisioning state %s", res.id, res.properties.ProvisioningState)
+	responseError := helpers.ErrorInternalServerError(ForceFailedMessage)
+	if failProvisioning {
+		if err := azure.SetFailedProvisioningState(r.Context(), res.subscriptionId, res.id, responseError); err != nil {
+			_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(fmt.Errorf("Failed to update state:%v", err)))
+			return
+		}
+		if err := failAsyncOp(r.Context(), res.subscriptionId, res.properties.OperationId); err != nil {
+			_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(err))
+			return
+		}
+	}
+	if failAction {
+		if err := azure.UpdateRPStatus(r.Context(), res.subscriptionId, res.id, "", "", ""); err != nil {
+			_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(fmt.Errorf("Failed to update state:%v", err)))
+			return
+		}
+		if err := failAsyncOp(r.Context(), res.subscriptionId, res.properties.ActionOperationId); err != nil {
+			_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(err))
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func failAsyncOp(ctx context.Context, subscriptionId string, operationId string) error {
+	if len(operationId) == 0 {
+		return nil
+	}
+	state, err := azure.GetAsyncOp(ctx, subscriptionId, operationId)
+	if err != nil {
+		if azure.IsNotFoundError(err) {
+			log.Debugf("Async op %s not found", operationId)
+			return nil
+		}
+		return fmt.Errorf("Failed to get async op %s :%v", operationId, err)
+	}
+	if state.Status == helpers.AsyncOperationComplete || state.Status == helpers.AsyncOperationFailed {
+		return nil
+	}
+	asyncOp := azure.AsyncOperationState{
+		Action:  state.Action,
+		Status:  helpers.AsyncOperationFailed,
+		Error:   ForceFailedMessage,
+		EndTime: time.Now().UTC(),
+	}
+	if err := azure.PutAsyncOp(ctx, subscriptionId, operationId, &asyncOp); err != nil {
+		return fmt.Errorf("Failed to update async op %s :%v", operationId, err)
+	}
+	return nil
+}
+
+// requeueResourceHandler queues the PUT or DELETE job again for a resource that is being created, updated or deleted but has no job, jobs that were interrupted by a shutdown are requeued when the handler starts
+func requeueResourceHandler(w http.ResponseWriter, r *http.Request) {
+	if jobs.Draining() {
+		_ = render.Render(w, r, helpers.ErrorServiceUnavailable("The resource handler is shutting down"))
+		return
+	}
+	res := loadResource(w, r)
+	if res == nil {
+		return
+	}
+	if job, ok := jobs.FindByResource(res.subscriptionId, res.id); ok {
+		_ = render.Render(w, r, helpers.ErrorConflict(fmt.Sprintf("Resource has a %s %s job for operation %s", job.State, job.Queue, job.OperationId)))
+		return
+	}
+
+	rpInput := &models.BundleRP{
+		RPProperties: models.RPProperties{
+			Id:             res.id,
+			Name:           res.name,
+			Type:           settings.GetRPName(res.bundleInfo.ResourceProvider, res.bundleInfo.ResourceType),
+			SubscriptionId: res.subscriptionId,
+			RequestPath:    res.id,
+		},
+		Properties: res.properties,
+	}
+	if err := jobs.Requeue(r.Context(), rpInput, res.installationName, res.bundleInfo); err != nil {
+		if errors.Is(err, jobs.ErrNotRequeueable) {
+			_ = render.Render(w, r, helpers.ErrorConflict(err.Error()))
+			return
+		}
+		_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(err))
+		return
+	}
+
+	job, _ := jobs.FindByResource(res.subscriptionId, res.id)
+	writeJSON(w, r, http.StatusAccepted, job)
+}
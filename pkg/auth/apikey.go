@@ -0,0 +1,32 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+)
+
+// APIKeyHeader is the header containing the API key, the key is not accepted in the query string as request URLs are logged
+const APIKeyHeader = "X-Api-Key"
+
+type apiKeyAuthenticator struct {
+	key []byte
+}
+
+func newAPIKeyAuthenticator(key string) (*apiKeyAuthenticator, error) {
+	if len(key) == 0 {
+		return nil, errors.New("AUTH_API_KEY should be set when using API key authentication")
+	}
+	return &apiKeyAuthenticator{key: []byte(key)}, nil
+}
+
+func (a *apiKeyAuthenticator) authenticate(r *http.Request) error {
+	key := r.Header.Get(APIKeyHeader)
+	if len(key) == 0 {
+		return errors.New("No API key in request")
+	}
+	if subtle.ConstantTimeCompare([]byte(key), a.key) != 1 {
+		return errors.New("API key is not valid")
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/render"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/helpers"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/settings"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ModeNone       = "none"
+	ModeClientCert = "clientcert"
+	ModeJWT        = "jwt"
+	ModeAPIKey     = "apikey"
+)
+
+// Config contains the settings for authenticating inbound requests
+type Config struct {
+	Mode string
+	// Thumbprints are the SHA1 thumbprints of the client certificates that are accepted
+	Thumbprints []string
+	// ClientCertHeader is the name of the header containing the base64 encoded client certificate when TLS is terminated before the handler
+	ClientCertHeader string
+	// ClientCertHeaderTrusted must be set for ClientCertHeader to be used, it should only be set when the handler is behind a proxy that verifies the client certificate and replaces the header so that clients cannot set it
+	ClientCertHeaderTrusted bool
+	// ClientCAFile is a PEM file of the certificate authorities that client certificates presented to the handler must chain to, the system roots are used if it is empty
+	ClientCAFile string
+	// NativeTLS is true when the handler terminates TLS itself, client certificates are then only taken from the TLS connection
+	NativeTLS bool
+	Issuer    string
+	Audience  string
+	JWKSURL   string
+	APIKey    string
+}
+
+type authenticator interface {
+	authenticate(r *http.Request) error
+}
+
+// ConfigFromSettings returns the authentication config from the environment settings, NativeTLS is not set as it depends on the TLS settings
+func ConfigFromSettings() Config {
+	config := Config{
+		Mode:                    strings.ToLower(settings.OptionalSettings["AuthMode"].(string)),
+		ClientCertHeader:        settings.OptionalSettings["AuthCertHeader"].(string),
+		ClientCertHeaderTrusted: settings.OptionalSettings["AuthCertHeaderTrusted"].(bool),
+		ClientCAFile:            settings.OptionalSettings["AuthCertCAFile"].(string),
+		Issuer:                  settings.OptionalSettings["AuthJWTIssuer"].(string),
+		Audience:                settings.OptionalSettings["AuthJWTAudience"].(string),
+		JWKSURL:                 settings.OptionalSettings["AuthJWKSURL"].(string),
+		APIKey:                  settings.OptionalSettings["AuthAPIKey"].(string),
+	}
+	for _, t := range strings.Split(settings.OptionalSettings["AuthCertThumbprints"].(string), ",") {
+		if t = strings.TrimSpace(t); len(t) > 0 {
+			config.Thumbprints = append(config.Thumbprints, t)
+		}
+	}
+	return config
+}
+
+// New returns middleware that authenticates requests using the mode set in config
+func New(config Config) (func(http.Handler) http.Handler, error) {
+	var a authenticator
+	var err error
+	switch config.Mode {
+	case "", ModeNone:
+		log.Info("Inbound requests are not authenticated")
+		return func(next http.Handler) http.Handler { return next }, nil
+	case ModeClientCert:
+		a, err = newClientCertAuthenticator(config)
+	case ModeJWT:
+		a, err = newJWTAuthenticator(config.Issuer, config.Audience, config.JWKSURL)
+	case ModeAPIKey:
+		a, err = newAPIKeyAuthenticator(config.APIKey)
+	default:
+		err = fmt.Errorf("Unknown authentication mode %s, expected one of %s, %s, %s or %s", config.Mode, ModeNone, ModeClientCert, ModeJWT, ModeAPIKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Authenticating inbound requests using %s", config.Mode)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := a.authenticate(r); err != nil {
+				log.Infof("Failed to authenticate request for %s: %v", r.URL.Path, err)
+				_ = render.Render(w, r, helpers.ErrorUnauthorized("Request is not authenticated"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
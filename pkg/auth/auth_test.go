@@ -0,0 +1,234 @@
+package auth_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/auth"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/auth/authtest"
+)
+
+const (
+	audience = "api://cnab-custom-resource-handler"
+	apiKey   = "test-api-key"
+	// certHeader is the header a trusted proxy passes the client certificate in
+	certHeader = "X-ARR-ClientCert"
+)
+
+type authCase struct {
+	name string
+	// request sets the credentials on the request
+	request func(r *http.Request)
+	// authenticated is true if the request should be passed to the handler
+	authenticated bool
+}
+
+func TestAuthenticate(t *testing.T) {
+	ca, err := authtest.NewCA()
+	if err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+	otherCA, err := authtest.NewCA()
+	if err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+	dir, err := ioutil.TempDir("", "authtest")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, ca.PEM(), 0600); err != nil {
+		t.Fatalf("Failed to write CA file: %v", err)
+	}
+	client, thumbprint := issue(t, ca, time.Now().Add(time.Hour))
+	expired, expiredThumbprint := issue(t, ca, time.Now().Add(-time.Hour))
+	other, _ := issue(t, ca, time.Now().Add(time.Hour))
+	untrusted, untrustedThumbprint := issue(t, otherCA, time.Now().Add(time.Hour))
+	thumbprints := []string{thumbprint, expiredThumbprint, untrustedThumbprint}
+
+	jwks, err := authtest.NewJWKS()
+	if err != nil {
+		t.Fatalf("Failed to start JWKS endpoint: %v", err)
+	}
+	defer jwks.Close()
+	otherJWKS, err := authtest.NewJWKS()
+	if err != nil {
+		t.Fatalf("Failed to start JWKS endpoint: %v", err)
+	}
+	defer otherJWKS.Close()
+
+	tests := []struct {
+		name   string
+		config auth.Config
+		cases  []authCase
+	}{
+		{
+			name: "client certificate",
+			config: auth.Config{
+				Mode:         auth.ModeClientCert,
+				Thumbprints:  thumbprints,
+				ClientCAFile: caFile,
+				NativeTLS:    true,
+			},
+			cases: []authCase{
+				{name: "valid", request: peerCertificates(client), authenticated: true},
+				{name: "expired", request: peerCertificates(expired)},
+				{name: "wrong thumbprint", request: peerCertificates(other)},
+				{name: "untrusted issuer", request: peerCertificates(untrusted)},
+				{name: "missing credential", request: func(r *http.Request) {}},
+				{name: "header is ignored", request: header(certHeader, authtest.EncodeCertificate(client))},
+			},
+		},
+		{
+			name: "client certificate from trusted proxy",
+			config: auth.Config{
+				Mode:                    auth.ModeClientCert,
+				Thumbprints:             thumbprints,
+				ClientCertHeader:        certHeader,
+				ClientCertHeaderTrusted: true,
+			},
+			cases: []authCase{
+				{name: "valid", request: header(certHeader, authtest.EncodeCertificate(client)), authenticated: true},
+				{name: "expired", request: header(certHeader, authtest.EncodeCertificate(expired))},
+				{name: "wrong thumbprint", request: header(certHeader, authtest.EncodeCertificate(other))},
+				{name: "invalid certificate", request: header(certHeader, "bm90IGEgY2VydGlmaWNhdGU=")},
+				{name: "missing credential", request: func(r *http.Request) {}},
+			},
+		},
+		{
+			name: "JWT",
+			config: auth.Config{
+				Mode:     auth.ModeJWT,
+				Issuer:   jwks.Issuer,
+				Audience: audience,
+				JWKSURL:  jwks.URL(),
+			},
+			cases: []authCase{
+				{name: "valid", request: bearer(t, jwks, claims(jwks.Issuer, audience, time.Hour)), authenticated: true},
+				{name: "expired", request: bearer(t, jwks, claims(jwks.Issuer, audience, -time.Hour))},
+				{name: "no expiry", request: bearer(t, jwks, map[string]interface{}{"iss": jwks.Issuer, "aud": audience})},
+				{name: "wrong issuer", request: bearer(t, jwks, claims(otherJWKS.Issuer, audience, time.Hour))},
+				{name: "wrong audience", request: bearer(t, jwks, claims(jwks.Issuer, "api://other", time.Hour))},
+				{name: "wrong key", request: bearer(t, otherJWKS, claims(jwks.Issuer, audience, time.Hour))},
+				{name: "missing credential", request: func(r *http.Request) {}},
+			},
+		},
+		{
+			name: "API key",
+			config: auth.Config{
+				Mode:   auth.ModeAPIKey,
+				APIKey: apiKey,
+			},
+			cases: []authCase{
+				{name: "valid", request: header(auth.APIKeyHeader, apiKey), authenticated: true},
+				{name: "wrong key", request: header(auth.APIKeyHeader, "other-key")},
+				{name: "query string is ignored", request: func(r *http.Request) { r.URL.RawQuery = "code=" + apiKey }},
+				{name: "missing credential", request: func(r *http.Request) {}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authenticate, err := auth.New(tt.config)
+			if err != nil {
+				t.Fatalf("Failed to create authenticator: %v", err)
+			}
+			for _, c := range tt.cases {
+				t.Run(c.name, func(t *testing.T) {
+					called := false
+					handler := authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						called = true
+					}))
+					r := httptest.NewRequest(http.MethodGet, "/subscriptions/sub/resourceGroups/rg/providers/Microsoft.CustomProviders/resourceProviders/rp/test/test", nil)
+					c.request(r)
+					w := httptest.NewRecorder()
+					handler.ServeHTTP(w, r)
+					if called != c.authenticated {
+						t.Errorf("request was passed to the handler: %v, expected %v", called, c.authenticated)
+					}
+					if !c.authenticated && w.Code != http.StatusUnauthorized {
+						t.Errorf("status %d, expected %d", w.Code, http.StatusUnauthorized)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestNewClientCertConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config auth.Config
+		valid  bool
+	}{
+		{name: "native TLS", config: auth.Config{NativeTLS: true}, valid: true},
+		{name: "trusted proxy", config: auth.Config{ClientCertHeader: certHeader, ClientCertHeaderTrusted: true}, valid: true},
+		{name: "header without trusted proxy", config: auth.Config{ClientCertHeader: certHeader}},
+		{name: "header with native TLS", config: auth.Config{ClientCertHeader: certHeader, ClientCertHeaderTrusted: true, NativeTLS: true}},
+		{name: "trusted proxy without header", config: auth.Config{ClientCertHeaderTrusted: true}},
+		{name: "no TLS", config: auth.Config{}},
+		{name: "missing CA file", config: auth.Config{NativeTLS: true, ClientCAFile: filepath.Join(os.TempDir(), "missing-ca.pem")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.Mode = auth.ModeClientCert
+			tt.config.Thumbprints = []string{"00"}
+			_, err := auth.New(tt.config)
+			if tt.valid && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func issue(t *testing.T, ca *authtest.CA, notAfter time.Time) (*tls.Certificate, string) {
+	cert, thumbprint, err := ca.IssueClientCertificateValidUntil("client", notAfter)
+	if err != nil {
+		t.Fatalf("Failed to issue client certificate: %v", err)
+	}
+	return cert, thumbprint
+}
+
+func peerCertificates(cert *tls.Certificate) func(r *http.Request) {
+	return func(r *http.Request) {
+		r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert.Leaf}}
+	}
+}
+
+func header(name string, value string) func(r *http.Request) {
+	return func(r *http.Request) {
+		r.Header.Set(name, value)
+	}
+}
+
+func claims(issuer string, audience string, expiry time.Duration) map[string]interface{} {
+	return map[string]interface{}{
+		"iss": issuer,
+		"aud": audience,
+		"nbf": time.Now().Add(-time.Hour).Unix(),
+		"exp": time.Now().Add(expiry).Unix(),
+	}
+}
+
+func bearer(t *testing.T, jwks *authtest.JWKS, claims map[string]interface{}) func(r *http.Request) {
+	token, err := jwks.Sign(claims)
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	return func(r *http.Request) {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+}
@@ -0,0 +1,190 @@
+// Package authtest provides a local certificate authority and JSON Web Key Set endpoint for testing authentication without Azure
+package authtest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/auth"
+)
+
+// CA is a self signed certificate authority that issues client and server certificates
+type CA struct {
+	Certificate *x509.Certificate
+	key         *rsa.PrivateKey
+	serial      int64
+}
+
+// NewCA creates a new certificate authority
+func NewCA() (*CA, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate CA key: %v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "cnab-custom-resource-handler test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse CA certificate: %v", err)
+	}
+	return &CA{Certificate: cert, key: key, serial: 1}, nil
+}
+
+// Pool returns a certificate pool containing the CA certificate
+func (ca *CA) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Certificate)
+	return pool
+}
+
+// PEM returns the PEM encoded CA certificate
+func (ca *CA) PEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate.Raw})
+}
+
+// IssueClientCertificate issues a client certificate and returns it along with its thumbprint
+func (ca *CA) IssueClientCertificate(commonName string) (*tls.Certificate, string, error) {
+	return ca.IssueClientCertificateValidUntil(commonName, time.Now().Add(24*time.Hour))
+}
+
+// IssueClientCertificateValidUntil issues a client certificate that expires at notAfter and returns it along with its thumbprint
+func (ca *CA) IssueClientCertificateValidUntil(commonName string, notAfter time.Time) (*tls.Certificate, string, error) {
+	return ca.issue(commonName, nil, x509.ExtKeyUsageClientAuth, notAfter)
+}
+
+// IssueServerCertificate issues a server certificate for the DNS names
+func (ca *CA) IssueServerCertificate(dnsNames ...string) (*tls.Certificate, error) {
+	cert, _, err := ca.issue(dnsNames[0], dnsNames, x509.ExtKeyUsageServerAuth, time.Now().Add(24*time.Hour))
+	return cert, err
+}
+
+func (ca *CA) issue(commonName string, dnsNames []string, usage x509.ExtKeyUsage, notAfter time.Time) (*tls.Certificate, string, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to generate key: %v", err)
+	}
+	ca.serial++
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-48 * time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, ca.Certificate, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to parse certificate: %v", err)
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        cert,
+	}, auth.Thumbprint(cert), nil
+}
+
+// EncodeCertificate returns the certificate in the base64 DER form expected in the client certificate header
+func EncodeCertificate(cert *tls.Certificate) string {
+	return base64.StdEncoding.EncodeToString(cert.Certificate[0])
+}
+
+// PEM returns the PEM encoded certificate and private key
+func PEM(cert *tls.Certificate) ([]byte, []byte) {
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(cert.PrivateKey.(*rsa.PrivateKey))})
+	return certPEM, keyPEM
+}
+
+// JWKS is a stand in for an identity provider, it serves a JSON Web Key Set and issues tokens signed with its key
+type JWKS struct {
+	Server *httptest.Server
+	Issuer string
+	key    *rsa.PrivateKey
+	kid    string
+}
+
+// NewJWKS starts a JWKS endpoint, Close should be called when it is no longer needed
+func NewJWKS() (*JWKS, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to generate signing key: %v", err)
+	}
+	j := JWKS{
+		key: key,
+		kid: "test-key",
+	}
+	j.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keySet := map[string]interface{}{
+			"keys": []map[string]string{
+				{
+					"kid": j.kid,
+					"kty": "RSA",
+					"use": "sig",
+					"alg": "RS256",
+					"n":   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+					"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+				},
+			},
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(keySet)
+	}))
+	j.Issuer = j.Server.URL + "/"
+	return &j, nil
+}
+
+// URL returns the URL of the key set
+func (j *JWKS) URL() string {
+	return j.Server.URL
+}
+
+// IssueToken returns a signed token for the audience that expires after expiry, a negative expiry issues an expired token
+func (j *JWKS) IssueToken(audience string, expiry time.Duration) (string, error) {
+	return j.Sign(map[string]interface{}{
+		"iss": j.Issuer,
+		"aud": audience,
+		"iat": time.Now().Add(-time.Hour).Unix(),
+		"nbf": time.Now().Add(-time.Hour).Unix(),
+		"exp": time.Now().Add(expiry).Unix(),
+	})
+}
+
+// Sign returns a token with the claims signed with the key served by the JWKS endpoint
+func (j *JWKS) Sign(claims map[string]interface{}) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims(claims))
+	token.Header["kid"] = j.kid
+	return token.SignedString(j.key)
+}
+
+// Close stops the JWKS endpoint
+func (j *JWKS) Close() {
+	j.Server.Close()
+}
@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type clientCertAuthenticator struct {
+	thumbprints map[string]bool
+	// header is only set when the handler is behind a trusted proxy that terminates TLS
+	header string
+	// roots are the certificate authorities that certificates from the TLS connection must chain to, nil uses the system roots
+	roots *x509.CertPool
+}
+
+func newClientCertAuthenticator(config Config) (*clientCertAuthenticator, error) {
+	if len(config.Thumbprints) == 0 {
+		return nil, errors.New("AUTH_CLIENT_CERT_THUMBPRINTS should be set when using client certificate authentication")
+	}
+	a := clientCertAuthenticator{
+		thumbprints: make(map[string]bool),
+	}
+	for _, t := range config.Thumbprints {
+		a.thumbprints[strings.ToUpper(t)] = true
+	}
+	switch {
+	case config.ClientCertHeaderTrusted && config.NativeTLS:
+		return nil, errors.New("AUTH_CLIENT_CERT_HEADER_TRUSTED cannot be set when the handler terminates TLS, the client certificate is taken from the TLS connection")
+	case config.ClientCertHeaderTrusted && len(config.ClientCertHeader) == 0:
+		return nil, errors.New("AUTH_CLIENT_CERT_HEADER should be set when AUTH_CLIENT_CERT_HEADER_TRUSTED is true")
+	case config.ClientCertHeaderTrusted:
+		a.header = config.ClientCertHeader
+	case len(config.ClientCertHeader) > 0:
+		return nil, errors.New("AUTH_CLIENT_CERT_HEADER is only used when AUTH_CLIENT_CERT_HEADER_TRUSTED is true, it should only be set when the handler is behind a proxy that verifies the client certificate and sets the header")
+	case !config.NativeTLS:
+		return nil, errors.New("Client certificate authentication needs TLS_CERT_FILE to be set or the certificate to be passed by a trusted proxy in AUTH_CLIENT_CERT_HEADER")
+	}
+	if len(config.ClientCAFile) > 0 {
+		pem, err := ioutil.ReadFile(config.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read client certificate authorities from %s: %v", config.ClientCAFile, err)
+		}
+		a.roots = x509.NewCertPool()
+		if !a.roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", config.ClientCAFile)
+		}
+	}
+	return &a, nil
+}
+
+func (a *clientCertAuthenticator) authenticate(r *http.Request) error {
+	cert, err := a.getClientCertificate(r)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return fmt.Errorf("Client certificate %s is not valid at %v", cert.Subject, now)
+	}
+	thumbprint := Thumbprint(cert)
+	if !a.thumbprints[thumbprint] {
+		return fmt.Errorf("Client certificate thumbprint %s is not allowed", thumbprint)
+	}
+	return nil
+}
+
+// getClientCertificate returns the certificate from the header set by the trusted proxy, otherwise the certificate from the TLS connection once its chain has been verified as the TLS listener only requests the certificate
+func (a *clientCertAuthenticator) getClientCertificate(r *http.Request) (*x509.Certificate, error) {
+	if len(a.header) > 0 {
+		return a.getHeaderCertificate(r)
+	}
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil, errors.New("No client certificate in request")
+	}
+	cert := r.TLS.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, c := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(c)
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:         a.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return nil, fmt.Errorf("Failed to verify client certificate %s: %v", cert.Subject, err)
+	}
+	return cert, nil
+}
+
+func (a *clientCertAuthenticator) getHeaderCertificate(r *http.Request) (*x509.Certificate, error) {
+	value := r.Header.Get(a.header)
+	if len(value) == 0 {
+		return nil, fmt.Errorf("No client certificate in header %s", a.header)
+	}
+	der, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode client certificate from header %s: %v", a.header, err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse client certificate from header %s: %v", a.header, err)
+	}
+	return cert, nil
+}
+
+// Thumbprint returns the upper case hex SHA1 thumbprint of the certificate, this is the format Azure uses to identify certificates
+func Thumbprint(cert *x509.Certificate) string {
+	return fmt.Sprintf("%X", sha1.Sum(cert.Raw))
+}
@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// jwksRefreshInterval is how long keys are cached for
+	jwksRefreshInterval = time.Hour
+	// jwksMinRefreshInterval limits how often an unknown key id causes the keys to be fetched
+	jwksMinRefreshInterval = time.Minute
+)
+
+type jwtAuthenticator struct {
+	issuer   string
+	audience string
+	keys     *jwksCache
+}
+
+func newJWTAuthenticator(issuer string, audience string, jwksURL string) (*jwtAuthenticator, error) {
+	if len(issuer) == 0 || len(jwksURL) == 0 {
+		return nil, errors.New("AUTH_JWT_ISSUER and AUTH_JWKS_URL should be set when using JWT authentication")
+	}
+	return &jwtAuthenticator{
+		issuer:   issuer,
+		audience: audience,
+		keys: &jwksCache{
+			url:    jwksURL,
+			client: &http.Client{Timeout: 10 * time.Second},
+		},
+	}, nil
+}
+
+func (a *jwtAuthenticator) authenticate(r *http.Request) error {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return errors.New("No bearer token in request")
+	}
+	token, err := jwt.Parse(header[7:], func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("Unexpected signing method %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		return a.keys.getKey(kid)
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to validate token: %v", err)
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return errors.New("Token is not valid")
+	}
+	// the expiry is only checked by Parse when it is present, a token without one would never expire
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return errors.New("Token has no expiry")
+	}
+	if !claims.VerifyIssuer(a.issuer, true) {
+		return fmt.Errorf("Token issuer %v is not valid", claims["iss"])
+	}
+	if len(a.audience) > 0 && !claims.VerifyAudience(a.audience, true) {
+		return fmt.Errorf("Token audience %v is not valid", claims["aud"])
+	}
+	return nil
+}
+
+type jwksCache struct {
+	url     string
+	client  *http.Client
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func (c *jwksCache) getKey(kid string) (*rsa.PublicKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	age := time.Since(c.fetched)
+	key, ok := c.keys[kid]
+	if ok && age < jwksRefreshInterval {
+		return key, nil
+	}
+	if c.keys == nil || age > jwksMinRefreshInterval {
+		if err := c.refresh(); err != nil {
+			// keep using the cached key if the endpoint is unavailable
+			if ok {
+				log.Infof("Failed to refresh keys from %s using cached key: %v", c.url, err)
+				return key, nil
+			}
+			return nil, err
+		}
+		key, ok = c.keys[kid]
+	}
+	if !ok {
+		return nil, fmt.Errorf("Key %s not found in %s", kid, c.url)
+	}
+	return key, nil
+}
+
+func (c *jwksCache) refresh() error {
+	log.Debugf("Fetching keys from %s", c.url)
+	resp, err := c.client.Get(c.url)
+	if err != nil {
+		return fmt.Errorf("Failed to get keys from %s: %v", c.url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed to get keys from %s status: %d", c.url, resp.StatusCode)
+	}
+	var keySet jsonWebKeySet
+	if err := json.NewDecoder(resp.Body).Decode(&keySet); err != nil {
+		return fmt.Errorf("Failed to decode keys from %s: %v", c.url, err)
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range keySet.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		key, err := parseRSAKey(k)
+		if err != nil {
+			log.Debugf("Ignoring key %s: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	c.keys = keys
+	c.fetched = time.Now()
+	return nil
+}
+
+func parseRSAKey(k jsonWebKey) (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode modulus: %v", err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode exponent: %v", err)
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
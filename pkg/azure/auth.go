@@ -2,15 +2,20 @@ package azure
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2019-04-01/storage"
 	"github.com/Azure/go-autorest/autorest"
 	"github.com/Azure/go-autorest/autorest/adal"
-	"github.com/Azure/go-autorest/autorest/azure/auth"
+	"github.com/Azure/go-autorest/autorest/azure/cli"
 	"github.com/simongdavies/cnab-custom-resource-handler/pkg/helpers"
 	"github.com/simongdavies/cnab-custom-resource-handler/pkg/settings"
 	log "github.com/sirupsen/logrus"
@@ -18,43 +23,236 @@ import (
 
 const (
 	msiTokenEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+	// cliTokenRefreshBuffer is how long before expiry a token from the az cli is refreshed
+	cliTokenRefreshBuffer = 5 * time.Minute
 )
 
+// Credential sources that can be used in AZURE_CREDENTIAL_ORDER
+const (
+	CredentialServicePrincipal = "serviceprincipal"
+	CredentialWorkloadIdentity = "workloadidentity"
+	CredentialMSI              = "msi"
+	CredentialCLI              = "cli"
+)
+
+// DefaultCredentialOrder is the order that credential sources are tried in if AZURE_CREDENTIAL_ORDER is not set
+var DefaultCredentialOrder = []string{CredentialServicePrincipal, CredentialWorkloadIdentity, CredentialMSI, CredentialCLI}
+
 // LoginInfo contains Azure login information
 type LoginInfo struct {
 	Authorizer         autorest.Authorizer
 	OAuthTokenProvider adal.OAuthTokenProvider
+	// Source is the credential source that was used to login
+	Source      string
+	ensureFresh func() error
 }
 
-func LoginToAzure() (LoginInfo, error) {
-	var loginInfo LoginInfo
-	var err error
+var loginInfo *LoginInfo
 
-	if checkForMSIEndpoint() {
-		// Attempt to login with MSI
-		log.Debug("Attempting to Login with MSI")
-		msiConfig := auth.NewMSIConfig()
-		loginInfo.Authorizer, err = msiConfig.Authorizer()
-		if err == nil {
-			log.Debug("Logged in with MSI")
-			return loginInfo, nil
+var credentialSources = map[string]func(resource string) (*LoginInfo, error){
+	CredentialServicePrincipal: loginWithServicePrincipal,
+	CredentialWorkloadIdentity: loginWithWorkloadIdentity,
+	CredentialMSI:              loginWithMSI,
+	CredentialCLI:              loginWithCLI,
+}
+
+// InitialiseCredentials tries each credential source in the order set in AZURE_CREDENTIAL_ORDER and caches the first one that can get a token, the cached credential refreshes its own tokens so it is used for the lifetime of the process
+func InitialiseCredentials() error {
+	order := DefaultCredentialOrder
+	if val := settings.OptionalSettings["AzureCredentialOrder"].(string); len(val) > 0 {
+		order = nil
+		for _, source := range strings.Split(val, ",") {
+			order = append(order, strings.ToLower(strings.TrimSpace(source)))
 		}
-	} else {
-		log.Debug("Unable to find MSI Endpoint")
 	}
 
-	// Attempt to Login using azure CLI
-	log.Debug("Attempting to Login with az cli")
-	loginInfo.Authorizer, err = auth.NewAuthorizerFromCLI()
-	if err == nil {
-		log.Debug("Logged in with CLI")
-		return loginInfo, nil
-	} else {
-		log.Debugf("Failed to login with Azure cli: %v", err)
+	var errs []string
+	for _, source := range order {
+		login, ok := credentialSources[source]
+		if !ok {
+			return fmt.Errorf("Unknown credential source %s, expected one of %s", source, strings.Join(DefaultCredentialOrder, ","))
+		}
+		log.Debugf("Attempting to Login with %s", source)
+		info, err := login(tokenAudience())
+		if err != nil {
+			log.Debugf("Failed to login with %s: %v", source, err)
+			errs = append(errs, fmt.Sprintf("%s: %v", source, err))
+			continue
+		}
+		log.Infof("Logged in to Azure with %s", source)
+		loginInfo = info
+		return nil
 	}
+	return fmt.Errorf("No Azure credential available: %s", strings.Join(errs, "; "))
+}
+
+// LoginToAzure returns the cached credential created by InitialiseCredentials
+func LoginToAzure() (LoginInfo, error) {
+	if loginInfo == nil {
+		return LoginInfo{}, errors.New("No Azure credential available")
+	}
+	return *loginInfo, nil
+}
+
+// UseLoginInfo replaces the cached credential, it is used to run the handler with a credential that does not come from Azure such as in tests
+func UseLoginInfo(info *LoginInfo) {
+	if info != nil && info.ensureFresh == nil {
+		info.ensureFresh = func() error { return nil }
+	}
+	loginInfo = info
+}
 
-	return loginInfo, fmt.Errorf("Failed to login with MSI: %v", err)
+// CheckCredentials returns an error if there is no credential or it can no longer get a token
+func CheckCredentials() error {
+	if loginInfo == nil {
+		return errors.New("No Azure credential available")
+	}
+	return loginInfo.ensureFresh()
+}
 
+func getOAuthConfig(tenantID string) (*adal.OAuthConfig, error) {
+	activeDirectoryEndpoint := Environment.ActiveDirectoryEndpoint
+	// set by the workload identity webhook
+	if authorityHost := os.Getenv("AZURE_AUTHORITY_HOST"); len(authorityHost) > 0 {
+		activeDirectoryEndpoint = authorityHost
+	}
+	return adal.NewOAuthConfig(activeDirectoryEndpoint, tenantID)
+}
+
+func newLoginInfoFromToken(spt *adal.ServicePrincipalToken, source string) (*LoginInfo, error) {
+	// getting a token now means that a missing or invalid credential is found at startup rather than on the first request
+	if err := spt.EnsureFresh(); err != nil {
+		return nil, fmt.Errorf("Failed to get token: %v", err)
+	}
+	return &LoginInfo{
+		Authorizer:         autorest.NewBearerAuthorizer(spt),
+		OAuthTokenProvider: spt,
+		Source:             source,
+		ensureFresh:        spt.EnsureFresh,
+	}, nil
+}
+
+func loginWithServicePrincipal(resource string) (*LoginInfo, error) {
+	clientID := os.Getenv("AZURE_CLIENT_ID")
+	clientSecret := os.Getenv("AZURE_CLIENT_SECRET")
+	tenantID := os.Getenv("AZURE_TENANT_ID")
+	if len(clientID) == 0 || len(clientSecret) == 0 || len(tenantID) == 0 {
+		return nil, errors.New("AZURE_CLIENT_ID, AZURE_CLIENT_SECRET and AZURE_TENANT_ID should be set")
+	}
+	oauthConfig, err := getOAuthConfig(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	spt, err := adal.NewServicePrincipalToken(*oauthConfig, clientID, clientSecret, resource)
+	if err != nil {
+		return nil, err
+	}
+	return newLoginInfoFromToken(spt, CredentialServicePrincipal)
+}
+
+// federatedTokenSecret uses the token in the projected service account token file as the client assertion, the file is read each time a token is requested as it is rotated
+type federatedTokenSecret struct {
+	file string
+}
+
+func (s *federatedTokenSecret) SetAuthenticationValues(spt *adal.ServicePrincipalToken, v *url.Values) error {
+	token, err := ioutil.ReadFile(s.file)
+	if err != nil {
+		return fmt.Errorf("Failed to read federated token file %s: %v", s.file, err)
+	}
+	v.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+	v.Set("client_assertion", strings.TrimSpace(string(token)))
+	return nil
+}
+
+func (s *federatedTokenSecret) MarshalJSON() ([]byte, error) {
+	return nil, errors.New("Federated token secret cannot be serialised")
+}
+
+func loginWithWorkloadIdentity(resource string) (*LoginInfo, error) {
+	clientID := os.Getenv("AZURE_CLIENT_ID")
+	tenantID := os.Getenv("AZURE_TENANT_ID")
+	tokenFile := os.Getenv("AZURE_FEDERATED_TOKEN_FILE")
+	if len(clientID) == 0 || len(tenantID) == 0 || len(tokenFile) == 0 {
+		return nil, errors.New("AZURE_CLIENT_ID, AZURE_TENANT_ID and AZURE_FEDERATED_TOKEN_FILE should be set")
+	}
+	oauthConfig, err := getOAuthConfig(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	spt, err := adal.NewServicePrincipalTokenWithSecret(*oauthConfig, clientID, resource, &federatedTokenSecret{file: tokenFile})
+	if err != nil {
+		return nil, err
+	}
+	return newLoginInfoFromToken(spt, CredentialWorkloadIdentity)
+}
+
+func loginWithMSI(resource string) (*LoginInfo, error) {
+	if !checkForMSIEndpoint() {
+		return nil, errors.New("Unable to find MSI Endpoint")
+	}
+	msiEndpoint, err := adal.GetMSIEndpoint()
+	if err != nil {
+		return nil, err
+	}
+	spt, err := adal.NewServicePrincipalTokenFromMSI(msiEndpoint, resource)
+	if err != nil {
+		return nil, err
+	}
+	return newLoginInfoFromToken(spt, CredentialMSI)
+}
+
+// cliTokenProvider caches the token from the az cli and gets a new one when it is about to expire
+type cliTokenProvider struct {
+	resource string
+	mu       sync.Mutex
+	token    adal.Token
+}
+
+func (p *cliTokenProvider) refresh() error {
+	cliToken, err := cli.GetTokenFromCLI(p.resource)
+	if err != nil {
+		return err
+	}
+	token, err := cliToken.ToADALToken()
+	if err != nil {
+		return err
+	}
+	p.token = token
+	return nil
+}
+
+func (p *cliTokenProvider) ensureFresh() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.token.WillExpireIn(cliTokenRefreshBuffer) {
+		return nil
+	}
+	return p.refresh()
+}
+
+func (p *cliTokenProvider) OAuthToken() string {
+	if err := p.ensureFresh(); err != nil {
+		log.Errorf("Failed to refresh token from az cli: %v", err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.token.AccessToken
+}
+
+func loginWithCLI(resource string) (*LoginInfo, error) {
+	provider := cliTokenProvider{
+		resource: resource,
+	}
+	if err := provider.refresh(); err != nil {
+		return nil, err
+	}
+	return &LoginInfo{
+		Authorizer:         autorest.NewBearerAuthorizer(&provider),
+		OAuthTokenProvider: &provider,
+		Source:             CredentialCLI,
+		ensureFresh:        provider.ensureFresh,
+	}, nil
 }
 
 func checkForMSIEndpoint() bool {
@@ -74,29 +272,62 @@ func checkForMSIEndpoint() bool {
 	return err == nil
 }
 
-// SetAzureStorageInfo. The Azure plugin expects the connection string to be set in an environment variable , the Azure CNAB Driver requires an account key to access file shares and the storage package requires details of the storage account and tables that are used
+// SetAzureStorageInfo. The Azure plugin expects the connection string to be set in an environment variable , the Azure CNAB Driver requires an account key to access file shares and the storage package requires details of the storage account and tables that are used.
+// The storage account can be set with a connection string, an account name and key, or an account name, resource group and subscription in which case the key is looked up using ARM
 func SetAzureStorageInfo() error {
-	var loginInfo LoginInfo
-	var err error
-	if loginInfo, err = LoginToAzure(); err != nil {
-		return fmt.Errorf("Login to Azure Failed: %v", err)
-	}
-	result, err := getstorageAccountKey(loginInfo.Authorizer, settings.RequiredSettings["SusbcriptionId"], settings.RequiredSettings["StorageResourceGroup"], settings.RequiredSettings["StorageAccountName"])
-	if err != nil {
-		return fmt.Errorf("Get Storage Account Key Failed: %v", err)
+	StateTableName = settings.RequiredSettings["StateTable"]
+	AsyncOperationTableName = settings.RequiredSettings["AsyncOpTable"]
+	StorageTableEndpoint = settings.OptionalSettings["StorageTableEndpoint"].(string)
+
+	connectionString := settings.OptionalSettings["StorageConnection"].(string)
+	if len(connectionString) > 0 {
+		if err := setStorageInfoFromConnectionString(connectionString); err != nil {
+			return err
+		}
+	} else {
+		StorageAccountName = settings.OptionalSettings["StorageAccountName"].(string)
+		StorageAccountKey = settings.OptionalSettings["StorageAccountKey"].(string)
+		if len(StorageAccountName) == 0 {
+			return fmt.Errorf("Either %s or CNAB_AZURE_STATE_STORAGE_ACCOUNT_NAME should be set", AzureStorageConnectionString)
+		}
+		if len(StorageAccountKey) == 0 {
+			key, err := getStorageAccountKeyFromARM()
+			if err != nil {
+				return err
+			}
+			StorageAccountKey = key
+		}
+		connectionString = fmt.Sprintf("AccountName=%s;AccountKey=%s;EndpointSuffix=%s", StorageAccountName, StorageAccountKey, StorageEndpointSuffix)
 	}
 
-	os.Setenv(AzureStorageConnectionString, fmt.Sprintf("AccountName=%s;AccountKey=%s", settings.RequiredSettings["StorageAccountName"], *(((*result.Keys)[0]).Value)))
+	os.Setenv(AzureStorageConnectionString, connectionString)
 	// this is used by the Azure CNAB Driver
-	os.Setenv(CnabStateStorageAccountKey, *(((*result.Keys)[0]).Value))
-	// these are used by Table Storage functions
-	StorageAccountName = settings.RequiredSettings["StorageAccountName"]
-	StorageAccountKey = *(((*result.Keys)[0]).Value)
-	StateTableName = settings.RequiredSettings["StateTable"]
-	AsyncOperationTableName = settings.RequiredSettings["AsyncOpTable"]
+	os.Setenv(CnabStateStorageAccountKey, StorageAccountKey)
 	return nil
 }
 
+// CredentialsRequired returns true if the storage account key has to be looked up using ARM, this is the only use of the Azure credential so it is not needed when a connection string or an account key is set or in dev mode
+func CredentialsRequired() bool {
+	return !settings.DevMode && len(settings.OptionalSettings["StorageConnection"].(string)) == 0 && len(settings.OptionalSettings["StorageAccountKey"].(string)) == 0
+}
+
+func getStorageAccountKeyFromARM() (string, error) {
+	subscriptionID := settings.OptionalSettings["SusbcriptionId"].(string)
+	resourceGroupName := settings.OptionalSettings["StorageResourceGroup"].(string)
+	if len(subscriptionID) == 0 || len(resourceGroupName) == 0 {
+		return "", fmt.Errorf("CNAB_AZURE_SUBSCRIPTION_ID and CNAB_AZURE_STATE_STORAGE_RESOURCE_GROUP should be set to look up the key for storage account %s", StorageAccountName)
+	}
+	loginInfo, err := LoginToAzure()
+	if err != nil {
+		return "", fmt.Errorf("Login to Azure Failed: %v", err)
+	}
+	result, err := getstorageAccountKey(loginInfo.Authorizer, subscriptionID, resourceGroupName, StorageAccountName)
+	if err != nil {
+		return "", fmt.Errorf("Get Storage Account Key Failed: %v", err)
+	}
+	return *(((*result.Keys)[0]).Value), nil
+}
+
 func getstorageAccountKey(authorizer autorest.Authorizer, subscriptionID string, resourceGroupName string, storageAccountName string) (*storage.AccountListKeysResult, error) {
 	client := GetStorageAccountsClient(subscriptionID, authorizer, helpers.UserAgent())
 	ctx, cancel := context.WithCancel(context.Background())
@@ -7,7 +7,7 @@ import (
 
 // GetStorageAccountsClient gets a Storage Account Client
 func GetStorageAccountsClient(subscriptionID string, authorizer autorest.Authorizer, userAgent string) storage.AccountsClient {
-	accountsClient := storage.NewAccountsClient(subscriptionID)
+	accountsClient := storage.NewAccountsClientWithBaseURI(Environment.ResourceManagerEndpoint, subscriptionID)
 	accountsClient.Authorizer = authorizer
 	_ = accountsClient.AddToUserAgent(userAgent)
 	return accountsClient
@@ -0,0 +1,58 @@
+package azure
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/settings"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// AzureEnvironmentName and AzureEnvironmentFilePath are the variables used by go-autorest to select the cloud, they are also read by the Azure CNAB Driver
+	AzureEnvironmentName     = "AZURE_ENVIRONMENT"
+	AzureEnvironmentFilePath = "AZURE_ENVIRONMENT_FILEPATH"
+	// azureStackCloudName tells go-autorest to load the environment from AZURE_ENVIRONMENT_FILEPATH
+	azureStackCloudName = "AZURESTACKCLOUD"
+)
+
+// Environment is the Azure cloud that is used for ARM, Azure AD and storage endpoints
+var Environment = azure.PublicCloud
+
+// InitialiseEnvironment sets Environment from the environment file in AZURE_ENVIRONMENT_FILEPATH or the cloud name in AZURE_ENVIRONMENT and exports the selection so that it is used by the Azure CNAB Driver
+func InitialiseEnvironment() error {
+	name := settings.OptionalSettings["AzureEnvironment"].(string)
+	file := settings.OptionalSettings["AzureEnvironmentFile"].(string)
+	switch {
+	case len(file) > 0:
+		env, err := azure.EnvironmentFromFile(file)
+		if err != nil {
+			return fmt.Errorf("Failed to load Azure environment from %s: %v", file, err)
+		}
+		Environment = env
+		os.Setenv(AzureEnvironmentName, azureStackCloudName)
+	case len(name) > 0:
+		env, err := azure.EnvironmentFromName(name)
+		if err != nil {
+			return fmt.Errorf("Unknown Azure environment %s, expected one of AzurePublicCloud, AzureUSGovernmentCloud, AzureChinaCloud or AzureGermanCloud: %v", name, err)
+		}
+		Environment = env
+		os.Setenv(AzureEnvironmentName, env.Name)
+	default:
+		os.Setenv(AzureEnvironmentName, Environment.Name)
+	}
+	// a storage connection string may override the suffix
+	StorageEndpointSuffix = Environment.StorageEndpointSuffix
+	log.Infof("Using Azure environment %s", Environment.Name)
+	return nil
+}
+
+// tokenAudience returns the resource to request ARM tokens for
+func tokenAudience() string {
+	if len(strings.TrimSpace(Environment.TokenAudience)) > 0 {
+		return Environment.TokenAudience
+	}
+	return Environment.ResourceManagerEndpoint
+}
@@ -0,0 +1,407 @@
+package azure
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/helpers"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/models"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	localStateTable          = "state"
+	localAsyncOperationTable = "asyncOperations"
+	localTypeBinary          = "binary"
+	localTypeDateTime        = "datetime"
+)
+
+// LocalStateStore is a StateStore that keeps the state in memory and optionally saves it to a file, it is used to run without Azure in dev mode and tests
+type LocalStateStore struct {
+	mu     sync.Mutex
+	file   string
+	tables map[string]map[string]*storage.Entity
+	// saveErr is the error from the last attempt to save the file, it is reported by CheckStateStore
+	saveErr error
+}
+
+// localRow is the representation of a row in the state file, binary and date time values are tagged with their type so that they can be read back as the type the table storage client returns
+type localRow struct {
+	PartitionKey string                   `json:"partitionKey"`
+	RowKey       string                   `json:"rowKey"`
+	Timestamp    time.Time                `json:"timestamp"`
+	Properties   map[string]localProperty `json:"properties"`
+}
+
+type localProperty struct {
+	Type  string      `json:"type,omitempty"`
+	Value interface{} `json:"value"`
+}
+
+// NewLocalStateStore returns a LocalStateStore, if file is not empty the state is loaded from the file if it exists and saved to it after every change
+func NewLocalStateStore(file string) (*LocalStateStore, error) {
+	s := &LocalStateStore{
+		file: file,
+		tables: map[string]map[string]*storage.Entity{
+			localStateTable:          {},
+			localAsyncOperationTable: {},
+		},
+	}
+	if len(file) == 0 {
+		return s, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read state file %s: %v", file, err)
+	}
+	var tables map[string][]localRow
+	if err := json.Unmarshal(data, &tables); err != nil {
+		return nil, fmt.Errorf("Failed to parse state file %s: %v", file, err)
+	}
+	for name, rows := range tables {
+		if _, ok := s.tables[name]; !ok {
+			continue
+		}
+		for _, row := range rows {
+			entity, err := row.entity()
+			if err != nil {
+				return nil, fmt.Errorf("Failed to parse state file %s: %v", file, err)
+			}
+			s.tables[name][localKey(entity.PartitionKey, entity.RowKey)] = entity
+		}
+	}
+	return s, nil
+}
+
+func (s *LocalStateStore) GetRPState(ctx context.Context, partitionKey string, resourceId string) (*models.BundleCommandProperties, error) {
+	row, err := s.get(localStateTable, partitionKey, getRowKeyFromResourceId(resourceId))
+	if err != nil {
+		return nil, err
+	}
+	return rpStateFromEntity(row)
+}
+
+func (s *LocalStateStore) PutRPState(ctx context.Context, partitionKey string, resourceId string, properties *models.BundleCommandProperties) error {
+	p, err := rpStateProperties(properties)
+	if err != nil {
+		return err
+	}
+	return s.write(localStateTable, partitionKey, getRowKeyFromResourceId(resourceId), p, false, true)
+}
+
+func (s *LocalStateStore) DeleteRPState(ctx context.Context, partitionKey string, resourceId string) error {
+	return s.delete(localStateTable, partitionKey, getRowKeyFromResourceId(resourceId))
+}
+
+func (s *LocalStateStore) SetFailedProvisioningState(ctx context.Context, partitionKey string, resourceId string, errorResponse *helpers.ErrorResponse) error {
+	p, err := failedProvisioningProperties(errorResponse)
+	if err != nil {
+		return err
+	}
+	if err := s.write(localStateTable, partitionKey, getRowKeyFromResourceId(resourceId), p, true, false); err != nil {
+		return fmt.Errorf("Failed to SetFailedProvisioningState ErrorResponse:%v", err)
+	}
+	return nil
+}
+
+func (s *LocalStateStore) UpdateRPStatus(ctx context.Context, partitionKey string, resourceId string, status string, operationId string, fingerprint string) error {
+	p := map[string]interface{}{
+		"Status":            status,
+		"ActionOperationId": operationId,
+		"ActionFingerprint": fingerprint,
+	}
+	if err := s.write(localStateTable, partitionKey, getRowKeyFromResourceId(resourceId), p, true, false); err != nil {
+		return fmt.Errorf("Failed to update RP status:%v", err)
+	}
+	return nil
+}
+
+func (s *LocalStateStore) UpdateRPProvisioningState(ctx context.Context, partitionKey string, resourceId string, provisioningState string) error {
+	p := map[string]interface{}{
+		"ProvisioningState": provisioningState,
+	}
+	if err := s.write(localStateTable, partitionKey, getRowKeyFromResourceId(resourceId), p, true, false); err != nil {
+		return fmt.Errorf("Failed to update RP provisioning state:%v", err)
+	}
+	return nil
+}
+
+func (s *LocalStateStore) ListRPState(ctx context.Context, partitionKey string, resourceProviderName string, resourceTypeName string) (*storage.EntityQueryResult, error) {
+	filter := RPStateFilter{
+		SubscriptionId:   partitionKey,
+		ResourceProvider: resourceProviderName,
+		ResourceType:     resourceTypeName,
+	}
+	return &storage.EntityQueryResult{
+		Entities: s.query(localStateTable, filter.Matches),
+	}, nil
+}
+
+func (s *LocalStateStore) CountRPStateByProvisioningState(ctx context.Context) (map[string]map[string]int, error) {
+	counts := make(map[string]map[string]int)
+	addProvisioningStateCounts(counts, s.query(localStateTable, nil))
+	return counts, nil
+}
+
+// CheckStateStore returns the error from the last attempt to save the state file
+func (s *LocalStateStore) CheckStateStore(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.saveErr
+}
+
+func (s *LocalStateStore) PutAsyncOp(ctx context.Context, partitionKey string, operationId string, state *AsyncOperationState) error {
+	log.Debugf("Put AsyncOp for partition key: %s operationId: %s action:%s status %s", partitionKey, operationId, state.Action, state.Status)
+	return s.write(localAsyncOperationTable, partitionKey, operationId, asyncOpProperties(state), true, true)
+}
+
+func (s *LocalStateStore) GetAsyncOp(ctx context.Context, partitionKey string, operationId string) (*AsyncOperationState, error) {
+	row, err := s.get(localAsyncOperationTable, partitionKey, operationId)
+	if err != nil {
+		return nil, err
+	}
+	return getAsyncOpFromEntity(row), nil
+}
+
+func (s *LocalStateStore) ListAsyncOps(ctx context.Context, partitionKey string, resourceId string) ([]*AsyncOperationState, error) {
+	resourceId = strings.ToLower(resourceId)
+	rows := s.query(localAsyncOperationTable, func(row *storage.Entity) bool {
+		return row.PartitionKey == partitionKey && row.Properties["resourceId"] == resourceId
+	})
+	return asyncOpsFromEntities(rows), nil
+}
+
+func (s *LocalStateStore) ListTerminalAsyncOps(ctx context.Context) ([]*AsyncOperationState, error) {
+	rows := s.query(localAsyncOperationTable, func(row *storage.Entity) bool {
+		status := row.Properties["status"]
+		return status == helpers.AsyncOperationComplete || status == helpers.AsyncOperationFailed
+	})
+	return asyncOpsFromEntities(rows), nil
+}
+
+func (s *LocalStateStore) ListInterruptedAsyncOps(ctx context.Context) ([]*AsyncOperationState, error) {
+	rows := s.query(localAsyncOperationTable, func(row *storage.Entity) bool {
+		interrupted, _ := row.Properties["interrupted"].(bool)
+		return interrupted
+	})
+	return asyncOpsFromEntities(rows), nil
+}
+
+func (s *LocalStateStore) DeleteAsyncOp(ctx context.Context, partitionKey string, operationId string) error {
+	return s.delete(localAsyncOperationTable, partitionKey, operationId)
+}
+
+func (s *LocalStateStore) QueryRPState(ctx context.Context, filter RPStateFilter) ([]*storage.Entity, error) {
+	return s.query(localStateTable, filter.Matches), nil
+}
+
+func (s *LocalStateStore) GetRPStateEntity(ctx context.Context, partitionKey string, resourceId string) (*storage.Entity, error) {
+	return s.get(localStateTable, partitionKey, getRowKeyFromResourceId(resourceId))
+}
+
+func (s *LocalStateStore) ImportRPStateEntity(ctx context.Context, entity *storage.Entity) error {
+	return s.write(localStateTable, entity.PartitionKey, entity.RowKey, entity.Properties, false, true)
+}
+
+// get returns a copy of the row or a not found error in the same form as table storage
+func (s *LocalStateStore) get(table string, partitionKey string, rowKey string) (*storage.Entity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	row, ok := s.tables[table][localKey(partitionKey, rowKey)]
+	if !ok {
+		return nil, notFoundError(table, partitionKey, rowKey)
+	}
+	return copyEntity(row), nil
+}
+
+// write replaces the properties of the row or merges them into the existing properties, insert creates the row if it does not exist. Nil values are not stored as table storage does not store null properties
+func (s *LocalStateStore) write(table string, partitionKey string, rowKey string, properties map[string]interface{}, merge bool, insert bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := localKey(partitionKey, rowKey)
+	existing, ok := s.tables[table][key]
+	if !ok && !insert {
+		return notFoundError(table, partitionKey, rowKey)
+	}
+	p := make(map[string]interface{})
+	if ok && merge {
+		for k, v := range existing.Properties {
+			p[k] = v
+		}
+	}
+	for k, v := range properties {
+		if v == nil {
+			delete(p, k)
+			continue
+		}
+		p[k] = v
+	}
+	s.tables[table][key] = &storage.Entity{
+		PartitionKey: partitionKey,
+		RowKey:       rowKey,
+		TimeStamp:    time.Now().UTC(),
+		Properties:   p,
+	}
+	s.save()
+	return nil
+}
+
+func (s *LocalStateStore) delete(table string, partitionKey string, rowKey string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := localKey(partitionKey, rowKey)
+	if _, ok := s.tables[table][key]; !ok {
+		return notFoundError(table, partitionKey, rowKey)
+	}
+	delete(s.tables[table], key)
+	s.save()
+	return nil
+}
+
+// query returns copies of the rows that match in partition key then row key order which is the order table storage returns them in
+func (s *LocalStateStore) query(table string, match func(*storage.Entity) bool) []*storage.Entity {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rows := make([]*storage.Entity, 0)
+	for _, row := range s.tables[table] {
+		if match == nil || match(row) {
+			rows = append(rows, copyEntity(row))
+		}
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].PartitionKey != rows[j].PartitionKey {
+			return rows[i].PartitionKey < rows[j].PartitionKey
+		}
+		return rows[i].RowKey < rows[j].RowKey
+	})
+	return rows
+}
+
+// save writes the state file, it must be called with the lock held. A failure is logged and reported by CheckStateStore rather than failing the change as the state in memory is still correct
+func (s *LocalStateStore) save() {
+	if len(s.file) == 0 {
+		return
+	}
+	tables := make(map[string][]localRow)
+	for name, rows := range s.tables {
+		tables[name] = make([]localRow, 0, len(rows))
+		for _, row := range rows {
+			tables[name] = append(tables[name], newLocalRow(row))
+		}
+		sort.Slice(tables[name], func(i, j int) bool {
+			return localKey(tables[name][i].PartitionKey, tables[name][i].RowKey) < localKey(tables[name][j].PartitionKey, tables[name][j].RowKey)
+		})
+	}
+	s.saveErr = writeFileAtomic(s.file, tables)
+	if s.saveErr != nil {
+		log.Errorf("Failed to save state file %s: %v", s.file, s.saveErr)
+	}
+}
+
+func writeFileAtomic(file string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+func newLocalRow(entity *storage.Entity) localRow {
+	row := localRow{
+		PartitionKey: entity.PartitionKey,
+		RowKey:       entity.RowKey,
+		Timestamp:    entity.TimeStamp,
+		Properties:   make(map[string]localProperty),
+	}
+	for k, v := range entity.Properties {
+		switch value := v.(type) {
+		case []byte:
+			row.Properties[k] = localProperty{Type: localTypeBinary, Value: base64.StdEncoding.EncodeToString(value)}
+		case time.Time:
+			row.Properties[k] = localProperty{Type: localTypeDateTime, Value: value.UTC().Format(time.RFC3339Nano)}
+		default:
+			row.Properties[k] = localProperty{Value: value}
+		}
+	}
+	return row
+}
+
+func (row localRow) entity() (*storage.Entity, error) {
+	entity := &storage.Entity{
+		PartitionKey: row.PartitionKey,
+		RowKey:       row.RowKey,
+		TimeStamp:    row.Timestamp,
+		Properties:   make(map[string]interface{}),
+	}
+	for k, p := range row.Properties {
+		value, _ := p.Value.(string)
+		switch p.Type {
+		case localTypeBinary:
+			data, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				return nil, fmt.Errorf("property %s of row %s is not valid base64: %v", k, row.RowKey, err)
+			}
+			entity.Properties[k] = data
+		case localTypeDateTime:
+			t, err := time.Parse(time.RFC3339Nano, value)
+			if err != nil {
+				return nil, fmt.Errorf("property %s of row %s is not a valid time: %v", k, row.RowKey, err)
+			}
+			entity.Properties[k] = t
+		default:
+			entity.Properties[k] = p.Value
+		}
+	}
+	return entity, nil
+}
+
+func copyEntity(row *storage.Entity) *storage.Entity {
+	entity := &storage.Entity{
+		PartitionKey: row.PartitionKey,
+		RowKey:       row.RowKey,
+		TimeStamp:    row.TimeStamp,
+		Properties:   make(map[string]interface{}, len(row.Properties)),
+	}
+	for k, v := range row.Properties {
+		entity.Properties[k] = v
+	}
+	return entity
+}
+
+func localKey(partitionKey string, rowKey string) string {
+	return partitionKey + "\x00" + rowKey
+}
+
+func notFoundError(table string, partitionKey string, rowKey string) error {
+	return storage.AzureStorageServiceError{
+		StatusCode: http.StatusNotFound,
+		Code:       "ResourceNotFound",
+		Message:    fmt.Sprintf("The row %s/%s was not found in %s", partitionKey, rowKey, table),
+	}
+}
@@ -14,8 +14,11 @@ import (
 	"github.com/go-chi/render"
 	"github.com/google/uuid"
 	"github.com/simongdavies/cnab-custom-resource-handler/pkg/helpers"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/logging"
 	"github.com/simongdavies/cnab-custom-resource-handler/pkg/models"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/redact"
 	"github.com/simongdavies/cnab-custom-resource-handler/pkg/settings"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/tracing"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -24,17 +27,20 @@ type AzureLoginContextKey string
 const AzureLoginContext AzureLoginContextKey = "AzureLoginContext"
 
 type ResponseLogger struct {
-	w http.ResponseWriter
+	w   http.ResponseWriter
+	ctx context.Context
 }
 
-func NewResponseLogger(writer http.ResponseWriter) *ResponseLogger {
+// NewResponseLogger returns a writer that logs the response body with the log fields in ctx
+func NewResponseLogger(ctx context.Context, writer http.ResponseWriter) *ResponseLogger {
 	return &ResponseLogger{
-		w: writer,
+		w:   writer,
+		ctx: ctx,
 	}
 }
 
 func (r *ResponseLogger) Write(b []byte) (int, error) {
-	log.Debugf("Response Body:%s", string(b))
+	logging.FromContext(r.ctx).Debugf("Response Body:%s", string(redact.Body(b)))
 	return r.w.Write(b)
 }
 
@@ -46,16 +52,15 @@ func (r *ResponseLogger) WriteHeader(statusCode int) {
 	r.w.WriteHeader(statusCode)
 }
 
-// HTTP middleware setting original request URL on context
+// Login adds the cached Azure credential to the request context
 func Login(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var loginInfo LoginInfo
-		var err error
-		if loginInfo, err = LoginToAzure(); err != nil {
-			log.Infof("Failed to Login: %v", err)
+		loginInfo, err := LoginToAzure()
+		if err != nil {
+			logging.FromContext(r.Context()).Infof("Failed to Login: %v", err)
 			_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(fmt.Errorf("Failed to Login to Azure error: %v for request URI %s", err, r.RequestURI)))
+			return
 		}
-		log.Debugf("Logged in to Azure for request URI %s", r.RequestURI)
 		ctx := context.WithValue(r.Context(), AzureLoginContext, loginInfo)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
@@ -65,7 +70,7 @@ func LogResponseBody(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		writer := w
 		if settings.LogResponseBody {
-			writer = NewResponseLogger(w)
+			writer = NewResponseLogger(r.Context(), w)
 		}
 		next.ServeHTTP(writer, r)
 
@@ -76,10 +81,10 @@ func LogRequestBody(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if settings.LogRequestBody {
 			if body, err := ioutil.ReadAll(r.Body); err != nil {
-				log.Debug("Error Logging Request Body:%w", err)
+				logging.FromContext(r.Context()).Debugf("Error Logging Request Body:%v", err)
 			} else {
 				r.Body = ioutil.NopCloser(bytes.NewBuffer(body))
-				log.Debugf("Request Body:%s", string(body))
+				logging.FromContext(r.Context()).Debugf("Request Body:%s", string(redact.Body(body)))
 			}
 		}
 		next.ServeHTTP(w, r)
@@ -95,7 +100,15 @@ func RequestId(next http.Handler) http.Handler {
 		}
 		r.Header.Set(middleware.RequestIDHeader, requestId)
 		ctx = context.WithValue(ctx, middleware.RequestIDKey, requestId)
-		next.ServeHTTP(w, r.WithContext(ctx))
+		ctx = logging.WithFields(ctx, log.Fields{
+			logging.CorrelationIdField: requestId,
+			logging.RequestIdField:     r.Header.Get("X-Ms-Client-Request-Id"),
+		})
+		ctx, span := tracing.StartRequest(r.WithContext(ctx), requestId)
+		defer span.End()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+		tracing.SetStatusCode(span, ww.Status())
 	})
 }
 
@@ -110,38 +123,24 @@ func ValidateRPType(next http.Handler) http.Handler {
 		}
 		ctx := context.WithValue(r.Context(), models.BundleContext, payload)
 		requestPath := r.URL.Path
-		resource, err := az.ParseResourceID(requestPath)
+		bundleInfo, err := GetBundleInformation(requestPath)
 		if err != nil {
-			log.Infof("Failed to parse request path: %s Error: %v", requestPath, err)
-			_ = render.Render(w, r, helpers.ErrorInternalServerError(fmt.Sprintf("Failed to parse request path: %s Error: %v", requestPath, err)))
+			logging.FromContext(r.Context()).Info(err)
+			_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(err))
 			return
 		}
-
-		var bundleInfo *settings.BundleInformation
-		var ok bool
-		if settings.IsRPaaS {
-			rpName := settings.GetRPName(resource.Provider, resource.ResourceType)
-			bundleInfo, ok = settings.RPToProvider[rpName]
-			if !ok {
-				log.Infof("no mapping found for request: %s Provider:%s", requestPath, rpName)
-				_ = render.Render(w, r, helpers.ErrorInternalServerError(fmt.Sprintf("no mapping found for request: %s Provider:%s", requestPath, rpName)))
-				return
-			}
-			log.Debugf("Using Bundle %s to process request", bundleInfo.BundlePullOptions.Tag)
-		} else {
-			resource.ResourceType = strings.Split(requestPath, "/")[8]
-			rpName := settings.GetRPName(resource.Provider, resource.ResourceType)
-			bundleInfo, ok = settings.RPToProvider[rpName]
-			if !ok || !strings.EqualFold(resource.Provider, bundleInfo.ResourceProvider) || !strings.EqualFold(resource.ResourceType, bundleInfo.ResourceType) {
-				log.Infof("request: %s not for registered Resource Provider %s Resource Type:%s", requestPath, bundleInfo.ResourceProvider, bundleInfo.ResourceType)
-				_ = render.Render(w, r, helpers.ErrorInternalServerError(fmt.Sprintf("request: %s not for registered Resource Provider %s Resource Type:%s", requestPath, bundleInfo.ResourceProvider, bundleInfo.ResourceType)))
-				return
-			}
+		// operations and resources of a resource type that was removed from the mappings can still be read while it is drained
+		if r.Method != http.MethodGet && settings.IsRemoved(bundleInfo) {
+			rpName := settings.GetRPName(bundleInfo.ResourceProvider, bundleInfo.ResourceType)
+			logging.FromContext(r.Context()).Infof("Rejecting request for resource type %s that was removed from the provider mappings", rpName)
+			_ = render.Render(w, r, helpers.ErrorInvalidRequest(fmt.Sprintf("Resource type %s is no longer handled by this resource provider", rpName)))
+			return
 		}
+		logging.FromContext(r.Context()).Debugf("Using Bundle %s to process request", bundleInfo.BundlePullOptions.Tag)
 
 		payload.Properties.BundleInformation = bundleInfo
 		if strings.Contains(requestPath, "!") {
-			log.Infof("request: %s contains !", requestPath)
+			logging.FromContext(r.Context()).Infof("request: %s contains !", requestPath)
 			_ = render.Render(w, r, helpers.ErrorInternalServerError(fmt.Sprintf("resource name: %s is not valid ! character is not allowed", requestPath)))
 			return
 		}
@@ -150,6 +149,32 @@ func ValidateRPType(next http.Handler) http.Handler {
 	})
 }
 
+// GetBundleInformation returns the bundle that handles the resource type in the request path or resource id
+func GetBundleInformation(requestPath string) (*settings.BundleInformation, error) {
+	resource, err := az.ParseResourceID(requestPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse request path: %s Error: %v", requestPath, err)
+	}
+	if settings.IsRPaaS {
+		rpName := settings.GetRPName(resource.Provider, resource.ResourceType)
+		bundleInfo, ok := settings.ProviderFor(rpName)
+		if !ok {
+			// resource types that were removed from the mappings are still found until they have been drained
+			if bundleInfo, ok = settings.RemovedProviderFor(rpName); !ok {
+				return nil, fmt.Errorf("no mapping found for request: %s Provider:%s", requestPath, rpName)
+			}
+		}
+		return bundleInfo, nil
+	}
+	resource.ResourceType = strings.Split(requestPath, "/")[8]
+	rpName := settings.GetRPName(resource.Provider, resource.ResourceType)
+	bundleInfo, ok := settings.ProviderFor(rpName)
+	if !ok || !strings.EqualFold(resource.Provider, bundleInfo.ResourceProvider) || !strings.EqualFold(resource.ResourceType, bundleInfo.ResourceType) {
+		return nil, fmt.Errorf("request: %s not for registered Resource Provider %s Resource Type:%s", requestPath, resource.Provider, resource.ResourceType)
+	}
+	return bundleInfo, nil
+}
+
 func LoadState(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
@@ -161,6 +186,12 @@ func LoadState(next http.Handler) http.Handler {
 			return
 		}
 
+		r = r.WithContext(logging.WithFields(r.Context(), log.Fields{
+			logging.SubscriptionIdField:   resource.SubscriptionID,
+			logging.ResourceIdField:       *requestId,
+			logging.InstallationNameField: helpers.GetInstallationName(payload.Properties.TrimmedBundleTag, *requestId),
+		}))
+
 		// List request
 
 		if r.Method == "GET" && IsListRequest(*requestPath) {
@@ -168,7 +199,7 @@ func LoadState(next http.Handler) http.Handler {
 			return
 		}
 
-		properties, err := GetRPState(resource.SubscriptionID, *requestId)
+		properties, err := GetRPState(r.Context(), resource.SubscriptionID, *requestId)
 
 		if err != nil {
 			storageError, ok := err.(storage.AzureStorageServiceError)
@@ -178,6 +209,11 @@ func LoadState(next http.Handler) http.Handler {
 			}
 			if ok && storageError.StatusCode == 404 && r.Method != "PUT" && //Not found is valid for 1st Put (Create)
 				!(r.Method == "GET" && IsOperationsRequest(*requestPath)) { // Get on operations will produce not found
+				// ARM expects a DELETE of a resource that does not exist to succeed
+				if r.Method == "DELETE" {
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
 				_ = render.Render(w, r, helpers.ErrorNotFound())
 				return
 			}
@@ -195,8 +231,9 @@ func LoadState(next http.Handler) http.Handler {
 			}
 		case "POST":
 			{
-				// properties will be nil on first PUT of a resource
-				if !IsTerminalProvisioningState(properties.ProvisioningState) {
+				// A modifying action that is running sets the provisioning state to Updating, the handler decides if the request is a repeat of that action
+				updating := properties.ProvisioningState == helpers.ProvisioningStateUpdating && len(properties.Status) > 0
+				if !IsTerminalProvisioningState(properties.ProvisioningState) && !updating {
 					_ = render.Render(w, r, helpers.ErrorConflict(fmt.Sprintf("Resource Provisioning State is: %s", properties.ProvisioningState)))
 					return
 				}
@@ -217,9 +254,13 @@ func LoadState(next http.Handler) http.Handler {
 			payload.Properties.Parameters = properties.Parameters
 			payload.Properties.ErrorResponse = properties.ErrorResponse
 			payload.Properties.OperationId = properties.OperationId
+			payload.Properties.Fingerprint = properties.Fingerprint
+			payload.Properties.Status = properties.Status
+			payload.Properties.ActionOperationId = properties.ActionOperationId
+			payload.Properties.ActionFingerprint = properties.ActionFingerprint
 			// Need to exclude any porter injected outputs
 			installationName := helpers.GetInstallationName(payload.Properties.TrimmedBundleTag, *requestId)
-			outputs, err := helpers.GetBundleOutput(payload.Properties.BundleInformation.RPBundle, installationName, []string{"install", "upgrade"})
+			outputs, err := helpers.GetBundleOutput(r.Context(), payload.Properties.BundleInformation.RPBundle, installationName, []string{"install", "upgrade"})
 			if err != nil {
 				if payload.Properties.ProvisioningState != "" && !IsTerminalProvisioningState(payload.Properties.ProvisioningState) {
 					_ = render.Render(w, r, helpers.ErrorInternalServerError(fmt.Sprintf("Failed to get bundle outputs is: %v", err)))
@@ -227,7 +268,7 @@ func LoadState(next http.Handler) http.Handler {
 				}
 			} else {
 				for _, v := range outputs {
-					log.Debugf("Installation Name:%s Output:%s", installationName, v.Name)
+					logging.FromContext(r.Context()).Debugf("Installation Name:%s Output:%s", installationName, v.Name)
 					if IsSenstive, _ := payload.Properties.BundleInformation.RPBundle.IsOutputSensitive(v.Name); !IsSenstive {
 						if _, outputIsParameter := payload.Properties.BundleInformation.RPBundle.Parameters[v.Name]; outputIsParameter {
 							payload.Properties.Parameters[v.Name] = strings.TrimSuffix(v.Value, "\\n")
@@ -251,6 +292,18 @@ func IsOperationsRequest(requestPath string) bool {
 	return parts[len(parts)-2] == "operations"
 }
 
+// IsOperationsListRequest returns true if the request is for the list of async operations for a resource
+func IsOperationsListRequest(requestPath string) bool {
+	parts := strings.Split(requestPath, "/")
+	return IsListRequest(requestPath) && parts[len(parts)-1] == "operations"
+}
+
+// IsActionsListRequest returns true if the request is for the list of actions that can be invoked on a resource
+func IsActionsListRequest(requestPath string) bool {
+	parts := strings.Split(requestPath, "/")
+	return IsListRequest(requestPath) && parts[len(parts)-1] == "actions"
+}
+
 func IsListRequest(requestPath string) bool {
 	parts := strings.Split(requestPath, "/")
 	return len(parts)%2 == 0
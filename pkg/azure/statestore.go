@@ -0,0 +1,128 @@
+package azure
+
+import (
+	"context"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/helpers"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/models"
+)
+
+// StateStore stores the state of resources and async operations, rows are represented as table storage entities and a missing row is reported with a table storage not found error so that IsNotFoundError works with every implementation
+type StateStore interface {
+	GetRPState(ctx context.Context, partitionKey string, resourceId string) (*models.BundleCommandProperties, error)
+	PutRPState(ctx context.Context, partitionKey string, resourceId string, properties *models.BundleCommandProperties) error
+	DeleteRPState(ctx context.Context, partitionKey string, resourceId string) error
+	SetFailedProvisioningState(ctx context.Context, partitionKey string, resourceId string, errorResponse *helpers.ErrorResponse) error
+	UpdateRPStatus(ctx context.Context, partitionKey string, resourceId string, status string, operationId string, fingerprint string) error
+	UpdateRPProvisioningState(ctx context.Context, partitionKey string, resourceId string, provisioningState string) error
+	ListRPState(ctx context.Context, partitionKey string, resourceProviderName string, resourceTypeName string) (*storage.EntityQueryResult, error)
+	CountRPStateByProvisioningState(ctx context.Context) (map[string]map[string]int, error)
+	CheckStateStore(ctx context.Context) error
+	PutAsyncOp(ctx context.Context, partitionKey string, operationId string, state *AsyncOperationState) error
+	GetAsyncOp(ctx context.Context, partitionKey string, operationId string) (*AsyncOperationState, error)
+	ListAsyncOps(ctx context.Context, partitionKey string, resourceId string) ([]*AsyncOperationState, error)
+	ListTerminalAsyncOps(ctx context.Context) ([]*AsyncOperationState, error)
+	ListInterruptedAsyncOps(ctx context.Context) ([]*AsyncOperationState, error)
+	DeleteAsyncOp(ctx context.Context, partitionKey string, operationId string) error
+	QueryRPState(ctx context.Context, filter RPStateFilter) ([]*storage.Entity, error)
+	GetRPStateEntity(ctx context.Context, partitionKey string, resourceId string) (*storage.Entity, error)
+	ImportRPStateEntity(ctx context.Context, entity *storage.Entity) error
+}
+
+var stateStore StateStore = &tableStore{}
+
+// UseStateStore replaces the state store used by the package functions, the default is Azure table storage
+func UseStateStore(store StateStore) {
+	stateStore = store
+}
+
+// GetRPState returns the properties of the resource
+func GetRPState(ctx context.Context, partitionKey string, resourceId string) (*models.BundleCommandProperties, error) {
+	return stateStore.GetRPState(ctx, partitionKey, resourceId)
+}
+
+// PutRPState creates or replaces the state of the resource
+func PutRPState(ctx context.Context, partitionKey string, resourceId string, properties *models.BundleCommandProperties) error {
+	return stateStore.PutRPState(ctx, partitionKey, resourceId, properties)
+}
+
+// DeleteRPState deletes the state of the resource
+func DeleteRPState(ctx context.Context, partitionKey string, resourceId string) error {
+	return stateStore.DeleteRPState(ctx, partitionKey, resourceId)
+}
+
+// SetFailedProvisioningState sets the provisioning state of the resource to Failed and records the error
+func SetFailedProvisioningState(ctx context.Context, partitionKey string, resourceId string, errorResponse *helpers.ErrorResponse) error {
+	return stateStore.SetFailedProvisioningState(ctx, partitionKey, resourceId, errorResponse)
+}
+
+// UpdateRPStatus sets the status of the action that is running for the resource along with its operation id and a hash of its parameters
+func UpdateRPStatus(ctx context.Context, partitionKey string, resourceId string, status string, operationId string, fingerprint string) error {
+	return stateStore.UpdateRPStatus(ctx, partitionKey, resourceId, status, operationId, fingerprint)
+}
+
+// UpdateRPProvisioningState sets the provisioning state of the resource without changing any other properties
+func UpdateRPProvisioningState(ctx context.Context, partitionKey string, resourceId string, provisioningState string) error {
+	return stateStore.UpdateRPProvisioningState(ctx, partitionKey, resourceId, provisioningState)
+}
+
+// ListRPState returns the row keys of the resources of a type in a subscription
+func ListRPState(ctx context.Context, partitionKey string, resourceProviderName string, resourceTypeName string) (*storage.EntityQueryResult, error) {
+	return stateStore.ListRPState(ctx, partitionKey, resourceProviderName, resourceTypeName)
+}
+
+// CountRPStateByProvisioningState returns the number of resources in all partitions keyed by resource provider/resource type then provisioning state
+func CountRPStateByProvisioningState(ctx context.Context) (map[string]map[string]int, error) {
+	return stateStore.CountRPStateByProvisioningState(ctx)
+}
+
+// CheckStateStore checks that the state store can be reached
+func CheckStateStore(ctx context.Context) error {
+	return stateStore.CheckStateStore(ctx)
+}
+
+// PutAsyncOp creates or updates the async operation, properties that are not set in state are left unchanged on an existing operation
+func PutAsyncOp(ctx context.Context, partitionKey string, operationId string, state *AsyncOperationState) error {
+	return stateStore.PutAsyncOp(ctx, partitionKey, operationId, state)
+}
+
+// GetAsyncOp returns the async operation
+func GetAsyncOp(ctx context.Context, partitionKey string, operationId string) (*AsyncOperationState, error) {
+	return stateStore.GetAsyncOp(ctx, partitionKey, operationId)
+}
+
+// ListAsyncOps returns the async operations recorded for a resource
+func ListAsyncOps(ctx context.Context, partitionKey string, resourceId string) ([]*AsyncOperationState, error) {
+	return stateStore.ListAsyncOps(ctx, partitionKey, resourceId)
+}
+
+// ListTerminalAsyncOps returns the async operations in all partitions that have completed
+func ListTerminalAsyncOps(ctx context.Context) ([]*AsyncOperationState, error) {
+	return stateStore.ListTerminalAsyncOps(ctx)
+}
+
+// ListInterruptedAsyncOps returns the async operations in all partitions whose jobs were interrupted by a shutdown
+func ListInterruptedAsyncOps(ctx context.Context) ([]*AsyncOperationState, error) {
+	return stateStore.ListInterruptedAsyncOps(ctx)
+}
+
+// DeleteAsyncOp deletes the async operation
+func DeleteAsyncOp(ctx context.Context, partitionKey string, operationId string) error {
+	return stateStore.DeleteAsyncOp(ctx, partitionKey, operationId)
+}
+
+// QueryRPState returns the rows in the state table that match the filter, the rows are returned as stored so that they can be exported and imported
+func QueryRPState(ctx context.Context, filter RPStateFilter) ([]*storage.Entity, error) {
+	return stateStore.QueryRPState(ctx, filter)
+}
+
+// GetRPStateEntity returns the row in the state table for the resource as stored
+func GetRPStateEntity(ctx context.Context, partitionKey string, resourceId string) (*storage.Entity, error) {
+	return stateStore.GetRPStateEntity(ctx, partitionKey, resourceId)
+}
+
+// ImportRPStateEntity creates or replaces a row in the state table with a row that was returned by QueryRPState or GetRPStateEntity
+func ImportRPStateEntity(ctx context.Context, entity *storage.Entity) error {
+	return stateStore.ImportRPStateEntity(ctx, entity)
+}
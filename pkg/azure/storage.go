@@ -0,0 +1,140 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/metrics"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/tracing"
+)
+
+// StorageEndpointSuffix is the storage endpoint suffix used to build the table endpoint, it is set from the Azure environment or the connection string if one is set
+var StorageEndpointSuffix = storage.DefaultBaseURL
+
+// StorageUseHTTPS is false if the connection string sets DefaultEndpointsProtocol to http
+var StorageUseHTTPS = true
+
+// StorageTableEndpoint overrides the table endpoint, it is used when the tables are not at the default endpoint for the account such as Azurite running in another container
+var StorageTableEndpoint string
+
+// ParseConnectionString returns the values in a storage connection string keyed by lower case name
+func ParseConnectionString(connectionString string) (map[string]string, error) {
+	values := make(map[string]string)
+	for _, part := range strings.Split(connectionString, ";") {
+		part = strings.TrimSpace(part)
+		if len(part) == 0 {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid storage connection string, expected name=value but got %s", kv[0])
+		}
+		values[strings.ToLower(strings.TrimSpace(kv[0]))] = strings.TrimSpace(kv[1])
+	}
+	return values, nil
+}
+
+// setStorageInfoFromConnectionString sets the account name, key and endpoints from a connection string, UseDevelopmentStorage=true uses the emulator account
+func setStorageInfoFromConnectionString(connectionString string) error {
+	values, err := ParseConnectionString(connectionString)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(values["usedevelopmentstorage"], "true") {
+		StorageAccountName = storage.StorageEmulatorAccountName
+		StorageAccountKey = storage.StorageEmulatorAccountKey
+		StorageUseHTTPS = false
+		if proxy, ok := values["developmentstorageproxyuri"]; ok {
+			StorageTableEndpoint = proxy
+		}
+		return nil
+	}
+	StorageAccountName = values["accountname"]
+	StorageAccountKey = values["accountkey"]
+	if len(StorageAccountName) == 0 || len(StorageAccountKey) == 0 {
+		return fmt.Errorf("Storage connection string should contain AccountName and AccountKey or UseDevelopmentStorage=true")
+	}
+	if suffix, ok := values["endpointsuffix"]; ok {
+		StorageEndpointSuffix = suffix
+	}
+	if strings.EqualFold(values["defaultendpointsprotocol"], "http") {
+		StorageUseHTTPS = false
+	}
+	if endpoint, ok := values["tableendpoint"]; ok {
+		StorageTableEndpoint = endpoint
+	}
+	return nil
+}
+
+func newStorageClient(ctx context.Context) (storage.Client, error) {
+	var client storage.Client
+	var err error
+	if StorageAccountName == storage.StorageEmulatorAccountName {
+		client, err = storage.NewEmulatorClient()
+	} else {
+		client, err = storage.NewClient(StorageAccountName, StorageAccountKey, StorageEndpointSuffix, storage.DefaultAPIVersion, StorageUseHTTPS)
+	}
+	if err != nil {
+		return client, err
+	}
+	var transport http.RoundTripper = http.DefaultTransport
+	if len(StorageTableEndpoint) > 0 {
+		endpoint, err := url.Parse(StorageTableEndpoint)
+		if err != nil {
+			return client, fmt.Errorf("Failed to parse table endpoint %s: %v", StorageTableEndpoint, err)
+		}
+		transport = &endpointTransport{
+			endpoint: endpoint,
+			next:     transport,
+		}
+	}
+	client.HTTPClient = &http.Client{
+		Transport: tracing.Transport(ctx, "TableStorage", &metricsTransport{
+			next: transport,
+		}),
+	}
+	return client, nil
+}
+
+// metricsTransport records the latency and errors of table storage requests, not found is not counted as an error as it is the expected result of many lookups
+type metricsTransport struct {
+	next http.RoundTripper
+}
+
+func (t *metricsTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(r)
+	failed := err != nil || (resp.StatusCode >= 400 && resp.StatusCode != http.StatusNotFound)
+	metrics.ObserveStateStore(tableFromPath(r.URL.Path), r.Method, time.Since(start), failed)
+	return resp, err
+}
+
+// tableFromPath returns the table name from a table service request path such as /table(PartitionKey='p',RowKey='r')
+func tableFromPath(path string) string {
+	segments := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	table := segments[len(segments)-1]
+	if i := strings.Index(table, "("); i >= 0 {
+		table = table[:i]
+	}
+	return table
+}
+
+// endpointTransport sends requests to a different endpoint, the path of the endpoint is prefixed to the request path so that path style endpoints such as http://azurite:10002/account can be used
+type endpointTransport struct {
+	endpoint *url.URL
+	next     http.RoundTripper
+}
+
+func (t *endpointTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	req := r.Clone(r.Context())
+	req.URL.Scheme = t.endpoint.Scheme
+	req.URL.Host = t.endpoint.Host
+	req.URL.Path = strings.TrimSuffix(t.endpoint.Path, "/") + req.URL.Path
+	req.Host = t.endpoint.Host
+	return t.next.RoundTrip(req)
+}
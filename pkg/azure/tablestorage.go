@@ -3,15 +3,19 @@ package azure
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/storage"
 	"github.com/google/uuid"
 	"github.com/simongdavies/cnab-custom-resource-handler/pkg/helpers"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/logging"
 	"github.com/simongdavies/cnab-custom-resource-handler/pkg/models"
-	log "github.com/sirupsen/logrus"
 )
 
 const (
@@ -30,13 +34,24 @@ type RPState struct {
 }
 
 type AsyncOperationState struct {
-	Action string
-	Status string
-	Output string
+	SubscriptionId string
+	OperationId    string
+	ResourceId     string
+	Caller         string
+	Action         string
+	Status         string
+	Output         string
+	Error          string
+	StartTime      time.Time
+	EndTime        time.Time
+	// LastUpdated is the end time of the operation or the time the row was last modified if the end time was not recorded
+	LastUpdated time.Time
+	// Interrupted is true if the job for the operation was stopped by a shutdown before it finished, the operation is left running so that the job can be requeued
+	Interrupted bool
 }
 
-func getTableServiceClient() (*storage.TableServiceClient, error) {
-	client, err := storage.NewBasicClient(StorageAccountName, StorageAccountKey)
+func getTableServiceClient(ctx context.Context) (*storage.TableServiceClient, error) {
+	client, err := newStorageClient(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to get Table Service Client: %v", err)
 	}
@@ -44,10 +59,13 @@ func getTableServiceClient() (*storage.TableServiceClient, error) {
 	return &tableService, nil
 }
 
+// tableStore is the StateStore that uses Azure table storage
+type tableStore struct{}
+
 // TODO get guid from header/context
 
-func GetRPState(partitionKey string, resourceId string) (*models.BundleCommandProperties, error) {
-	client, err := getTableServiceClient()
+func (s *tableStore) GetRPState(ctx context.Context, partitionKey string, resourceId string) (*models.BundleCommandProperties, error) {
+	client, err := getTableServiceClient(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -55,27 +73,30 @@ func GetRPState(partitionKey string, resourceId string) (*models.BundleCommandPr
 	table := client.GetTableReference(StateTableName)
 	row := table.GetEntityReference(partitionKey, rowkey)
 	guid := uuid.New().String()
-	log.Debugf("Get RP State for parition key: %s row key: %s id: %s", partitionKey, rowkey, guid)
+	logging.FromContext(ctx).Debugf("Get RP State for parition key: %s row key: %s id: %s", partitionKey, rowkey, guid)
 	options := storage.GetEntityOptions{
 		RequestID: guid,
 	}
 	err = row.Get(timeout, storage.MinimalMetadata, &options)
 	if err != nil {
-		log.Debugf("Failed to GET state for %s", resourceId)
+		logging.FromContext(ctx).Debugf("Failed to GET state for %s", resourceId)
 		return nil, err
 	}
+	return rpStateFromEntity(row)
+}
+
+// rpStateFromEntity returns the resource properties stored in a state table row
+func rpStateFromEntity(row *storage.Entity) (*models.BundleCommandProperties, error) {
 	properties := models.BundleCommandProperties{}
 
 	if params, ok := row.Properties["Parameters"].(string); ok {
-		err = json.Unmarshal([]byte(params), &properties.Parameters)
-		if err != nil {
+		if err := json.Unmarshal([]byte(params), &properties.Parameters); err != nil {
 			return nil, fmt.Errorf("Failed to de-serialise parameters: %v", err)
 		}
 	}
 
 	if creds, ok := row.Properties["Credentials"].(string); ok {
-		err = json.Unmarshal([]byte(creds), &properties.Credentials)
-		if err != nil {
+		if err := json.Unmarshal([]byte(creds), &properties.Credentials); err != nil {
 			return nil, fmt.Errorf("Failed to de-serialise credentials: %v", err)
 		}
 	}
@@ -87,8 +108,8 @@ func GetRPState(partitionKey string, resourceId string) (*models.BundleCommandPr
 		if err != nil {
 			return nil, err
 		}
-		var result []byte
-		if _, err = reader.Read(result); err != nil {
+		result, err := ioutil.ReadAll(reader)
+		if err != nil {
 			return nil, err
 		}
 		err = json.Unmarshal(result, &properties.ErrorResponse)
@@ -101,25 +122,53 @@ func GetRPState(partitionKey string, resourceId string) (*models.BundleCommandPr
 	if val, ok := row.Properties["OperationId"].(string); ok {
 		properties.OperationId = val
 	}
+	if val, ok := row.Properties["Fingerprint"].(string); ok {
+		properties.Fingerprint = val
+	}
+	if val, ok := row.Properties["Status"].(string); ok {
+		properties.Status = val
+	}
+	if val, ok := row.Properties["ActionOperationId"].(string); ok {
+		properties.ActionOperationId = val
+	}
+	if val, ok := row.Properties["ActionFingerprint"].(string); ok {
+		properties.ActionFingerprint = val
+	}
 	return &properties, nil
 }
 
-func PutRPState(partitionKey string, resourceId string, properties *models.BundleCommandProperties) error {
-	client, err := getTableServiceClient()
+func (s *tableStore) PutRPState(ctx context.Context, partitionKey string, resourceId string, properties *models.BundleCommandProperties) error {
+	client, err := getTableServiceClient(ctx)
 	if err != nil {
 		return err
 	}
 	rowkey := getRowKeyFromResourceId(resourceId)
 	table := client.GetTableReference(StateTableName)
 	row := table.GetEntityReference(partitionKey, rowkey)
+	p, err := rpStateProperties(properties)
+	if err != nil {
+		return err
+	}
+	row.Properties = p
+	guid := uuid.New().String()
+	options := storage.EntityOptions{
+		Timeout:   timeout,
+		RequestID: guid,
+	}
+	logging.FromContext(ctx).Debugf("Put RP State for parition key: %s row key: %s id: %s", partitionKey, rowkey, guid)
+	return row.InsertOrReplace(&options)
+}
+
+// rpStateProperties returns the state table row properties for the resource properties
+func rpStateProperties(properties *models.BundleCommandProperties) (map[string]interface{}, error) {
 	p := make(map[string]interface{})
 	params, err := json.Marshal(properties.Parameters)
 	if err != nil {
-		return fmt.Errorf("Failed to serialise parameters:%v", err)
+		return nil, fmt.Errorf("Failed to serialise parameters:%v", err)
 	}
 	creds, err := json.Marshal(properties.Credentials)
 	if err != nil {
-		return fmt.Errorf("Failed to serialise creds:%v", err)
+		return nil, fmt.Errorf("Failed to serialise creds:%v", err)
 	}
 	// TODO use reflection
 	p["Parameters"] = string(params)
@@ -130,18 +179,14 @@ func PutRPState(partitionKey string, resourceId string, properties *models.Bundl
 	p["ResourceProvider"] = properties.BundleInformation.ResourceProvider
 	p["ResourceType"] = properties.BundleInformation.ResourceType
 	p["Status"] = properties.Status
-	row.Properties = p
-	guid := uuid.New().String()
-	options := storage.EntityOptions{
-		Timeout:   timeout,
-		RequestID: guid,
-	}
-	log.Debugf("Put RP State for parition key: %s row key: %s id: %s", partitionKey, rowkey, guid)
-	return row.InsertOrReplace(&options)
+	p["Fingerprint"] = properties.Fingerprint
+	p["ActionOperationId"] = properties.ActionOperationId
+	p["ActionFingerprint"] = properties.ActionFingerprint
+	return p, nil
 }
 
-func DeleteRPState(partitionKey string, resourceId string) error {
-	client, err := getTableServiceClient()
+func (s *tableStore) DeleteRPState(ctx context.Context, partitionKey string, resourceId string) error {
+	client, err := getTableServiceClient(ctx)
 	if err != nil {
 		return err
 	}
@@ -153,52 +198,88 @@ func DeleteRPState(partitionKey string, resourceId string) error {
 		Timeout:   timeout,
 		RequestID: guid,
 	}
-	log.Debugf("Delete RP State for parition key: %s row key: %s id: %s", partitionKey, rowkey, guid)
+	logging.FromContext(ctx).Debugf("Delete RP State for parition key: %s row key: %s id: %s", partitionKey, rowkey, guid)
 	return row.Delete(true, &options)
 }
 
-func SetFailedProvisioningState(partitionKey string, resourceId string, errorResponse *helpers.ErrorResponse) error {
-	client, err := getTableServiceClient()
+func (s *tableStore) SetFailedProvisioningState(ctx context.Context, partitionKey string, resourceId string, errorResponse *helpers.ErrorResponse) error {
+	client, err := getTableServiceClient(ctx)
 	if err != nil {
 		return err
 	}
 	rowkey := getRowKeyFromResourceId(resourceId)
 	table := client.GetTableReference(StateTableName)
 	row := table.GetEntityReference(partitionKey, rowkey)
+	p, err := failedProvisioningProperties(errorResponse)
+	if err != nil {
+		return err
+	}
+	row.Properties = p
+	guid := uuid.New().String()
+	options := storage.EntityOptions{
+		Timeout:   timeout,
+		RequestID: guid,
+	}
+	logging.FromContext(ctx).Debugf("SetFailedProvisioningState for parition key: %s row key: %s id: %s", partitionKey, rowkey, guid)
+	if err = row.Merge(true, &options); err != nil {
+		return fmt.Errorf("Failed to SetFailedProvisioningState ErrorResponse:%v", err)
+	}
+	return nil
+}
+
+// failedProvisioningProperties returns the state table row properties that are merged to record a failure
+func failedProvisioningProperties(errorResponse *helpers.ErrorResponse) (map[string]interface{}, error) {
 	p := make(map[string]interface{})
 	errResp, err := json.Marshal(errorResponse)
 	if err != nil {
-		return fmt.Errorf("Failed to serialise ErrorResponse:%v", err)
+		return nil, fmt.Errorf("Failed to serialise ErrorResponse:%v", err)
 	}
 	p["ProvisioningState"] = helpers.ProvisioningStateFailed
 	// compress error resp to avoid table storage size limit
 	var buf bytes.Buffer
 	zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if _, err := zw.Write(errResp); err != nil {
-		return err
+		return nil, err
 	}
 	if err = zw.Close(); err != nil {
-		return err
+		return nil, err
 	}
 	p["ErrorResponse"] = buf.Bytes()
+	return p, nil
+}
+
+// UpdateRPStatus sets the status of the action that is running for the resource along with its operation id and a hash of its parameters
+func (s *tableStore) UpdateRPStatus(ctx context.Context, partitionKey string, resourceId string, status string, operationId string, fingerprint string) error {
+	client, err := getTableServiceClient(ctx)
+	if err != nil {
+		return err
+	}
+	rowkey := getRowKeyFromResourceId(resourceId)
+	table := client.GetTableReference(StateTableName)
+	row := table.GetEntityReference(partitionKey, rowkey)
+	p := make(map[string]interface{})
+	p["Status"] = status
+	p["ActionOperationId"] = operationId
+	p["ActionFingerprint"] = fingerprint
 	row.Properties = p
 	guid := uuid.New().String()
 	options := storage.EntityOptions{
 		Timeout:   timeout,
 		RequestID: guid,
 	}
-	log.Debugf("SetFailedProvisioningState for parition key: %s row key: %s id: %s", partitionKey, rowkey, guid)
+	logging.FromContext(ctx).Debugf("Update RP status for parition key: %s row key: %s id: %s", partitionKey, rowkey, guid)
 	if err = row.Merge(true, &options); err != nil {
-		return fmt.Errorf("Failed to SetFailedProvisioningState ErrorResponse:%v", err)
+		return fmt.Errorf("Failed to update RP status:%v", err)
 	}
 	return nil
 }
 
-func UpdateRPStatus(partitionKey string, resourceId string, status string) error {
-	client, err := getTableServiceClient()
+// UpdateRPProvisioningState sets the provisioning state of the resource without changing any other properties
+func (s *tableStore) UpdateRPProvisioningState(ctx context.Context, partitionKey string, resourceId string, provisioningState string) error {
+	client, err := getTableServiceClient(ctx)
 	if err != nil {
 		return err
 	}
@@ -206,22 +287,22 @@ func UpdateRPStatus(partitionKey string, resourceId string, status string) error
 	table := client.GetTableReference(StateTableName)
 	row := table.GetEntityReference(partitionKey, rowkey)
 	p := make(map[string]interface{})
-	p["Status"] = status
+	p["ProvisioningState"] = provisioningState
 	row.Properties = p
 	guid := uuid.New().String()
 	options := storage.EntityOptions{
 		Timeout:   timeout,
 		RequestID: guid,
 	}
-	log.Debugf("Update RP status for parition key: %s row key: %s id: %s", partitionKey, rowkey, guid)
+	logging.FromContext(ctx).Debugf("Update RP provisioning state for parition key: %s row key: %s id: %s", partitionKey, rowkey, guid)
 	if err = row.Merge(true, &options); err != nil {
-		return fmt.Errorf("Failed to update RP status:%v", err)
+		return fmt.Errorf("Failed to update RP provisioning state:%v", err)
 	}
 	return nil
 }
 
-func ListRPState(partitionKey string, resourceProviderName string, resourceTypeName string) (*storage.EntityQueryResult, error) {
-	client, err := getTableServiceClient()
+func (s *tableStore) ListRPState(ctx context.Context, partitionKey string, resourceProviderName string, resourceTypeName string) (*storage.EntityQueryResult, error) {
+	client, err := getTableServiceClient(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -234,6 +315,70 @@ func ListRPState(partitionKey string, resourceProviderName string, resourceTypeN
 	}
 	return table.QueryEntities(timeout, storage.NoMetadata, &options)
 }
+
+// CountRPStateByProvisioningState returns the number of resources in all partitions keyed by resource provider/resource type then provisioning state
+func (s *tableStore) CountRPStateByProvisioningState(ctx context.Context) (map[string]map[string]int, error) {
+	client, err := getTableServiceClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	table := client.GetTableReference(StateTableName)
+	guid := uuid.New().String()
+	options := storage.QueryOptions{
+		RequestID: guid,
+		Select:    []string{"ResourceProvider", "ResourceType", "ProvisioningState"},
+	}
+	logging.FromContext(ctx).Debugf("Count RP State id: %s", guid)
+	result, err := table.QueryEntities(timeout, storage.NoMetadata, &options)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]map[string]int)
+	for {
+		addProvisioningStateCounts(counts, result.Entities)
+		if result.NextLink == nil {
+			break
+		}
+		if result, err = result.NextResults(nil); err != nil {
+			return nil, err
+		}
+	}
+	return counts, nil
+}
+
+func addProvisioningStateCounts(counts map[string]map[string]int, rows []*storage.Entity) {
+	for _, row := range rows {
+		provider, _ := row.Properties["ResourceProvider"].(string)
+		resourceType, _ := row.Properties["ResourceType"].(string)
+		provisioningState, _ := row.Properties["ProvisioningState"].(string)
+		key := strings.ToLower(fmt.Sprintf("%s/%s", provider, resourceType))
+		if counts[key] == nil {
+			counts[key] = make(map[string]int)
+		}
+		counts[key][provisioningState]++
+	}
+}
+
+// CheckStateStore reads a row from the state and async operation tables to check that they can be reached with the configured credentials
+func (s *tableStore) CheckStateStore(ctx context.Context) error {
+	client, err := getTableServiceClient(ctx)
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{StateTableName, AsyncOperationTableName} {
+		table := client.GetTableReference(name)
+		options := storage.QueryOptions{
+			RequestID: uuid.New().String(),
+			Top:       1,
+			Select:    []string{"RowKey"},
+		}
+		if _, err := table.QueryEntities(timeout, storage.NoMetadata, &options); err != nil {
+			return fmt.Errorf("Failed to query table %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
 func getRowKeyFromResourceId(resourceId string) string {
 	return strings.ReplaceAll(resourceId, "/", "!")
 }
@@ -241,33 +386,60 @@ func GetResourceIdFromRowKey(rowKey string) string {
 	return strings.ReplaceAll(rowKey, "!", "/")
 }
 
-func PutAsyncOp(partitionKey string, operationId string, action string, status string, result interface{}) error {
-	client, err := getTableServiceClient()
+// PutAsyncOp creates or updates the async operation row, properties that are not set in state are left unchanged on an existing row
+func (s *tableStore) PutAsyncOp(ctx context.Context, partitionKey string, operationId string, state *AsyncOperationState) error {
+	client, err := getTableServiceClient(ctx)
 	if err != nil {
 		return err
 	}
 	rowkey := operationId
 	table := client.GetTableReference(AsyncOperationTableName)
 	row := table.GetEntityReference(partitionKey, rowkey)
-	p := make(map[string]interface{})
-	p["action"] = action
-	p["status"] = status
-	if result != nil {
-		p["output"] = result
-	}
-	row.Properties = p
+	row.Properties = asyncOpProperties(state)
 	guid := uuid.New().String()
 	options := storage.EntityOptions{
 		Timeout:   timeout,
 		RequestID: guid,
 	}
-	log.Debugf("Put AsyncOp for partition key: %s operationId: %s id: %s action:%s status %s", partitionKey, operationId, guid, action, status)
-	err = row.InsertOrReplace(&options)
+	logging.FromContext(ctx).Debugf("Put AsyncOp for partition key: %s operationId: %s id: %s action:%s status %s", partitionKey, operationId, guid, state.Action, state.Status)
+	err = row.InsertOrMerge(&options)
 	return err
 }
 
-func GetAsyncOp(partitionKey string, operationId string) (*AsyncOperationState, error) {
-	client, err := getTableServiceClient()
+// asyncOpProperties returns the async operation row properties for the state, properties that are not set are omitted so that they are left unchanged by a merge. Interrupted is always set so that it is cleared by the next update of a requeued operation
+func asyncOpProperties(state *AsyncOperationState) map[string]interface{} {
+	p := make(map[string]interface{})
+	p["interrupted"] = state.Interrupted
+	if len(state.Action) > 0 {
+		p["action"] = state.Action
+	}
+	if len(state.Status) > 0 {
+		p["status"] = state.Status
+	}
+	if len(state.ResourceId) > 0 {
+		// resource ids are case insensitive, the lower case value is stored so that it can be used in query filters
+		p["resourceId"] = strings.ToLower(state.ResourceId)
+	}
+	if len(state.Caller) > 0 {
+		p["caller"] = state.Caller
+	}
+	if len(state.Output) > 0 {
+		p["output"] = state.Output
+	}
+	if len(state.Error) > 0 {
+		p["error"] = state.Error
+	}
+	if !state.StartTime.IsZero() {
+		p["startTime"] = state.StartTime
+	}
+	if !state.EndTime.IsZero() {
+		p["endTime"] = state.EndTime
+	}
+	return p
+}
+
+func (s *tableStore) GetAsyncOp(ctx context.Context, partitionKey string, operationId string) (*AsyncOperationState, error) {
+	client, err := getTableServiceClient(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -278,18 +450,235 @@ func GetAsyncOp(partitionKey string, operationId string) (*AsyncOperationState,
 	options := storage.GetEntityOptions{
 		RequestID: guid,
 	}
-	log.Debugf("Get AsyncOp for partition key: %s operationId: %s id: %s", partitionKey, operationId, guid)
+	logging.FromContext(ctx).Debugf("Get AsyncOp for partition key: %s operationId: %s id: %s", partitionKey, operationId, guid)
 	err = row.Get(timeout, storage.MinimalMetadata, &options)
 	if err != nil {
-		log.Debugf("Failed to GET state for %s", operationId)
+		logging.FromContext(ctx).Debugf("Failed to GET state for %s", operationId)
+		return nil, err
+	}
+	return getAsyncOpFromEntity(row), nil
+}
+
+// ListAsyncOps returns the async operations recorded for a resource
+func (s *tableStore) ListAsyncOps(ctx context.Context, partitionKey string, resourceId string) ([]*AsyncOperationState, error) {
+	client, err := getTableServiceClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	table := client.GetTableReference(AsyncOperationTableName)
+	guid := uuid.New().String()
+	options := storage.QueryOptions{
+		RequestID: guid,
+		Filter:    fmt.Sprintf("PartitionKey eq '%s' and resourceId eq '%s'", partitionKey, strings.ReplaceAll(strings.ToLower(resourceId), "'", "''")),
+	}
+	logging.FromContext(ctx).Debugf("List AsyncOps for partition key: %s resourceId: %s id: %s", partitionKey, resourceId, guid)
+	return queryAsyncOps(table, &options)
+}
+
+// ListTerminalAsyncOps returns the async operations in all partitions that have completed
+func (s *tableStore) ListTerminalAsyncOps(ctx context.Context) ([]*AsyncOperationState, error) {
+	client, err := getTableServiceClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	table := client.GetTableReference(AsyncOperationTableName)
+	guid := uuid.New().String()
+	options := storage.QueryOptions{
+		RequestID: guid,
+		Filter:    fmt.Sprintf("status eq '%s' or status eq '%s'", helpers.AsyncOperationComplete, helpers.AsyncOperationFailed),
+	}
+	logging.FromContext(ctx).Debugf("List terminal AsyncOps id: %s", guid)
+	return queryAsyncOps(table, &options)
+}
+
+// ListInterruptedAsyncOps returns the async operations in all partitions whose jobs were interrupted by a shutdown
+func (s *tableStore) ListInterruptedAsyncOps(ctx context.Context) ([]*AsyncOperationState, error) {
+	client, err := getTableServiceClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	table := client.GetTableReference(AsyncOperationTableName)
+	guid := uuid.New().String()
+	options := storage.QueryOptions{
+		RequestID: guid,
+		Filter:    "interrupted eq true",
+	}
+	logging.FromContext(ctx).Debugf("List interrupted AsyncOps id: %s", guid)
+	return queryAsyncOps(table, &options)
+}
+
+func queryAsyncOps(table *storage.Table, options *storage.QueryOptions) ([]*AsyncOperationState, error) {
+	result, err := table.QueryEntities(timeout, storage.MinimalMetadata, options)
+	if err != nil {
+		return nil, err
+	}
+	operations := make([]*AsyncOperationState, 0)
+	for {
+		operations = append(operations, asyncOpsFromEntities(result.Entities)...)
+		if result.NextLink == nil {
+			break
+		}
+		if result, err = result.NextResults(nil); err != nil {
+			return nil, err
+		}
+	}
+	return operations, nil
+}
+
+func asyncOpsFromEntities(rows []*storage.Entity) []*AsyncOperationState {
+	operations := make([]*AsyncOperationState, 0, len(rows))
+	for _, row := range rows {
+		operations = append(operations, getAsyncOpFromEntity(row))
+	}
+	return operations
+}
+
+func getAsyncOpFromEntity(row *storage.Entity) *AsyncOperationState {
+	state := AsyncOperationState{
+		SubscriptionId: row.PartitionKey,
+		OperationId:    row.RowKey,
+	}
+	state.ResourceId, _ = row.Properties["resourceId"].(string)
+	state.Caller, _ = row.Properties["caller"].(string)
+	state.Action, _ = row.Properties["action"].(string)
+	state.Status, _ = row.Properties["status"].(string)
+	state.Output, _ = row.Properties["output"].(string)
+	state.Error, _ = row.Properties["error"].(string)
+	state.StartTime, _ = row.Properties["startTime"].(time.Time)
+	state.EndTime, _ = row.Properties["endTime"].(time.Time)
+	state.Interrupted, _ = row.Properties["interrupted"].(bool)
+	state.LastUpdated = state.EndTime
+	if state.LastUpdated.IsZero() {
+		state.LastUpdated = row.TimeStamp
+	}
+	return &state
+}
+
+// DeleteAsyncOp deletes the async operation row
+func (s *tableStore) DeleteAsyncOp(ctx context.Context, partitionKey string, operationId string) error {
+	client, err := getTableServiceClient(ctx)
+	if err != nil {
+		return err
+	}
+	table := client.GetTableReference(AsyncOperationTableName)
+	row := table.GetEntityReference(partitionKey, operationId)
+	guid := uuid.New().String()
+	options := storage.EntityOptions{
+		Timeout:   timeout,
+		RequestID: guid,
+	}
+	logging.FromContext(ctx).Debugf("Delete AsyncOp for partition key: %s operationId: %s id: %s", partitionKey, operationId, guid)
+	return row.Delete(true, &options)
+}
+
+// IsNotFoundError returns true if the error is a table storage not found error
+func IsNotFoundError(err error) bool {
+	storageError, ok := err.(storage.AzureStorageServiceError)
+	return ok && storageError.StatusCode == 404
+}
+
+// RPStateFilter selects rows in the state table, empty values match every row. Resource provider and type are compared ignoring case as ARM resource types are case insensitive, provisioning state is compared as stored so it should be one of the ProvisioningState constants
+type RPStateFilter struct {
+	SubscriptionId    string
+	ResourceProvider  string
+	ResourceType      string
+	ProvisioningState string
+}
+
+// query returns the table storage filter for the subscription and provisioning state, table storage comparisons are case sensitive so resource provider and type are filtered by Matches once the rows are returned
+func (f RPStateFilter) query() string {
+	var clauses []string
+	for name, value := range map[string]string{
+		"PartitionKey":      f.SubscriptionId,
+		"ProvisioningState": f.ProvisioningState,
+	} {
+		if len(value) > 0 {
+			clauses = append(clauses, fmt.Sprintf("%s eq '%s'", name, strings.ReplaceAll(value, "'", "''")))
+		}
+	}
+	sort.Strings(clauses)
+	return strings.Join(clauses, " and ")
+}
+
+// Matches returns true if the state row is selected by the filter
+func (f RPStateFilter) Matches(entity *storage.Entity) bool {
+	property := func(name string) string {
+		value, _ := entity.Properties[name].(string)
+		return value
+	}
+	return (len(f.SubscriptionId) == 0 || f.SubscriptionId == entity.PartitionKey) &&
+		(len(f.ResourceProvider) == 0 || strings.EqualFold(f.ResourceProvider, property("ResourceProvider"))) &&
+		(len(f.ResourceType) == 0 || strings.EqualFold(f.ResourceType, property("ResourceType"))) &&
+		(len(f.ProvisioningState) == 0 || f.ProvisioningState == property("ProvisioningState"))
+}
+
+// QueryRPState returns the rows in the state table that match the filter, the rows are returned as stored so that they can be exported and imported
+func (s *tableStore) QueryRPState(ctx context.Context, filter RPStateFilter) ([]*storage.Entity, error) {
+	client, err := getTableServiceClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	table := client.GetTableReference(StateTableName)
+	guid := uuid.New().String()
+	options := storage.QueryOptions{
+		RequestID: guid,
+		Filter:    filter.query(),
+	}
+	logging.FromContext(ctx).Debugf("Query RP State filter: %s id: %s", options.Filter, guid)
+	result, err := table.QueryEntities(timeout, storage.FullMetadata, &options)
+	if err != nil {
+		return nil, err
+	}
+	entities := make([]*storage.Entity, 0)
+	for {
+		for _, entity := range result.Entities {
+			if filter.Matches(entity) {
+				entities = append(entities, entity)
+			}
+		}
+		if result.NextLink == nil {
+			break
+		}
+		if result, err = result.NextResults(nil); err != nil {
+			return nil, err
+		}
+	}
+	return entities, nil
+}
+
+// GetRPStateEntity returns the row in the state table for the resource as stored
+func (s *tableStore) GetRPStateEntity(ctx context.Context, partitionKey string, resourceId string) (*storage.Entity, error) {
+	client, err := getTableServiceClient(ctx)
+	if err != nil {
 		return nil, err
 	}
-	action := ""
-	action, _ = row.Properties["action"].(string)
-	status := ""
-	status, _ = row.Properties["status"].(string)
-	output := ""
-	output, _ = row.Properties["output"].(string)
+	table := client.GetTableReference(StateTableName)
+	row := table.GetEntityReference(partitionKey, getRowKeyFromResourceId(resourceId))
+	guid := uuid.New().String()
+	options := storage.GetEntityOptions{
+		RequestID: guid,
+	}
+	logging.FromContext(ctx).Debugf("Get RP State entity for parition key: %s row key: %s id: %s", partitionKey, row.RowKey, guid)
+	if err := row.Get(timeout, storage.FullMetadata, &options); err != nil {
+		return nil, err
+	}
+	return row, nil
+}
 
-	return &AsyncOperationState{Action: action, Status: status, Output: output}, nil
+// ImportRPStateEntity creates or replaces a row in the state table with a row that was returned by QueryRPState or GetRPStateEntity
+func (s *tableStore) ImportRPStateEntity(ctx context.Context, entity *storage.Entity) error {
+	client, err := getTableServiceClient(ctx)
+	if err != nil {
+		return err
+	}
+	table := client.GetTableReference(StateTableName)
+	row := table.GetEntityReference(entity.PartitionKey, entity.RowKey)
+	row.Properties = entity.Properties
+	guid := uuid.New().String()
+	options := storage.EntityOptions{
+		Timeout:   timeout,
+		RequestID: guid,
+	}
+	logging.FromContext(ctx).Debugf("Import RP State for parition key: %s row key: %s id: %s", entity.PartitionKey, entity.RowKey, guid)
+	return row.InsertOrReplace(&options)
 }
@@ -0,0 +1,190 @@
+package azure
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/storage"
+	"github.com/google/uuid"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/helpers"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/models"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/settings"
+)
+
+// azuriteConnectionEnv is the connection string for the Azurite table service that the table store is tested against, the test is skipped if it is not set, for example UseDevelopmentStorage=true with Azurite listening on the default ports
+const azuriteConnectionEnv = "AZURITE_CONNECTION_STRING"
+
+func TestTableStoreAzurite(t *testing.T) {
+	connectionString := os.Getenv(azuriteConnectionEnv)
+	if len(connectionString) == 0 {
+		t.Skipf("%s is not set", azuriteConnectionEnv)
+	}
+	if err := setStorageInfoFromConnectionString(connectionString); err != nil {
+		t.Fatalf("Failed to parse %s: %v", azuriteConnectionEnv, err)
+	}
+	suffix := strings.ReplaceAll(uuid.New().String(), "-", "")[:8]
+	StateTableName = "state" + suffix
+	AsyncOperationTableName = "asyncoperations" + suffix
+
+	ctx := context.Background()
+	client, err := getTableServiceClient(ctx)
+	if err != nil {
+		t.Fatalf("Failed to create table client: %v", err)
+	}
+	for _, name := range []string{StateTableName, AsyncOperationTableName} {
+		table := client.GetTableReference(name)
+		if err := table.Create(timeout, storage.EmptyPayload, nil); err != nil {
+			t.Fatalf("Failed to create table %s: %v", name, err)
+		}
+		defer func() {
+			if err := table.Delete(timeout, nil); err != nil {
+				t.Errorf("Failed to delete table %s: %v", table.Name, err)
+			}
+		}()
+	}
+
+	store := &tableStore{}
+	if err := store.CheckStateStore(ctx); err != nil {
+		t.Fatalf("CheckStateStore failed: %v", err)
+	}
+
+	const (
+		partitionKey = "subscription"
+		resourceId   = "/subscriptions/subscription/resourceGroups/rg/providers/Microsoft.CustomProviders/resourceProviders/rp/test/azurite"
+		operationId  = "operation"
+	)
+	properties := &models.BundleCommandProperties{
+		Parameters:        map[string]interface{}{"region": "eastus"},
+		Credentials:       map[string]interface{}{"kubeconfig": "secret"},
+		ProvisioningState: helpers.ProvisioningStateSucceeded,
+		OperationId:       operationId,
+		BundleInformation: &settings.BundleInformation{
+			ResourceProvider: "rp",
+			ResourceType:     "test",
+		},
+	}
+	if err := store.PutRPState(ctx, partitionKey, resourceId, properties); err != nil {
+		t.Fatalf("PutRPState failed: %v", err)
+	}
+	if err := store.UpdateRPStatus(ctx, partitionKey, resourceId, "running", "action", "fingerprint"); err != nil {
+		t.Fatalf("UpdateRPStatus failed: %v", err)
+	}
+	state, err := store.GetRPState(ctx, partitionKey, resourceId)
+	if err != nil {
+		t.Fatalf("GetRPState failed: %v", err)
+	}
+	if state.ProvisioningState != helpers.ProvisioningStateSucceeded || state.Parameters["region"] != "eastus" || state.Credentials["kubeconfig"] != "secret" {
+		t.Errorf("GetRPState returned %+v, expected the properties that were put", state)
+	}
+	if state.Status != "running" || state.ActionOperationId != "action" || state.ActionFingerprint != "fingerprint" {
+		t.Errorf("GetRPState returned status %s operation %s fingerprint %s, expected the values that were updated", state.Status, state.ActionOperationId, state.ActionFingerprint)
+	}
+	if err := store.SetFailedProvisioningState(ctx, partitionKey, resourceId, helpers.ErrorInternalServerError("failed")); err != nil {
+		t.Fatalf("SetFailedProvisioningState failed: %v", err)
+	}
+	if state, err = store.GetRPState(ctx, partitionKey, resourceId); err != nil {
+		t.Fatalf("GetRPState failed: %v", err)
+	}
+	if state.ProvisioningState != helpers.ProvisioningStateFailed || state.ErrorResponse == nil {
+		t.Errorf("GetRPState returned provisioning state %s error %v, expected the failure that was recorded", state.ProvisioningState, state.ErrorResponse)
+	}
+	list, err := store.ListRPState(ctx, partitionKey, "rp", "test")
+	if err != nil {
+		t.Fatalf("ListRPState failed: %v", err)
+	}
+	if len(list.Entities) != 1 || GetResourceIdFromRowKey(list.Entities[0].RowKey) != resourceId {
+		t.Errorf("ListRPState returned %d resources, expected %s", len(list.Entities), resourceId)
+	}
+
+	started := time.Now().UTC().Truncate(time.Second)
+	if err := store.PutAsyncOp(ctx, partitionKey, operationId, &AsyncOperationState{
+		ResourceId: resourceId,
+		Action:     "install",
+		Status:     helpers.ProvisioningStateAccepted,
+		StartTime:  started,
+	}); err != nil {
+		t.Fatalf("PutAsyncOp failed: %v", err)
+	}
+	if err := store.PutAsyncOp(ctx, partitionKey, operationId, &AsyncOperationState{Interrupted: true}); err != nil {
+		t.Fatalf("PutAsyncOp failed: %v", err)
+	}
+	interrupted, err := store.ListInterruptedAsyncOps(ctx)
+	if err != nil {
+		t.Fatalf("ListInterruptedAsyncOps failed: %v", err)
+	}
+	if len(interrupted) != 1 || interrupted[0].OperationId != operationId || interrupted[0].Status != helpers.ProvisioningStateAccepted {
+		t.Errorf("ListInterruptedAsyncOps returned %d operations, expected %s with its status unchanged", len(interrupted), operationId)
+	}
+	if err := store.PutAsyncOp(ctx, partitionKey, operationId, &AsyncOperationState{
+		Action: "install",
+		Status: helpers.AsyncOperationComplete,
+	}); err != nil {
+		t.Fatalf("PutAsyncOp failed: %v", err)
+	}
+	op, err := store.GetAsyncOp(ctx, partitionKey, operationId)
+	if err != nil {
+		t.Fatalf("GetAsyncOp failed: %v", err)
+	}
+	if op.Status != helpers.AsyncOperationComplete || op.Interrupted || !strings.EqualFold(op.ResourceId, resourceId) || !op.StartTime.Equal(started) {
+		t.Errorf("GetAsyncOp returned %+v, expected the merged operation", op)
+	}
+	ops, err := store.ListAsyncOps(ctx, partitionKey, strings.ToUpper(resourceId))
+	if err != nil {
+		t.Fatalf("ListAsyncOps failed: %v", err)
+	}
+	if len(ops) != 1 || ops[0].OperationId != operationId {
+		t.Errorf("ListAsyncOps returned %d operations, expected %s", len(ops), operationId)
+	}
+	if err := store.DeleteAsyncOp(ctx, partitionKey, operationId); err != nil {
+		t.Fatalf("DeleteAsyncOp failed: %v", err)
+	}
+	if _, err := store.GetAsyncOp(ctx, partitionKey, operationId); !IsNotFoundError(err) {
+		t.Errorf("GetAsyncOp after delete returned %v, expected not found", err)
+	}
+
+	if err := store.DeleteRPState(ctx, partitionKey, resourceId); err != nil {
+		t.Fatalf("DeleteRPState failed: %v", err)
+	}
+	if _, err := store.GetRPState(ctx, partitionKey, resourceId); !IsNotFoundError(err) {
+		t.Errorf("GetRPState after delete returned %v, expected not found", err)
+	}
+}
+
+func TestRPStateFilter(t *testing.T) {
+	entity := &storage.Entity{
+		PartitionKey: "subscription",
+		Properties: map[string]interface{}{
+			"ResourceProvider":  "Microsoft.CustomProviders",
+			"ResourceType":      "Test",
+			"ProvisioningState": helpers.ProvisioningStateSucceeded,
+		},
+	}
+	tests := []struct {
+		name    string
+		filter  RPStateFilter
+		query   string
+		matches bool
+	}{
+		{name: "empty", matches: true},
+		{name: "subscription", filter: RPStateFilter{SubscriptionId: "subscription"}, query: "PartitionKey eq 'subscription'", matches: true},
+		{name: "other subscription", filter: RPStateFilter{SubscriptionId: "other"}, query: "PartitionKey eq 'other'"},
+		{name: "type ignores case", filter: RPStateFilter{ResourceProvider: "microsoft.customproviders", ResourceType: "TEST"}, matches: true},
+		{name: "other type", filter: RPStateFilter{ResourceProvider: "Microsoft.CustomProviders", ResourceType: "other"}},
+		{name: "provisioning state", filter: RPStateFilter{SubscriptionId: "subscription", ProvisioningState: helpers.ProvisioningStateSucceeded}, query: "PartitionKey eq 'subscription' and ProvisioningState eq 'Succeeded'", matches: true},
+		{name: "other provisioning state", filter: RPStateFilter{ProvisioningState: helpers.ProvisioningStateFailed}, query: "ProvisioningState eq 'Failed'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if query := tt.filter.query(); query != tt.query {
+				t.Errorf("query %q, expected %q", query, tt.query)
+			}
+			if matches := tt.filter.Matches(entity); matches != tt.matches {
+				t.Errorf("matches %v, expected %v", matches, tt.matches)
+			}
+		})
+	}
+}
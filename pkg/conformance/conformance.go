@@ -0,0 +1,288 @@
+// Package conformance checks that a handler follows the ARM RPC v1.0 rules by running the ARM flows for a resource against it, it can be run against a handler in process or a deployed endpoint
+package conformance
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/helpers"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/simulator"
+)
+
+// Config is the resource the checks are run against
+type Config struct {
+	// Resource is created, updated, listed and deleted by the checks, it must not exist before the checks are run
+	Resource simulator.Resource
+	// Action is a custom action invoked on the resource, no action is invoked if it is empty
+	Action     string
+	ActionBody interface{}
+}
+
+// Suite runs the conformance checks in order, the checks share the resource so a check that needs the resource is skipped if it could not be created
+type Suite struct {
+	client    *simulator.Client
+	simulator *simulator.Simulator
+	config    Config
+	created   bool
+}
+
+// CheckResult is the outcome of a check
+type CheckResult struct {
+	Name        string
+	Description string
+	Violations  []simulator.Violation
+	// Err is set if the check could not be completed such as when the handler cannot be reached or an operation does not finish
+	Err error
+	// Skipped is set if the check needs the resource and it could not be created
+	Skipped bool
+}
+
+// Passed returns true if the check completed without violations
+func (r CheckResult) Passed() bool {
+	return !r.Skipped && r.Err == nil && len(r.Violations) == 0
+}
+
+// Report is the outcome of the checks in the order they were run
+type Report struct {
+	Results []CheckResult
+}
+
+type check struct {
+	name        string
+	description string
+	// needsResource is true if the check uses the resource created by the create check
+	needsResource bool
+	run           func(s *Suite, ctx context.Context) ([]simulator.Violation, error)
+}
+
+var checks = []check{
+	{name: "missing-resource", description: "GET of a resource that does not exist returns 404 with an error body", run: (*Suite).checkMissingResource},
+	{name: "delete-missing", description: "DELETE of a resource that does not exist returns 200 or 204", run: (*Suite).checkDeleteMissing},
+	{name: "create", description: "PUT returns 200 or 201 with a provisioningState and the operation succeeds", run: (*Suite).checkCreate},
+	{name: "get", description: "GET returns the resource with a terminal provisioningState", needsResource: true, run: (*Suite).checkGet},
+	{name: "update", description: "PUT of an existing resource returns 200 and the operation succeeds", needsResource: true, run: (*Suite).checkUpdate},
+	{name: "list", description: "LIST returns the resource in the value array of an envelope", needsResource: true, run: (*Suite).checkList},
+	{name: "action", description: "POST of an action returns 202 with a Location header and the operation succeeds", needsResource: true, run: (*Suite).checkAction},
+	{name: "delete", description: "DELETE returns 200, 202 or 204, the operation succeeds and the resource is not found", needsResource: true, run: (*Suite).checkDelete},
+}
+
+// New returns a Suite that uses the client to run the checks
+func New(client *simulator.Client, config Config) *Suite {
+	return &Suite{
+		client:    client,
+		simulator: simulator.New(client),
+		config:    config,
+	}
+}
+
+// Run runs every check, the action check is only run if an action is configured
+func (s *Suite) Run(ctx context.Context) *Report {
+	report := &Report{}
+	for _, c := range checks {
+		if c.name == "action" && len(s.config.Action) == 0 {
+			continue
+		}
+		result := CheckResult{
+			Name:        c.name,
+			Description: c.description,
+		}
+		if c.needsResource && !s.created {
+			result.Skipped = true
+		} else {
+			result.Violations, result.Err = c.run(s, ctx)
+		}
+		report.Results = append(report.Results, result)
+	}
+	return report
+}
+
+func (s *Suite) resourceId(resource simulator.Resource) string {
+	config := s.client.Config()
+	return resource.ResourceId(config.SubscriptionId, config.ResourceGroup)
+}
+
+func (s *Suite) checkMissingResource(ctx context.Context) ([]simulator.Violation, error) {
+	result, err := s.simulator.GetMissing(ctx, s.config.Resource)
+	if err != nil {
+		return nil, err
+	}
+	return result.Violations, nil
+}
+
+func (s *Suite) checkDeleteMissing(ctx context.Context) ([]simulator.Violation, error) {
+	missing := s.config.Resource
+	missing.Name = fmt.Sprintf("%s-%s", missing.Name, uuid.New().String()[:8])
+	resp, err := s.client.Do(ctx, http.MethodDelete, s.resourceId(missing), nil, uuid.New().String())
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return []simulator.Violation{{
+			Rule:    simulator.RuleDeleteStatus,
+			Request: fmt.Sprintf("%s %s", resp.Method, resp.URL),
+			Message: fmt.Sprintf("status should be 200 or 204 for a resource that does not exist but is %d", resp.StatusCode),
+		}}, nil
+	}
+	return nil, nil
+}
+
+func (s *Suite) checkCreate(ctx context.Context) ([]simulator.Violation, error) {
+	result, err := s.simulator.Put(ctx, s.config.Resource)
+	if err != nil {
+		return s.resultViolations(result), err
+	}
+	violations := s.resultViolations(result)
+	if len(result.Responses) > 0 && result.Responses[0].StatusCode < 400 {
+		s.created = true
+	}
+	return append(violations, s.checkSucceeded(result, "create")...), nil
+}
+
+func (s *Suite) checkGet(ctx context.Context) ([]simulator.Violation, error) {
+	result, err := s.simulator.Get(ctx, s.config.Resource)
+	if err != nil {
+		return nil, err
+	}
+	violations := result.Violations
+	if !simulator.IsTerminalStatus(result.Status) {
+		violations = append(violations, violationFor(result.Responses[0], simulator.RuleProvisioningState, "provisioningState should be terminal once the operation has finished but is %q", result.Status))
+	}
+	return violations, nil
+}
+
+func (s *Suite) checkUpdate(ctx context.Context) ([]simulator.Violation, error) {
+	result, err := s.simulator.Put(ctx, s.config.Resource)
+	if err != nil {
+		return s.resultViolations(result), err
+	}
+	violations := s.resultViolations(result)
+	if first := result.Responses[0]; first.StatusCode == http.StatusCreated {
+		violations = append(violations, violationFor(first, simulator.RulePutStatus, "status should be 200 when the resource exists but is 201"))
+	}
+	return append(violations, s.checkSucceeded(result, "update")...), nil
+}
+
+func (s *Suite) checkList(ctx context.Context) ([]simulator.Violation, error) {
+	result, err := s.simulator.List(ctx, s.config.Resource)
+	if err != nil {
+		return nil, err
+	}
+	violations := result.Violations
+	resp := result.Responses[0]
+	value, ok := resp.JSON()["value"].([]interface{})
+	if resp.StatusCode != http.StatusOK || !ok {
+		// the envelope has already been checked
+		return violations, nil
+	}
+	resourceId := s.resourceId(s.config.Resource)
+	for _, v := range value {
+		if resource, ok := v.(map[string]interface{}); ok {
+			if id, _ := resource["id"].(string); strings.EqualFold(id, resourceId) {
+				return violations, nil
+			}
+		}
+	}
+	return append(violations, violationFor(resp, simulator.RuleListEnvelope, "value should contain %s", resourceId)), nil
+}
+
+func (s *Suite) checkAction(ctx context.Context) ([]simulator.Violation, error) {
+	result, err := s.simulator.Post(ctx, s.config.Resource, s.config.Action, s.config.ActionBody)
+	if err != nil {
+		return s.resultViolations(result), err
+	}
+	return append(s.resultViolations(result), s.checkSucceeded(result, "action")...), nil
+}
+
+func (s *Suite) checkDelete(ctx context.Context) ([]simulator.Violation, error) {
+	result, err := s.simulator.Delete(ctx, s.config.Resource)
+	if err != nil {
+		return s.resultViolations(result), err
+	}
+	violations := s.resultViolations(result)
+	if first := result.Responses[0]; first.StatusCode == http.StatusAccepted {
+		violations = append(violations, s.checkSucceeded(result, "delete")...)
+	}
+	return violations, nil
+}
+
+// checkSucceeded checks that the flow finished with the operation or resource in the Succeeded state
+func (s *Suite) checkSucceeded(result *simulator.Result, flow string) []simulator.Violation {
+	if len(result.Responses) == 0 || strings.EqualFold(result.Status, helpers.StatusSucceeded) {
+		return nil
+	}
+	// a Location poll can finish with 200 or 204 and no body
+	if result.Status == fmt.Sprintf("%d", http.StatusOK) || result.Status == fmt.Sprintf("%d", http.StatusNoContent) {
+		return nil
+	}
+	last := result.Responses[len(result.Responses)-1]
+	return []simulator.Violation{violationFor(last, simulator.RuleOperationStatus, "%s should finish in the Succeeded state but finished in %q", flow, result.Status)}
+}
+
+// resultViolations returns the violations of the flow and checks that the async headers point at an operation of the resource so that ARM polls the handler for the right operation
+func (s *Suite) resultViolations(result *simulator.Result) []simulator.Violation {
+	if result == nil {
+		return nil
+	}
+	violations := result.Violations
+	resourceId := strings.ToLower(s.resourceId(s.config.Resource))
+	for _, resp := range result.Responses {
+		for _, header := range []string{"Azure-AsyncOperation", "Location"} {
+			value := resp.Header.Get(header)
+			if len(value) == 0 {
+				continue
+			}
+			parsed, err := url.Parse(value)
+			if err != nil {
+				// the header has already been checked
+				continue
+			}
+			if !strings.HasPrefix(strings.ToLower(parsed.Path), resourceId) {
+				violations = append(violations, violationFor(resp, simulator.RuleAsyncHeader, "%s header %q should be under the resource %s", header, value, resourceId))
+			}
+		}
+	}
+	return violations
+}
+
+func violationFor(resp *simulator.Response, rule string, format string, args ...interface{}) simulator.Violation {
+	return simulator.Violation{
+		Rule:    rule,
+		Request: fmt.Sprintf("%s %s", resp.Method, resp.URL),
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// Failed returns true if any check did not pass, skipped checks fail as they could not be run
+func (r *Report) Failed() bool {
+	for _, result := range r.Results {
+		if !result.Passed() {
+			return true
+		}
+	}
+	return false
+}
+
+// Print writes a line for each check followed by its violations or error
+func (r *Report) Print(w io.Writer) {
+	for _, result := range r.Results {
+		status := "PASS"
+		switch {
+		case result.Skipped:
+			status = "SKIP"
+		case !result.Passed():
+			status = "FAIL"
+		}
+		fmt.Fprintf(w, "%-4s %s: %s\n", status, result.Name, result.Description)
+		for _, v := range result.Violations {
+			fmt.Fprintf(w, "     %s\n", v)
+		}
+		if result.Err != nil {
+			fmt.Fprintf(w, "     error: %v\n", result.Err)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package conformance_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/conformance"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/server/servertest"
+)
+
+func TestConformance(t *testing.T) {
+	server, err := servertest.NewServer()
+	if err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	suite := conformance.New(server.Client(uuid.New().String()), conformance.Config{
+		Resource: servertest.Resource("conformance", map[string]interface{}{"region": "eastus"}),
+		Action:   "status",
+	})
+	report := suite.Run(context.Background())
+
+	var out bytes.Buffer
+	report.Print(&out)
+	t.Log(out.String())
+
+	if len(report.Results) != 8 {
+		t.Errorf("%d checks were run, expected 8", len(report.Results))
+	}
+	for _, result := range report.Results {
+		if result.Skipped {
+			t.Errorf("check %s was skipped", result.Name)
+		}
+		if result.Err != nil {
+			t.Errorf("check %s failed: %v", result.Name, result.Err)
+		}
+		for _, v := range result.Violations {
+			t.Errorf("check %s: %s", result.Name, v)
+		}
+	}
+}
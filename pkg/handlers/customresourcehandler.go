@@ -1,10 +1,13 @@
 package handlers
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
+	"time"
 
 	az "github.com/Azure/go-autorest/autorest/azure"
 	"github.com/cnabio/cnab-go/bundle"
@@ -14,7 +17,10 @@ import (
 	"github.com/simongdavies/cnab-custom-resource-handler/pkg/azure"
 	"github.com/simongdavies/cnab-custom-resource-handler/pkg/helpers"
 	"github.com/simongdavies/cnab-custom-resource-handler/pkg/jobs"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/logging"
 	"github.com/simongdavies/cnab-custom-resource-handler/pkg/models"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/settings"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/tracing"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -33,14 +39,24 @@ func NewCustomResourceHandler() chi.Router {
 
 func getCustomResourceHandler(w http.ResponseWriter, r *http.Request) {
 	rpInput := r.Context().Value(models.BundleContext).(*models.BundleRP)
-	log.Infof("Received GET Request: %s", rpInput.RequestPath)
-	log.Infof("GET Request URI: %s", r.URL.String())
+	logging.FromContext(r.Context()).Infof("Received GET Request: %s", rpInput.RequestPath)
+	logging.FromContext(r.Context()).Infof("GET Request URI: %s", r.URL.String())
 
 	if azure.IsOperationsRequest(rpInput.Id) {
 		getOperationHandler(w, r)
 		return
 	}
 
+	if azure.IsOperationsListRequest(rpInput.Id) {
+		listOperationsHandler(w, r)
+		return
+	}
+
+	if azure.IsActionsListRequest(rpInput.Id) {
+		listActionsHandler(w, r)
+		return
+	}
+
 	// TODO change to use Custom RP Type name
 	if rpInput.Name == "installs" {
 		listCustomResourceHandler(w, r, rpInput.SubscriptionId)
@@ -72,7 +88,7 @@ func getCustomResourceHandler(w http.ResponseWriter, r *http.Request) {
 	// The resource is not in a terminal state
 
 	if azure.IsTerminalProvisioningState(rpInput.Properties.ProvisioningState) {
-		if exists, err := checkIfInstallationExists(installationName); err != nil {
+		if exists, err := checkIfInstallationExists(r.Context(), installationName); err != nil {
 			_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(fmt.Errorf("Failed to check for existing installation: %v", err)))
 			return
 		} else if !exists {
@@ -83,7 +99,7 @@ func getCustomResourceHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	rpOutput, err := getRPOutput(rpInput.Properties.BundleInformation.RPBundle, installationName, rpInput, rpInput.Properties.ProvisioningState)
+	rpOutput, err := getRPOutput(r.Context(), rpInput.Properties.BundleInformation.RPBundle, installationName, rpInput, rpInput.Properties.ProvisioningState)
 	if err != nil {
 		_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(fmt.Errorf("Failed getRPOutput: %v", err)))
 		return
@@ -93,10 +109,10 @@ func getCustomResourceHandler(w http.ResponseWriter, r *http.Request) {
 
 func listCustomResourceHandler(w http.ResponseWriter, r *http.Request, subscriptionId string) {
 	rpInput := r.Context().Value(models.BundleContext).(*models.BundleRP)
-	log.Infof("Received LIST Request: %s", rpInput.RequestPath)
-	log.Infof("LIST Request URI: %s", r.URL.String())
+	logging.FromContext(r.Context()).Infof("Received LIST Request: %s", rpInput.RequestPath)
+	logging.FromContext(r.Context()).Infof("LIST Request URI: %s", r.URL.String())
 	// TODO handle paging
-	res, err := azure.ListRPState(subscriptionId, rpInput.Properties.BundleInformation.ResourceProvider, rpInput.Properties.BundleInformation.ResourceType)
+	res, err := azure.ListRPState(r.Context(), subscriptionId, rpInput.Properties.BundleInformation.ResourceProvider, rpInput.Properties.BundleInformation.ResourceType)
 	if err != nil {
 		_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(fmt.Errorf("Failed getRPOutput: %v", err)))
 		return
@@ -120,28 +136,29 @@ func listCustomResourceHandler(w http.ResponseWriter, r *http.Request, subscript
 		}
 		list = append(list, &output)
 	}
-	render.DefaultResponder(w, r, list)
+	render.DefaultResponder(w, r, models.BundleRPOutputList{Value: list})
 }
 
 func putCustomResourceHandler(w http.ResponseWriter, r *http.Request) {
 
 	rpInput := r.Context().Value(models.BundleContext).(*models.BundleRP)
-	log.Infof("Received PUT Request: %s", rpInput.RequestPath)
-	log.Infof("PUT Request URI: %s", r.URL.String())
+	logging.FromContext(r.Context()).Infof("Received PUT Request: %s", rpInput.RequestPath)
+	logging.FromContext(r.Context()).Infof("PUT Request URI: %s", r.URL.String())
 	installationName := helpers.GetInstallationName(rpInput.Properties.TrimmedBundleTag, rpInput.Id)
 
 	action := "install"
-	provisioningState := "Created"
-	if exists, err := checkIfInstallationExists(installationName); err != nil {
+	provisioningState := helpers.ProvisioningStateCreated
+	if exists, err := checkIfInstallationExists(r.Context(), installationName); err != nil {
 		_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(fmt.Errorf("Failed to check for existing installation: %v", err)))
 		return
 	} else if exists {
 		action = "upgrade"
-		provisioningState = "Accepted"
+		provisioningState = helpers.ProvisioningStateAccepted
 	}
 
 	var args []string
-	args = append(args, action, installationName, "--reference", rpInput.Properties.BundlePullOptions.Tag)
+	args = append(args, action, installationName)
+	args = append(args, rpInput.Properties.BundleArgs()...)
 
 	if len(rpInput.Properties.Parameters) > 0 {
 		if err := validateParameters(rpInput.Properties.BundleInformation.RPBundle, rpInput.Properties.Parameters, action); err != nil {
@@ -157,21 +174,62 @@ func putCustomResourceHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	fingerprint, err := helpers.GetFingerprint(rpInput.Properties.BundleDigest, rpInput.Properties.ForceUpdateTag, rpInput.Properties.Parameters, rpInput.Properties.Credentials)
+	if err != nil {
+		_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(err))
+		return
+	}
+
+	// ARM redeploys resources with the same properties on every incremental deployment, there is no need to run the upgrade if nothing has changed since the last successful PUT
+	if action == "upgrade" && rpInput.Properties.ProvisioningState == helpers.ProvisioningStateSucceeded && rpInput.Properties.Fingerprint == fingerprint {
+		logging.FromContext(r.Context()).Infof("Resource %s is unchanged, skipping upgrade", rpInput.Id)
+		rpOutput, err := getRPOutput(r.Context(), rpInput.Properties.BundleInformation.RPBundle, installationName, rpInput, helpers.ProvisioningStateSucceeded)
+		if err != nil {
+			_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(fmt.Errorf("Failed to get RP output:%v", err)))
+			return
+		}
+		render.Status(r, http.StatusOK)
+		render.DefaultResponder(w, r, rpOutput)
+		return
+	}
+
+	guid := uuid.New().String()
 	jobData := jobs.PutJobData{
 		RPInput:          rpInput,
 		Args:             args,
 		InstallationName: installationName,
+		OperationId:      guid,
+		Action:           action,
+		TraceContext:     tracing.Inject(r.Context()),
+		LogFields:        logging.Fields(r.Context()),
+	}
+
+	// The async operation is written before the resource state so that a failure leaves the resource in its previous provisioning state rather than in one that is waiting for an operation that does not exist
+	asyncOp := azure.AsyncOperationState{
+		ResourceId: rpInput.Id,
+		Caller:     rpInput.Caller,
+		Action:     action,
+		Status:     fmt.Sprintf("Running%s", action),
+		StartTime:  time.Now().UTC(),
+	}
+	if err := azure.PutAsyncOp(r.Context(), rpInput.SubscriptionId, guid, &asyncOp); err != nil {
+		_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(fmt.Errorf("Failed to update async op %s :%v", guid, err)))
+		return
 	}
 
 	rpInput.Properties.ProvisioningState = provisioningState
-	if err := azure.PutRPState(rpInput.SubscriptionId, rpInput.Id, rpInput.Properties); err != nil {
-		_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(fmt.Errorf("Failed to update state:%v", err)))
+	rpInput.Properties.OperationId = guid
+	rpInput.Properties.Fingerprint = fingerprint
+	if err := azure.PutRPState(r.Context(), rpInput.SubscriptionId, rpInput.Id, rpInput.Properties); err != nil {
+		err = fmt.Errorf("Failed to update state:%v", err)
+		failAsyncOp(r.Context(), rpInput.SubscriptionId, guid, action, err)
+		_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(err))
 		return
 	}
 
-	jobs.PutJobs <- &jobData
+	jobs.QueuePut(&jobData)
 
-	rpOutput, err := getRPOutput(rpInput.Properties.BundleInformation.RPBundle, installationName, rpInput, provisioningState)
+	rpOutput, err := getRPOutput(r.Context(), rpInput.Properties.BundleInformation.RPBundle, installationName, rpInput, provisioningState)
 	if err != nil {
 		_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(fmt.Errorf("Failed to get RP output:%v", err)))
 		return
@@ -182,20 +240,24 @@ func putCustomResourceHandler(w http.ResponseWriter, r *http.Request) {
 		status = http.StatusOK
 	}
 
-	// Using provisioning state to show that operation is async, no location header reqruied  (see https://github.com/Azure/azure-resource-manager-rpc/blob/master/v1.0/Addendum.md#creatingupdating-using-put)
+	// The provisioning state shows that the operation is async, the Azure-AsyncOperation header allows the progress of the install or upgrade to be tracked (see https://github.com/Azure/azure-resource-manager-rpc/blob/master/v1.0/Addendum.md#creatingupdating-using-put)
+	location := getLocationHeader(rpInput, guid)
+	w.Header().Add("Azure-AsyncOperation", location)
+	w.Header().Add("Location", location)
+	w.Header().Add("Retry-After", "60")
 	render.Status(r, status)
 	render.DefaultResponder(w, r, rpOutput)
 
 }
 
-func getRPOutput(rpBundle *bundle.Bundle, installationName string, rpInput *models.BundleRP, provisioningState string) (*models.BundleRPOutput, error) {
+func getRPOutput(ctx context.Context, rpBundle *bundle.Bundle, installationName string, rpInput *models.BundleRP, provisioningState string) (*models.BundleRPOutput, error) {
 
 	var cmdOutput []helpers.PorterOutput
 	var err error
 
 	// TODO: get state from table storage (state sync needed)
 	if provisioningState == helpers.ProvisioningStateSucceeded {
-		cmdOutput, err = helpers.GetBundleOutput(rpBundle, installationName, []string{"install", "upgrade"})
+		cmdOutput, err = helpers.GetBundleOutput(ctx, rpBundle, installationName, []string{"install", "upgrade"})
 		if err != nil {
 			return nil, err
 		}
@@ -206,7 +268,7 @@ func getRPOutput(rpBundle *bundle.Bundle, installationName string, rpInput *mode
 	output["ProvisioningState"] = provisioningState
 	output["Installation"] = installationName
 	for _, v := range cmdOutput {
-		log.Debugf("Installation Name:%s Output:%s", installationName, v.Name)
+		logging.FromContext(ctx).Debugf("Installation Name:%s Output:%s", installationName, v.Name)
 		if IsSenstive, _ := rpBundle.IsOutputSensitive(v.Name); !IsSenstive {
 			output[v.Name] = strings.TrimSuffix(v.Value, "\\n")
 		}
@@ -279,41 +341,56 @@ func validateParameters(rpBundle *bundle.Bundle, params map[string]interface{},
 
 func postCustomResourceHandler(w http.ResponseWriter, r *http.Request) {
 	rpInput := r.Context().Value(models.BundleContext).(*models.BundleRP)
-	log.Infof("Received POST Request: %s", rpInput.RequestPath)
-	log.Infof("POST Request URI: %s", r.URL.String())
-
-	guid := rpInput.Properties.OperationId
-	action := getAction(rpInput.RequestPath)
+	logging.FromContext(r.Context()).Infof("Received POST Request: %s", rpInput.RequestPath)
+	logging.FromContext(r.Context()).Infof("POST Request URI: %s", r.URL.String())
+
+	guid := rpInput.Properties.ActionOperationId
+	rpBundle := rpInput.Properties.BundleInformation.RPBundle
+	action, bundleAction, ok := getBundleAction(rpBundle, getAction(rpInput.RequestPath))
+	if !ok {
+		_ = render.Render(w, r, helpers.ErrorInvalidRequest(fmt.Sprintf("Action %s is not supported, valid actions are: %s", getAction(rpInput.RequestPath), strings.Join(getBundleActionNames(rpBundle), ", "))))
+		return
+	}
 	status := fmt.Sprintf("Running%s", action)
 
-	if rpInput.Properties.ProvisioningState != helpers.ProvisioningStateSucceeded {
-		_ = render.Render(w, r, helpers.ErrorConflict(fmt.Sprintf("Cannot start action %s if provisioning state is not %s ", action, helpers.ProvisioningStateSucceeded)))
+	fingerprint, err := helpers.GetActionFingerprint(action, rpInput.Properties.Parameters)
+	if err != nil {
+		_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(err))
+		return
 	}
 
 	if len(rpInput.Properties.Status) == 0 {
-		installationName := helpers.GetInstallationName(rpInput.Properties.TrimmedBundleTag, rpInput.Id)
-		if exists, err := checkIfInstallationExists(installationName); err != nil {
-			_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(fmt.Errorf("Failed to check for existing installation: %v", err)))
-			return
-		} else if !exists {
-			// This should only happen if the resource is deleted outside of ARM
-			// TODO clean-up state
-			w.WriteHeader(http.StatusNotFound)
+		// Stateless actions do not need an installation so they can also run when the resource failed to install, like every action they need the resource to exist with a terminal provisioning state which LoadState checks
+		if !bundleAction.Stateless && rpInput.Properties.ProvisioningState != helpers.ProvisioningStateSucceeded {
+			_ = render.Render(w, r, helpers.ErrorConflict(fmt.Sprintf("Cannot start action %s if provisioning state is not %s ", action, helpers.ProvisioningStateSucceeded)))
 			return
 		}
 
+		installationName := helpers.GetInstallationName(rpInput.Properties.TrimmedBundleTag, rpInput.Id)
+		if !bundleAction.Stateless {
+			if exists, err := checkIfInstallationExists(r.Context(), installationName); err != nil {
+				_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(fmt.Errorf("Failed to check for existing installation: %v", err)))
+				return
+			} else if !exists {
+				// This should only happen if the resource is deleted outside of ARM
+				// TODO clean-up state
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+		}
+
 		var args []string
 		args = append(args, "invoke", installationName, "--action", action)
 
 		if len(rpInput.Properties.Parameters) > 0 {
-			if err := validateParameters(rpInput.Properties.BundleInformation.RPBundle, rpInput.Properties.Parameters, action); err != nil {
+			if err := validateParameters(rpBundle, rpInput.Properties.Parameters, action); err != nil {
 				_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(fmt.Errorf("Failed to validate parameters:%v", err)))
 				return
 			}
 		}
 
 		if len(rpInput.Properties.Credentials) > 0 {
-			if err := validateCredentials(rpInput.Properties.BundleInformation.RPBundle, rpInput.Properties.Credentials); err != nil {
+			if err := validateCredentials(rpBundle, rpInput.Properties.Credentials); err != nil {
 				_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(fmt.Errorf("Failed to validate credentials:%v", err)))
 				return
 			}
@@ -326,34 +403,134 @@ func postCustomResourceHandler(w http.ResponseWriter, r *http.Request) {
 			InstallationName: installationName,
 			OperationId:      guid,
 			Action:           action,
+			Modifies:         bundleAction.Modifies,
+			TraceContext:     tracing.Inject(r.Context()),
+			LogFields:        logging.Fields(r.Context()),
 		}
 
-		jobs.PostJobs <- &postData
-
-		if err := azure.UpdateRPStatus(rpInput.SubscriptionId, rpInput.Id, status); err != nil {
-			_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(fmt.Errorf("Failed to update state:%v", err)))
+		// The async operation is written before the resource state so that a failure does not leave the resource running an action that does not exist
+		asyncOp := azure.AsyncOperationState{
+			ResourceId: rpInput.Id,
+			Caller:     rpInput.Caller,
+			Action:     action,
+			Status:     status,
+			StartTime:  time.Now().UTC(),
+		}
+		if err := azure.PutAsyncOp(r.Context(), rpInput.SubscriptionId, guid, &asyncOp); err != nil {
+			_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(fmt.Errorf("Failed to update async op %s :%v", guid, err)))
 			return
 		}
 
-		if err := azure.PutAsyncOp(rpInput.SubscriptionId, guid, action, status, nil); err != nil {
-			_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(fmt.Errorf("Failed to update async op %s :%v", guid, err)))
+		if err := azure.UpdateRPStatus(r.Context(), rpInput.SubscriptionId, rpInput.Id, status, guid, fingerprint); err != nil {
+			err = fmt.Errorf("Failed to update state:%v", err)
+			failAsyncOp(r.Context(), rpInput.SubscriptionId, guid, action, err)
+			_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(err))
 			return
 		}
+
+		if bundleAction.Modifies {
+			if err := azure.UpdateRPProvisioningState(r.Context(), rpInput.SubscriptionId, rpInput.Id, helpers.ProvisioningStateUpdating); err != nil {
+				err = fmt.Errorf("Failed to update provisioning state:%v", err)
+				failAsyncOp(r.Context(), rpInput.SubscriptionId, guid, action, err)
+				if err := azure.UpdateRPStatus(r.Context(), rpInput.SubscriptionId, rpInput.Id, "", "", ""); err != nil {
+					logging.FromContext(r.Context()).Errorf("Failed to clear status of action %s for %s: %v", action, rpInput.Id, err)
+				}
+				_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(err))
+				return
+			}
+		}
+
+		jobs.QueuePost(&postData)
 	} else {
+		// A repeat of the running action with the same parameters joins the existing operation
 		if !strings.EqualFold(status, rpInput.Properties.Status) {
-			_ = render.Render(w, r, helpers.ErrorConflict(fmt.Sprintf("Cannot start action %s while status is %s", action, rpInput.Properties.Status)))
+			_ = render.Render(w, r, helpers.ErrorConflict(fmt.Sprintf("Cannot start action %s while operation %s is %s", action, rpInput.Properties.ActionOperationId, rpInput.Properties.Status)))
 			return
 		}
+		if fingerprint != rpInput.Properties.ActionFingerprint {
+			_ = render.Render(w, r, helpers.ErrorConflict(fmt.Sprintf("Action %s is already running as operation %s with different parameters", action, rpInput.Properties.ActionOperationId)))
+			return
+		}
+		logging.FromContext(r.Context()).Infof("Action %s is already running for %s joining operation %s", action, rpInput.Id, guid)
 	}
 
-	//TODO check that the action has the same parameters as the action that is running
-
 	w.Header().Add("Retry-After", "60")
 	w.Header().Add("Location", getLocationHeader(rpInput, guid))
 	w.WriteHeader(http.StatusAccepted)
 
 }
 
+// getBundleAction returns the name and definition of the custom action in the bundle that matches the requested action
+func getBundleAction(rpBundle *bundle.Bundle, name string) (string, *bundle.Action, bool) {
+	if action, ok := rpBundle.Actions[name]; ok {
+		return name, &action, true
+	}
+	for k, v := range rpBundle.Actions {
+		if strings.EqualFold(k, name) {
+			action := v
+			return k, &action, true
+		}
+	}
+	return "", nil, false
+}
+
+func getBundleActionNames(rpBundle *bundle.Bundle) []string {
+	names := make([]string, 0, len(rpBundle.Actions))
+	for k := range rpBundle.Actions {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func listActionsHandler(w http.ResponseWriter, r *http.Request) {
+	rpInput := r.Context().Value(models.BundleContext).(*models.BundleRP)
+	logging.FromContext(r.Context()).Infof("Received LIST Actions Request: %s", rpInput.RequestPath)
+	logging.FromContext(r.Context()).Infof("LIST Actions Request URI: %s", r.URL.String())
+
+	rpBundle := rpInput.Properties.BundleInformation.RPBundle
+	list := models.ActionList{
+		Value: make([]*models.Action, 0, len(rpBundle.Actions)),
+	}
+	for _, name := range getBundleActionNames(rpBundle) {
+		bundleAction := rpBundle.Actions[name]
+		action := models.Action{
+			Name:        name,
+			Description: bundleAction.Description,
+			Stateless:   bundleAction.Stateless,
+			Modifies:    bundleAction.Modifies,
+			Parameters:  make([]*models.ActionParameter, 0),
+		}
+		for _, paramName := range getSortedParameterNames(rpBundle) {
+			param := rpBundle.Parameters[paramName]
+			if !param.AppliesTo(name) {
+				continue
+			}
+			actionParameter := models.ActionParameter{
+				Name:        paramName,
+				Description: param.Description,
+				Required:    param.Required,
+			}
+			if definition, ok := rpBundle.Definitions[param.Definition]; ok {
+				actionParameter.Type = definition.Type
+				actionParameter.Default = definition.Default
+			}
+			action.Parameters = append(action.Parameters, &actionParameter)
+		}
+		list.Value = append(list.Value, &action)
+	}
+	render.DefaultResponder(w, r, list)
+}
+
+func getSortedParameterNames(rpBundle *bundle.Bundle) []string {
+	names := make([]string, 0, len(rpBundle.Parameters))
+	for k := range rpBundle.Parameters {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
 func getAction(requestPath string) string {
 	parts := strings.Split(requestPath, "/")
 	return parts[len(parts)-1]
@@ -361,14 +538,14 @@ func getAction(requestPath string) string {
 
 func deleteCustomResourceHandler(w http.ResponseWriter, r *http.Request) {
 	rpInput := r.Context().Value(models.BundleContext).(*models.BundleRP)
-	log.Infof("Received DELETE Request: %s", rpInput.RequestPath)
-	log.Infof("DELETE Request URI: %s", r.URL.String())
+	logging.FromContext(r.Context()).Infof("Received DELETE Request: %s", rpInput.RequestPath)
+	logging.FromContext(r.Context()).Infof("DELETE Request URI: %s", r.URL.String())
 	guid := rpInput.Properties.OperationId
 	if rpInput.Properties.ProvisioningState != helpers.ProvisioningStateDeleting {
 
 		installationName := helpers.GetInstallationName(rpInput.Properties.TrimmedBundleTag, rpInput.Id)
 		var args []string
-		if exists, err := checkIfInstallationExists(installationName); err != nil {
+		if exists, err := checkIfInstallationExists(r.Context(), installationName); err != nil {
 			_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(fmt.Errorf("Failed to check for existing installation: %v", err)))
 			return
 		} else if !exists {
@@ -387,19 +564,30 @@ func deleteCustomResourceHandler(w http.ResponseWriter, r *http.Request) {
 			InstallationName: installationName,
 			OperationId:      guid,
 			BundleInfo:       rpInput.Properties.BundleInformation,
+			TraceContext:     tracing.Inject(r.Context()),
+			LogFields:        logging.Fields(r.Context()),
 		}
 
-		jobs.DeleteJobs <- &jobData
-
-		if err := azure.PutRPState(rpInput.SubscriptionId, rpInput.Id, rpInput.Properties); err != nil {
-			_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(fmt.Errorf("Failed to update state:%v", err)))
-			return
+		// The job is queued once both writes have been made so that it cannot finish and then have its result overwritten by them
+		asyncOp := azure.AsyncOperationState{
+			ResourceId: rpInput.Id,
+			Caller:     rpInput.Caller,
+			Action:     "delete",
+			Status:     helpers.ProvisioningStateDeleting,
+			StartTime:  time.Now().UTC(),
 		}
-		if err := azure.PutAsyncOp(rpInput.SubscriptionId, guid, "delete", helpers.ProvisioningStateDeleting, nil); err != nil {
+		if err := azure.PutAsyncOp(r.Context(), rpInput.SubscriptionId, guid, &asyncOp); err != nil {
 			_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(fmt.Errorf("Failed to update asyncop %s :%v", guid, err)))
 			return
 		}
+		if err := azure.PutRPState(r.Context(), rpInput.SubscriptionId, rpInput.Id, rpInput.Properties); err != nil {
+			err = fmt.Errorf("Failed to update state:%v", err)
+			failAsyncOp(r.Context(), rpInput.SubscriptionId, guid, "delete", err)
+			_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(err))
+			return
+		}
 
+		jobs.QueueDelete(&jobData)
 	}
 
 	w.Header().Add("Retry-After", "60")
@@ -410,22 +598,31 @@ func deleteCustomResourceHandler(w http.ResponseWriter, r *http.Request) {
 
 func getOperationHandler(w http.ResponseWriter, r *http.Request) {
 
-	// TODO validate the operation Id
-
 	rpInput := r.Context().Value(models.BundleContext).(*models.BundleRP)
-	log.Infof("Received GET Operation Request: %s", rpInput.RequestPath)
-	log.Infof("Operation Request URI: %s", r.URL.String())
+	logging.FromContext(r.Context()).Infof("Received GET Operation Request: %s", rpInput.RequestPath)
+	logging.FromContext(r.Context()).Infof("Operation Request URI: %s", r.URL.String())
 
 	operation := models.Operation{
 		Id:   rpInput.Id,
 		Name: rpInput.Name,
 	}
 
-	state, err := azure.GetAsyncOp(rpInput.SubscriptionId, rpInput.Name)
+	state, err := azure.GetAsyncOp(r.Context(), rpInput.SubscriptionId, rpInput.Name)
 	if err != nil {
+		if azure.IsNotFoundError(err) {
+			_ = render.Render(w, r, helpers.ErrorNotFound())
+			return
+		}
 		writeOperation(w, r, &operation, helpers.AsyncOperationUnknown, "InternalServerError", fmt.Sprintf("Failed to get async op %s :%v", rpInput.Name, err), http.StatusInternalServerError)
 		return
 	}
+
+	// The operation must belong to the resource in the request path, operations recorded before the resource id was stored cannot be checked and are returned as they were before
+	if len(state.ResourceId) > 0 && !strings.EqualFold(state.ResourceId, getResourceIdFromOperationsId(rpInput.Id)) {
+		logging.FromContext(r.Context()).Infof("Operation %s does not belong to resource %s", rpInput.Name, getResourceIdFromOperationsId(rpInput.Id))
+		_ = render.Render(w, r, helpers.ErrorNotFound())
+		return
+	}
 	if state.Action == "delete" && (state.Status != helpers.ProvisioningStateDeleting && state.Status != helpers.AsyncOperationComplete && state.Status != helpers.AsyncOperationFailed) {
 		writeOperation(w, r, &operation, helpers.AsyncOperationUnknown, "InternalServerError", fmt.Sprintf("Unexpected status for delete action op id %s :%v", rpInput.Name, state.Status), http.StatusInternalServerError)
 		return
@@ -439,10 +636,23 @@ func getOperationHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !state.StartTime.IsZero() {
+		operation.StartTime = &state.StartTime
+	}
+
 	if state.Status == helpers.AsyncOperationComplete || state.Status == helpers.StatusFailed {
 		operation.Status = state.Status
+		if !state.EndTime.IsZero() {
+			operation.EndTime = &state.EndTime
+		}
+		if len(state.Error) > 0 {
+			operation.Error = &models.OperationError{
+				Code:    "ResourceOperationFailure",
+				Message: state.Error,
+			}
+		}
 		if state.Action != "delete" {
-			porterOutputs, err := helpers.GetBundleOutput(rpInput.Properties.BundleInformation.RPBundle, helpers.GetInstallationName(rpInput.Properties.TrimmedBundleTag, getResourceIdFromOperationsId(rpInput.Id)), []string{state.Action})
+			porterOutputs, err := helpers.GetBundleOutput(r.Context(), rpInput.Properties.BundleInformation.RPBundle, helpers.GetInstallationName(rpInput.Properties.TrimmedBundleTag, getResourceIdFromOperationsId(rpInput.Id)), []string{state.Action})
 			if err != nil {
 				writeOperation(w, r, &operation, state.Status, "InternalServerError", fmt.Sprintf("Failed to get outputs for action %s op id %s :%v", state.Action, rpInput.Name, err), http.StatusInternalServerError)
 				return
@@ -463,9 +673,10 @@ func getOperationHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// TODO deal with same action with different parameters
-
 	operation.Status = state.Status
+	if state.Interrupted {
+		operation.Properties = map[string]interface{}{"interrupted": true}
+	}
 	w.Header().Add("Retry-After", "60")
 	w.Header().Add("Location", getLocationHeader(rpInput, ""))
 	render.Status(r, http.StatusAccepted)
@@ -473,6 +684,69 @@ func getOperationHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
+func listOperationsHandler(w http.ResponseWriter, r *http.Request) {
+	rpInput := r.Context().Value(models.BundleContext).(*models.BundleRP)
+	logging.FromContext(r.Context()).Infof("Received LIST Operations Request: %s", rpInput.RequestPath)
+	logging.FromContext(r.Context()).Infof("LIST Operations Request URI: %s", r.URL.String())
+
+	resourceId := strings.TrimSuffix(rpInput.Id, "/operations")
+	if _, err := azure.GetRPState(r.Context(), rpInput.SubscriptionId, resourceId); err != nil {
+		if azure.IsNotFoundError(err) {
+			_ = render.Render(w, r, helpers.ErrorNotFound())
+			return
+		}
+		_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(fmt.Errorf("Failed to get RPState: %v", err)))
+		return
+	}
+
+	states, err := azure.ListAsyncOps(r.Context(), rpInput.SubscriptionId, resourceId)
+	if err != nil {
+		_ = render.Render(w, r, helpers.ErrorInternalServerErrorFromError(fmt.Errorf("Failed to list async ops for %s: %v", resourceId, err)))
+		return
+	}
+
+	list := models.OperationList{
+		Value: make([]*models.Operation, 0),
+	}
+	for _, state := range states {
+		operation := models.Operation{
+			Id:     fmt.Sprintf("%s/operations/%s", resourceId, state.OperationId),
+			Name:   state.OperationId,
+			Status: state.Status,
+		}
+		if !state.StartTime.IsZero() {
+			operation.StartTime = &state.StartTime
+		}
+		if !state.EndTime.IsZero() {
+			operation.EndTime = &state.EndTime
+		}
+		if len(state.Error) > 0 {
+			operation.Error = &models.OperationError{
+				Code:    "ResourceOperationFailure",
+				Message: state.Error,
+			}
+		}
+		if state.Interrupted {
+			operation.Properties = map[string]interface{}{"interrupted": true}
+		}
+		list.Value = append(list.Value, &operation)
+	}
+	render.DefaultResponder(w, r, list)
+}
+
+// failAsyncOp records that an operation failed before its job was queued so that it is not left running
+func failAsyncOp(ctx context.Context, subscriptionId string, operationId string, action string, err error) {
+	asyncOp := azure.AsyncOperationState{
+		Action:  action,
+		Status:  helpers.AsyncOperationFailed,
+		Error:   err.Error(),
+		EndTime: time.Now().UTC(),
+	}
+	if err := azure.PutAsyncOp(ctx, subscriptionId, operationId, &asyncOp); err != nil {
+		logging.FromContext(ctx).Errorf("Failed to update async op %s :%v", operationId, err)
+	}
+}
+
 func writeOperation(w http.ResponseWriter, r *http.Request, operation *models.Operation, status string, code string, message string, statuscode int) {
 	operation.Status = status
 	operation.Error = &models.OperationError{
@@ -484,10 +758,10 @@ func writeOperation(w http.ResponseWriter, r *http.Request, operation *models.Op
 }
 
 //TODO handle failed/successful installs
-func checkIfInstallationExists(name string) (bool, error) {
+func checkIfInstallationExists(ctx context.Context, name string) (bool, error) {
 	args := []string{}
 	args = append(args, "installations", "show", name)
-	if out, err := helpers.ExecutePorterCommand(args); err != nil {
+	if out, err := helpers.ExecutePorterCommand(ctx, args); err != nil {
 		if strings.Contains(strings.ToLower(string(out)), "installation does not exist") {
 			return false, nil
 		}
@@ -508,7 +782,8 @@ func getLocationHeader(rpInput *models.BundleRP, guid string) string {
 		host = fmt.Sprintf("localhost:%s", port)
 
 	}
-	if strings.HasPrefix(strings.ToLower(host), "localhost") {
+	// dev mode only serves HTTP
+	if strings.HasPrefix(strings.ToLower(host), "localhost") || settings.DevMode {
 		scheme = "http"
 	}
 	if len(guid) > 0 {
@@ -0,0 +1,377 @@
+package handlers_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/azure"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/helpers"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/server/servertest"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/simulator"
+)
+
+// methods that are not HTTP methods, LIST gets the collection the resource is in and OPERATION gets the operation started by the last request that returned an async header
+const (
+	methodList      = "LIST"
+	methodOperation = "OPERATION"
+)
+
+// legacyOperationId is an operation recorded without the id of its resource
+var legacyOperationId = uuid.New().String()
+
+type step struct {
+	// before runs before the request is sent
+	before func(h *harness)
+	method string
+	// resource is the name of the resource, the default is test. For OPERATION the operation is requested under the id of this resource
+	resource string
+	// operationId is the operation OPERATION gets instead of the operation started by the last request
+	operationId string
+	// path is appended to the resource id
+	path       string
+	parameters map[string]interface{}
+	// status is the expected status code, zero does not check the status code
+	status int
+	// provisioningState is the expected provisioning state in the properties of the response
+	provisioningState string
+	// properties are expected in the properties of the response
+	properties map[string]interface{}
+	// bodyStatus is the expected status in the body of an operation
+	bodyStatus string
+	retryAfter string
+	// count is the number of resources a LIST returns
+	count int
+	// operationStatus is the status the operation finishes with, the async headers are followed until the operation finishes
+	operationStatus string
+}
+
+type harness struct {
+	t       *testing.T
+	server  *servertest.Server
+	client  *simulator.Client
+	release func()
+	// async is the last response with an async header
+	async *simulator.Response
+}
+
+func TestCustomResourceHandler(t *testing.T) {
+	server, err := servertest.NewServer()
+	if err != nil {
+		t.Fatalf("Failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		outputs map[string]string
+		steps   []step
+		// actions are the bundle actions expected to have been run
+		actions []string
+	}{
+		{
+			name:    "install",
+			outputs: map[string]string{"host": "test.example.com"},
+			steps: []step{
+				{method: http.MethodGet, status: http.StatusNotFound},
+				{method: http.MethodPut, parameters: map[string]interface{}{"region": "eastus"}, status: http.StatusCreated, provisioningState: helpers.ProvisioningStateCreated, retryAfter: "60", operationStatus: helpers.AsyncOperationComplete},
+				{method: http.MethodGet, status: http.StatusOK, provisioningState: helpers.ProvisioningStateSucceeded, properties: map[string]interface{}{"region": "eastus", "host": "test.example.com"}},
+			},
+			actions: []string{"install"},
+		},
+		{
+			name: "upgrade",
+			steps: []step{
+				{method: http.MethodPut, parameters: map[string]interface{}{"region": "eastus"}, status: http.StatusCreated, operationStatus: helpers.AsyncOperationComplete},
+				{method: http.MethodPut, parameters: map[string]interface{}{"region": "westus"}, status: http.StatusOK, provisioningState: helpers.ProvisioningStateAccepted, operationStatus: helpers.AsyncOperationComplete},
+				{method: http.MethodGet, status: http.StatusOK, provisioningState: helpers.ProvisioningStateSucceeded, properties: map[string]interface{}{"region": "westus"}},
+			},
+			actions: []string{"install", "upgrade"},
+		},
+		{
+			name: "unchanged put skips upgrade",
+			steps: []step{
+				{method: http.MethodPut, parameters: map[string]interface{}{"region": "eastus"}, status: http.StatusCreated, operationStatus: helpers.AsyncOperationComplete},
+				{method: http.MethodPut, parameters: map[string]interface{}{"region": "eastus"}, status: http.StatusOK, provisioningState: helpers.ProvisioningStateSucceeded},
+			},
+			actions: []string{"install"},
+		},
+		{
+			name: "failed install",
+			steps: []step{
+				{
+					before: func(h *harness) { h.server.Porter.Fail("install", "image pull failed") },
+					method: http.MethodPut, status: http.StatusCreated, provisioningState: helpers.ProvisioningStateCreated, operationStatus: helpers.AsyncOperationFailed,
+				},
+				{method: http.MethodGet, status: http.StatusOK, provisioningState: helpers.ProvisioningStateFailed, properties: map[string]interface{}{"Error": "image pull failed"}},
+				{
+					before: func(h *harness) { h.server.Porter.Reset() },
+					method: http.MethodPut, status: http.StatusOK, provisioningState: helpers.ProvisioningStateAccepted, operationStatus: helpers.AsyncOperationComplete,
+				},
+				{method: http.MethodGet, status: http.StatusOK, provisioningState: helpers.ProvisioningStateSucceeded},
+			},
+			actions: []string{"upgrade"},
+		},
+		{
+			name: "post action",
+			steps: []step{
+				{method: http.MethodPut, status: http.StatusCreated, operationStatus: helpers.AsyncOperationComplete},
+				{method: http.MethodPost, path: "/status", status: http.StatusAccepted, retryAfter: "60", operationStatus: helpers.AsyncOperationComplete},
+				{method: http.MethodGet, status: http.StatusOK, provisioningState: helpers.ProvisioningStateSucceeded},
+				{method: http.MethodPost, path: "/missing", status: http.StatusBadRequest},
+			},
+			actions: []string{"install", "status"},
+		},
+		{
+			name: "stateless action after failed install",
+			steps: []step{
+				{
+					before: func(h *harness) { h.server.Porter.Fail("install", "image pull failed") },
+					method: http.MethodPut, status: http.StatusCreated, operationStatus: helpers.AsyncOperationFailed,
+				},
+				{method: http.MethodPost, path: "/status", status: http.StatusConflict},
+				{method: http.MethodPost, path: "/diagnose", status: http.StatusAccepted, operationStatus: helpers.AsyncOperationComplete},
+			},
+			actions: []string{"install", "diagnose"},
+		},
+		{
+			name: "stateless action without a resource",
+			steps: []step{
+				{method: http.MethodPost, path: "/diagnose", status: http.StatusNotFound},
+			},
+		},
+		{
+			name: "failed modifying action",
+			steps: []step{
+				{method: http.MethodPut, status: http.StatusCreated, operationStatus: helpers.AsyncOperationComplete},
+				{
+					before: func(h *harness) { h.server.Porter.Fail("restart", "restart failed") },
+					method: http.MethodPost, path: "/restart", status: http.StatusAccepted, operationStatus: helpers.AsyncOperationFailed,
+				},
+				{method: http.MethodGet, status: http.StatusOK, provisioningState: helpers.ProvisioningStateFailed},
+			},
+			actions: []string{"install", "restart"},
+		},
+		{
+			name: "delete",
+			steps: []step{
+				{method: http.MethodDelete, status: http.StatusNoContent},
+				{method: http.MethodPut, status: http.StatusCreated, operationStatus: helpers.AsyncOperationComplete},
+				{method: http.MethodDelete, status: http.StatusAccepted, retryAfter: "60", operationStatus: helpers.AsyncOperationComplete},
+				{method: http.MethodGet, status: http.StatusNotFound},
+			},
+			actions: []string{"install", "uninstall"},
+		},
+		{
+			name: "list",
+			steps: []step{
+				{method: methodList, status: http.StatusOK, count: 0},
+				{method: http.MethodPut, resource: "first", status: http.StatusCreated, operationStatus: helpers.AsyncOperationComplete},
+				{method: http.MethodPut, resource: "second", status: http.StatusCreated, operationStatus: helpers.AsyncOperationComplete},
+				{method: methodList, status: http.StatusOK, count: 2},
+			},
+			actions: []string{"install", "install"},
+		},
+		{
+			name: "conflict while installing",
+			steps: []step{
+				{
+					before: func(h *harness) { h.release = h.server.Porter.Hold("install") },
+					method: http.MethodPut, status: http.StatusCreated,
+				},
+				{method: http.MethodPut, status: http.StatusConflict},
+				{method: http.MethodPost, path: "/status", status: http.StatusConflict},
+				{method: http.MethodDelete, status: http.StatusConflict},
+				{
+					before: func(h *harness) { h.release() },
+					method: methodOperation, operationStatus: helpers.AsyncOperationComplete,
+				},
+				{method: http.MethodDelete, status: http.StatusAccepted, operationStatus: helpers.AsyncOperationComplete},
+			},
+			actions: []string{"install", "uninstall"},
+		},
+		{
+			name: "operation of another resource",
+			steps: []step{
+				{method: http.MethodPut, resource: "first", status: http.StatusCreated, operationStatus: helpers.AsyncOperationComplete},
+				{method: http.MethodPut, resource: "second", status: http.StatusCreated, operationStatus: helpers.AsyncOperationComplete},
+				{method: methodOperation, resource: "second", status: http.StatusOK, bodyStatus: helpers.AsyncOperationComplete},
+				{method: methodOperation, resource: "first", status: http.StatusNotFound},
+			},
+			actions: []string{"install", "install"},
+		},
+		{
+			name: "operation recorded without a resource id",
+			steps: []step{
+				{method: http.MethodPut, status: http.StatusCreated, operationStatus: helpers.AsyncOperationComplete},
+				{
+					before: func(h *harness) {
+						// operations recorded before the resource id was stored
+						state := azure.AsyncOperationState{Action: "install", Status: helpers.AsyncOperationComplete, StartTime: time.Now().UTC(), EndTime: time.Now().UTC()}
+						if err := azure.PutAsyncOp(context.Background(), h.client.Config().SubscriptionId, legacyOperationId, &state); err != nil {
+							h.t.Fatalf("Failed to put operation: %v", err)
+						}
+					},
+					method: methodOperation, operationId: legacyOperationId, status: http.StatusOK, bodyStatus: helpers.AsyncOperationComplete,
+				},
+			},
+			actions: []string{"install"},
+		},
+		{
+			name: "operation polling",
+			steps: []step{
+				{
+					before: func(h *harness) { h.release = h.server.Porter.Hold("install") },
+					method: http.MethodPut, status: http.StatusCreated,
+				},
+				{method: methodOperation, status: http.StatusAccepted, bodyStatus: "Runninginstall", retryAfter: "60"},
+				{method: http.MethodGet, status: http.StatusOK, provisioningState: helpers.ProvisioningStateCreated},
+				{
+					before: func(h *harness) { h.release() },
+					method: methodOperation, operationStatus: helpers.AsyncOperationComplete,
+				},
+				{method: methodOperation, status: http.StatusOK, bodyStatus: helpers.AsyncOperationComplete},
+			},
+			actions: []string{"install"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server.Porter.Reset()
+			defer server.Porter.Reset()
+			server.Porter.SetOutputs(tt.outputs)
+			h := &harness{
+				t:      t,
+				server: server,
+				client: server.Client(uuid.New().String()),
+			}
+			for i, s := range tt.steps {
+				h.run(i, s)
+				if t.Failed() {
+					return
+				}
+			}
+			if actions := server.Porter.Actions(); !reflect.DeepEqual(actions, tt.actions) {
+				t.Errorf("porter ran %v, expected %v", actions, tt.actions)
+			}
+		})
+	}
+}
+
+func (h *harness) run(i int, s step) {
+	t := h.t
+	if s.before != nil {
+		s.before(h)
+	}
+	name := s.resource
+	if len(name) == 0 {
+		name = "test"
+	}
+	resource := servertest.Resource(name, s.parameters)
+	config := h.client.Config()
+	resourceId := resource.ResourceId(config.SubscriptionId, config.ResourceGroup)
+	correlationId := uuid.New().String()
+	ctx := context.Background()
+
+	var resp *simulator.Response
+	var err error
+	switch s.method {
+	case http.MethodPut:
+		body := map[string]interface{}{
+			"location":   config.Location,
+			"properties": resource.Properties,
+		}
+		resp, err = h.client.Do(ctx, http.MethodPut, resourceId, body, correlationId)
+	case methodList:
+		resp, err = h.client.Do(ctx, http.MethodGet, resource.CollectionId(config.SubscriptionId, config.ResourceGroup), nil, correlationId)
+	case methodOperation:
+		operationId := s.operationId
+		if len(operationId) == 0 {
+			if h.async == nil {
+				t.Fatalf("step %d: no operation to get", i)
+			}
+			path := operationPath(t, h.async)
+			operationId = path[strings.LastIndex(path, "/")+1:]
+		}
+		resp, err = h.client.Do(ctx, http.MethodGet, fmt.Sprintf("%s/operations/%s", resourceId, operationId), nil, correlationId)
+	default:
+		resp, err = h.client.Do(ctx, s.method, resourceId+s.path, nil, correlationId)
+	}
+	if err != nil {
+		t.Fatalf("step %d: %s failed: %v", i, s.method, err)
+	}
+
+	if s.status != 0 && resp.StatusCode != s.status {
+		t.Errorf("step %d: %s %s returned %d, expected %d: %s", i, resp.Method, resp.URL, resp.StatusCode, s.status, resp.Body)
+		return
+	}
+	if len(s.provisioningState) > 0 {
+		if state, _ := simulator.ProvisioningState(resp); state != s.provisioningState {
+			t.Errorf("step %d: provisioning state is %q, expected %q", i, state, s.provisioningState)
+		}
+	}
+	if len(s.properties) > 0 {
+		properties, _ := resp.JSON()["properties"].(map[string]interface{})
+		for k, v := range s.properties {
+			if properties[k] != v {
+				t.Errorf("step %d: property %s is %v, expected %v", i, k, properties[k], v)
+			}
+		}
+	}
+	if len(s.bodyStatus) > 0 {
+		if status, _ := resp.JSON()["status"].(string); status != s.bodyStatus {
+			t.Errorf("step %d: status is %q, expected %q", i, status, s.bodyStatus)
+		}
+	}
+	if len(s.retryAfter) > 0 && resp.Header.Get("Retry-After") != s.retryAfter {
+		t.Errorf("step %d: Retry-After is %q, expected %q", i, resp.Header.Get("Retry-After"), s.retryAfter)
+	}
+	if s.method == methodList {
+		var list struct {
+			Value []interface{} `json:"value"`
+		}
+		if err := json.Unmarshal(resp.Body, &list); err != nil || list.Value == nil {
+			t.Errorf("step %d: list is not an object with a value array: %v", i, err)
+		} else if len(list.Value) != s.count {
+			t.Errorf("step %d: list returned %d resources, expected %d", i, len(list.Value), s.count)
+		}
+	}
+
+	if s.method != methodOperation && (len(resp.Header.Get("Azure-AsyncOperation")) > 0 || len(resp.Header.Get("Location")) > 0) {
+		h.async = resp
+	}
+	if len(s.operationStatus) > 0 {
+		if h.async == nil {
+			t.Fatalf("step %d: no operation to poll", i)
+		}
+		responses, err := h.client.Poll(ctx, h.async, correlationId)
+		if err != nil {
+			t.Fatalf("step %d: polling failed: %v", i, err)
+		}
+		last := responses[len(responses)-1]
+		if status, _ := last.JSON()["status"].(string); status != s.operationStatus {
+			t.Errorf("step %d: operation finished with %q, expected %q: %s", i, status, s.operationStatus, last.Body)
+		}
+	}
+}
+
+// operationPath returns the path of the operation in the async header of the response
+func operationPath(t *testing.T, resp *simulator.Response) string {
+	header := resp.Header.Get("Azure-AsyncOperation")
+	if len(header) == 0 {
+		header = resp.Header.Get("Location")
+	}
+	u, err := url.Parse(header)
+	if err != nil {
+		t.Fatalf("Invalid async header %s: %v", header, err)
+	}
+	return u.Path
+}
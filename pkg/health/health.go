@@ -0,0 +1,201 @@
+// Package health provides the liveness and readiness endpoints used by container probes, they are served outside of the ARM router so they do not need a resource id
+package health
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-chi/render"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/azure"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/helpers"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/jobs"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/settings"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	StatusOK          = "ok"
+	StatusUnavailable = "unavailable"
+	// StatusDegraded is reported for a check that has a problem that does not stop the handler serving requests
+	StatusDegraded = "degraded"
+	// checkTimeout is how long each readiness check can take
+	checkTimeout = 10 * time.Second
+	// toolCheckInterval is how long the result of the porter and driver checks is cached for so that every probe does not run porter
+	toolCheckInterval = 5 * time.Minute
+)
+
+// Check is a named readiness check
+type Check struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// CheckResult is the result of a readiness check
+type CheckResult struct {
+	Status  string      `json:"status"`
+	Error   string      `json:"error,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// Response is the body returned by the health endpoints
+type Response struct {
+	Status  string                 `json:"status"`
+	Version string                 `json:"version"`
+	Commit  string                 `json:"commit"`
+	Checks  map[string]CheckResult `json:"checks,omitempty"`
+}
+
+// DefaultChecks are the readiness checks for the handler
+var DefaultChecks = []Check{
+	{Name: "credentials", Check: checkCredentials},
+	{Name: "stateStore", Check: azure.CheckStateStore},
+	{Name: "porter", Check: cacheCheck(toolCheckInterval, helpers.CheckPorter)},
+	{Name: "driver", Check: cacheCheck(toolCheckInterval, checkDriver)},
+	{Name: "bundles", Check: func(ctx context.Context) error { return settings.CheckBundlesLoaded() }},
+	{Name: "workers", Check: checkWorkers},
+}
+
+// checkCredentials checks the Azure credential, there is no credential in dev mode or when the storage account key does not need to be looked up using ARM
+func checkCredentials(ctx context.Context) error {
+	if !azure.CredentialsRequired() {
+		return nil
+	}
+	return azure.CheckCredentials()
+}
+
+// checkDriver checks that the Azure CNAB driver is installed when it is the driver used to run bundle actions
+func checkDriver(ctx context.Context) error {
+	if settings.DevMode || settings.Driver != settings.DefaultDriver {
+		return nil
+	}
+	return helpers.CheckAzureDriver()
+}
+
+// checkWorkers fails if the jobs are draining or a worker has stopped, a full queue is reported as degraded by Readyz and in the queue depth metrics as the pod can still serve requests that do not queue a job
+func checkWorkers(ctx context.Context) error {
+	if jobs.Draining() {
+		return fmt.Errorf("jobs are draining for shutdown")
+	}
+	for queue, status := range jobs.Status() {
+		if status.Running != status.Workers {
+			return fmt.Errorf("%s queue has %d of %d workers running", queue, status.Running, status.Workers)
+		}
+	}
+	return nil
+}
+
+// cachedCheck is a check whose result is reused until interval has passed
+type cachedCheck struct {
+	mu       sync.Mutex
+	interval time.Duration
+	check    func(ctx context.Context) error
+	checked  time.Time
+	err      error
+}
+
+// cacheCheck returns a check that runs check at most once every interval, a check that is cancelled or times out is not cached
+func cacheCheck(interval time.Duration, check func(ctx context.Context) error) func(ctx context.Context) error {
+	c := &cachedCheck{interval: interval, check: check}
+	return c.run
+}
+
+func (c *cachedCheck) run(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.checked.IsZero() && time.Since(c.checked) < c.interval {
+		return c.err
+	}
+	err := c.check(ctx)
+	if ctx.Err() != nil {
+		return err
+	}
+	c.checked = time.Now()
+	c.err = err
+	return err
+}
+
+// Healthz reports that the process is running, it does not check any dependencies so that the container is not restarted when a dependency is unavailable
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, Response{
+		Status:  StatusOK,
+		Version: pkg.Version,
+		Commit:  pkg.Commit,
+	})
+}
+
+// Readyz returns a handler that runs the checks and returns 503 if any of them fail
+func Readyz(checks []Check) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		response := Response{
+			Status:  StatusOK,
+			Version: pkg.Version,
+			Commit:  pkg.Commit,
+			Checks:  make(map[string]CheckResult, len(checks)),
+		}
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for _, c := range checks {
+			wg.Add(1)
+			go func(c Check) {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+				defer cancel()
+				result := runCheck(ctx, c)
+				mu.Lock()
+				defer mu.Unlock()
+				response.Checks[c.Name] = result
+				if result.Status != StatusOK {
+					response.Status = StatusUnavailable
+				}
+			}(c)
+		}
+		wg.Wait()
+
+		if c, ok := response.Checks["workers"]; ok {
+			status := jobs.Status()
+			c.Details = status
+			for _, queue := range status {
+				if c.Status == StatusOK && queue.Saturated() {
+					c.Status = StatusDegraded
+				}
+			}
+			response.Checks["workers"] = c
+		}
+		// a failed reload of the provider mappings is reported without failing the check as the previous mappings are still used
+		if c, ok := response.Checks["bundles"]; ok {
+			if status := settings.CurrentMappingStatus(); status != nil {
+				c.Details = status
+				response.Checks["bundles"] = c
+			}
+		}
+
+		status := http.StatusOK
+		if response.Status != StatusOK {
+			log.Infof("Readiness check failed: %+v", response.Checks)
+			status = http.StatusServiceUnavailable
+		}
+		render.Status(r, status)
+		render.JSON(w, r, response)
+	}
+}
+
+func runCheck(ctx context.Context, c Check) CheckResult {
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Check(ctx)
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return CheckResult{Status: StatusUnavailable, Error: err.Error()}
+		}
+		return CheckResult{Status: StatusOK}
+	case <-ctx.Done():
+		return CheckResult{Status: StatusUnavailable, Error: fmt.Sprintf("Check timed out: %v", ctx.Err())}
+	}
+}
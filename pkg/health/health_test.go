@@ -0,0 +1,65 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCacheCheck(t *testing.T) {
+	tests := []struct {
+		name           string
+		interval       time.Duration
+		err            error
+		expectedRuns   int
+		expectedHTTPOK bool
+	}{
+		{name: "success is cached", interval: time.Hour, expectedRuns: 1, expectedHTTPOK: true},
+		{name: "failure is cached", interval: time.Hour, err: errors.New("porter failed"), expectedRuns: 1},
+		{name: "expired result is checked again", interval: 0, expectedRuns: 3, expectedHTTPOK: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runs := 0
+			check := cacheCheck(tt.interval, func(ctx context.Context) error {
+				runs++
+				return tt.err
+			})
+			handler := Readyz([]Check{{Name: "porter", Check: check}})
+			for i := 0; i < 3; i++ {
+				req := httptest.NewRequest(http.MethodGet, "/readyz", nil)
+				rec := httptest.NewRecorder()
+				handler(rec, req)
+				if ok := rec.Code == http.StatusOK; ok != tt.expectedHTTPOK {
+					t.Errorf("probe %d returned %d, expected ok %v", i, rec.Code, tt.expectedHTTPOK)
+				}
+			}
+			if runs != tt.expectedRuns {
+				t.Errorf("check ran %d times, expected %d", runs, tt.expectedRuns)
+			}
+		})
+	}
+}
+
+func TestCacheCheckCancelled(t *testing.T) {
+	runs := 0
+	check := cacheCheck(time.Hour, func(ctx context.Context) error {
+		runs++
+		return ctx.Err()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := check(ctx); err == nil {
+		t.Error("cancelled check succeeded")
+	}
+	if err := check(context.Background()); err != nil {
+		t.Errorf("check failed after a cancelled check: %v", err)
+	}
+	if runs != 2 {
+		t.Errorf("check ran %d times, expected the cancelled result not to be cached", runs)
+	}
+}
@@ -11,6 +11,9 @@ const (
 	ProvisioningStateSucceeded = "Succeeded"
 	ProvisioningStateFailed    = "Failed"
 	ProvisioningStateDeleting  = "Deleting"
+	ProvisioningStateUpdating  = "Updating"
+	ProvisioningStateCreated   = "Created"
+	ProvisioningStateAccepted  = "Accepted"
 	StatusSucceeded            = "Succeeded"
 	StatusFailed               = "Failed"
 	APIVersion                 = "2018-09-01-preview"
@@ -2,6 +2,7 @@ package helpers
 
 import (
 	"net/http"
+	"strings"
 
 	"github.com/go-chi/render"
 )
@@ -13,16 +14,32 @@ type RequestError struct {
 }
 type ErrorResponse struct {
 	*RequestError `json:"ErrorResponse"`
+	// Error is the ARM error object, it is only set when the error is rendered so that the stored error is unchanged
+	Error *ErrorDetail `json:"error,omitempty"`
+}
+
+// ErrorDetail is the error object that ARM expects in the body of an error response
+type ErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
 }
 
 func (e *ErrorResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	message := e.Message
+	if len(message) == 0 {
+		message = e.Status
+	}
+	e.Error = &ErrorDetail{
+		Code:    strings.ReplaceAll(e.Status, " ", ""),
+		Message: message,
+	}
 	render.Status(r, e.HTTPStatusCode)
 	return nil
 }
 
 func ErrorInternalServerErrorFromError(err error) *ErrorResponse {
 	return &ErrorResponse{
-		&RequestError{
+		RequestError: &RequestError{
 			HTTPStatusCode: 500,
 			Status:         "Internal Server Error",
 			Message:        err.Error(),
@@ -32,7 +49,7 @@ func ErrorInternalServerErrorFromError(err error) *ErrorResponse {
 
 func ErrorConflict(message string) render.Renderer {
 	return &ErrorResponse{
-		&RequestError{
+		RequestError: &RequestError{
 			HTTPStatusCode: 409,
 			Status:         "Conflict",
 			Message:        message,
@@ -42,7 +59,7 @@ func ErrorConflict(message string) render.Renderer {
 
 func ErrorNotFound() render.Renderer {
 	return &ErrorResponse{
-		&RequestError{
+		RequestError: &RequestError{
 			HTTPStatusCode: 404,
 			Status:         "Resource Not Found",
 		},
@@ -51,7 +68,7 @@ func ErrorNotFound() render.Renderer {
 
 func ErrorInternalServerError(message string) *ErrorResponse {
 	return &ErrorResponse{
-		&RequestError{
+		RequestError: &RequestError{
 			HTTPStatusCode: 500,
 			Status:         "Internal Server Error",
 			Message:        message,
@@ -61,7 +78,7 @@ func ErrorInternalServerError(message string) *ErrorResponse {
 
 func ErrorInvalidRequestFromError(err error) render.Renderer {
 	return &ErrorResponse{
-		&RequestError{
+		RequestError: &RequestError{
 			HTTPStatusCode: 400,
 			Status:         "Invalid Request",
 			Message:        err.Error(),
@@ -71,10 +88,30 @@ func ErrorInvalidRequestFromError(err error) render.Renderer {
 
 func ErrorInvalidRequest(message string) render.Renderer {
 	return &ErrorResponse{
-		&RequestError{
+		RequestError: &RequestError{
 			HTTPStatusCode: 400,
 			Status:         "Invalid Request",
 			Message:        message,
 		},
 	}
 }
+
+func ErrorUnauthorized(message string) render.Renderer {
+	return &ErrorResponse{
+		RequestError: &RequestError{
+			HTTPStatusCode: 401,
+			Status:         "Unauthorized",
+			Message:        message,
+		},
+	}
+}
+
+func ErrorServiceUnavailable(message string) render.Renderer {
+	return &ErrorResponse{
+		RequestError: &RequestError{
+			HTTPStatusCode: 503,
+			Status:         "Service Unavailable",
+			Message:        message,
+		},
+	}
+}
@@ -1,15 +1,20 @@
 package helpers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
 	"strings"
+	"time"
 
 	"github.com/cnabio/cnab-go/bundle"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/logging"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/metrics"
 	"github.com/simongdavies/cnab-custom-resource-handler/pkg/settings"
-	log "github.com/sirupsen/logrus"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type PorterOutput struct {
@@ -18,12 +23,27 @@ type PorterOutput struct {
 	Type  string `json:"Type"`
 }
 
-func ExecutePorterCommand(args []string) ([]byte, error) {
+// PorterRunner runs porter with the arguments and environment and returns its combined output
+type PorterRunner func(ctx context.Context, args []string, env []string) ([]byte, error)
+
+var porterRunner PorterRunner = runPorter
+
+// UsePorterRunner replaces the function that runs porter, it is used to run the handler without porter such as in tests
+func UsePorterRunner(runner PorterRunner) {
+	porterRunner = runner
+}
+
+// ExecutePorterCommand runs porter with args, porter is killed if ctx is cancelled such as when a job is interrupted by a shutdown
+func ExecutePorterCommand(ctx context.Context, args []string) (out []byte, err error) {
+	ctx, span := tracing.Start(ctx, fmt.Sprintf("porter %s", porterAction(args)), attribute.String("porter.bundle", porterBundle(args)))
+	defer func() {
+		tracing.End(span, err)
+	}()
 
 	env := os.Environ()
 	if isDriverCommand(args[0]) {
-		args = append(args, "--driver", "azure")
-		if settings.Debug {
+		args = append(args, "--driver", settings.Driver)
+		if settings.Debug && settings.Driver == settings.DefaultDriver {
 			env = append(env, "CNAB_AZURE_DELETE_RESOURCES=false")
 		}
 	}
@@ -32,20 +52,89 @@ func ExecutePorterCommand(args []string) ([]byte, error) {
 		args = append(args, "--output", "json")
 	}
 
-	log.Debugf("porter %v", args)
+	logging.FromContext(ctx).Debugf("porter %v", args)
 
-	cmd := exec.Command("porter", args...)
-	cmd.Env = env
-	out, err := cmd.CombinedOutput()
+	start := time.Now()
+	out, err = porterRunner(ctx, args, tracing.Environment(ctx, env))
+	metrics.ObservePorter(porterAction(args), porterBundle(args), exitCode(err), time.Since(start))
 	//out, err := exec.Command("porter", args...).CombinedOutput()
 	if err != nil {
-		log.Debugf("Command failed Error:%v Output: %s", err, string(out))
+		// the output is not logged as porter can echo credentials and sensitive parameters, jobs record it against the operation once it is redacted with the bundle
+		logging.FromContext(ctx).Debugf("Command failed Error:%v", err)
 		return out, fmt.Errorf("Porter command failed: %v", err)
 	}
 
 	return out, nil
 }
 
+func runPorter(ctx context.Context, args []string, env []string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "porter", args...)
+	cmd.Env = env
+	return cmd.CombinedOutput()
+}
+
+// exitCode returns the exit code of a porter command from its error, -1 means porter did not run
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// CheckPorter checks that porter can be run and that the plugins it is configured to use are installed
+func CheckPorter(ctx context.Context) error {
+	if _, err := ExecutePorterCommand(ctx, []string{"version"}); err != nil {
+		return err
+	}
+	out, err := ExecutePorterCommand(ctx, []string{"plugins", "list"})
+	if err != nil {
+		return err
+	}
+	// the azure plugin stores claims and credentials in Azure storage alongside actions run by the Azure driver, in dev mode or with a local driver porter uses its default local storage
+	if !settings.DevMode && settings.Driver == settings.DefaultDriver && !strings.Contains(string(out), "azure") {
+		return fmt.Errorf("Porter azure plugin is not installed")
+	}
+	return nil
+}
+
+// CheckAzureDriver checks that the Azure CNAB driver used to run bundle actions is on the path
+func CheckAzureDriver() error {
+	if _, err := exec.LookPath("cnab-azure"); err != nil {
+		return fmt.Errorf("Azure CNAB driver cnab-azure is not installed: %v", err)
+	}
+	return nil
+}
+
+// porterAction returns the bundle action for invoke commands otherwise the porter command
+func porterAction(args []string) string {
+	if args[0] == "invoke" {
+		if action := argValue(args, "--action"); len(action) > 0 {
+			return action
+		}
+	}
+	return args[0]
+}
+
+// porterBundle returns the bundle reference or bundle file the command is run against, commands that do not use a bundle return an empty string
+func porterBundle(args []string) string {
+	if bundleFile := argValue(args, "--cnab-file"); len(bundleFile) > 0 {
+		return bundleFile
+	}
+	return argValue(args, "--reference")
+}
+
+func argValue(args []string, flag string) string {
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == flag {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
 func isDriverCommand(cmd string) bool {
 	return strings.Contains("installupgradeuninstallinvoke", cmd)
 }
@@ -54,11 +143,11 @@ func isOutputCommand(cmd string) bool {
 	return cmd == "installations"
 }
 
-func GetBundleOutput(rpBundle *bundle.Bundle, installationName string, actions []string) ([]PorterOutput, error) {
+func GetBundleOutput(ctx context.Context, rpBundle *bundle.Bundle, installationName string, actions []string) ([]PorterOutput, error) {
 	var cmdOutput []PorterOutput
 	args := []string{}
 	args = append(args, "installations", "output", "list", "-i", installationName)
-	out, err := ExecutePorterCommand(args)
+	out, err := ExecutePorterCommand(ctx, args)
 	if err != nil {
 		return nil, err
 	}
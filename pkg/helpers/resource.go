@@ -2,6 +2,7 @@ package helpers
 
 import (
 	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"strings"
@@ -35,8 +36,62 @@ func GetResourceDetails(r *http.Request) (*azure.Resource, *string, *string, err
 	log.Debugf("Resource Type: %s", resource.ResourceType)
 	return &resource, &resourceId, &requestPath, nil
 }
+
+// GetCaller returns the identity of the caller from the headers that ARM adds to the request
+func GetCaller(r *http.Request) string {
+	if caller := r.Header.Get("X-Ms-Client-Object-Id"); len(caller) > 0 {
+		return caller
+	}
+	return r.Header.Get("X-Ms-Client-Principal-Name")
+}
+
 func GetInstallationName(trimmedBundleTag string, requestPath string) string {
 	data := []byte(fmt.Sprintf("%s%s", strings.ToLower(trimmedBundleTag), strings.ToLower(requestPath)))
 	hash := sha256.Sum256(data)
 	return fmt.Sprintf("%x", hash)
 }
+
+// GetFingerprint returns a hash of the bundle digest, forceUpdateTag, parameters and credentials, parameter and credential values are normalised to the string form that is passed to porter
+func GetFingerprint(bundleDigest string, forceUpdateTag string, params map[string]interface{}, creds map[string]interface{}) (string, error) {
+	fingerprint := struct {
+		BundleDigest   string
+		ForceUpdateTag string
+		Parameters     map[string]string
+		Credentials    map[string]string
+	}{
+		BundleDigest:   bundleDigest,
+		ForceUpdateTag: forceUpdateTag,
+		Parameters:     normaliseValues(params),
+		Credentials:    normaliseValues(creds),
+	}
+	// json.Marshal sorts map keys so the result is stable
+	data, err := json.Marshal(fingerprint)
+	if err != nil {
+		return "", fmt.Errorf("Failed to serialise fingerprint: %v", err)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data)), nil
+}
+
+func normaliseValues(values map[string]interface{}) map[string]string {
+	result := make(map[string]string, len(values))
+	for k, v := range values {
+		result[k] = fmt.Sprintf("%v", v)
+	}
+	return result
+}
+
+// GetActionFingerprint returns a hash of the action name and its parameters, it is used to detect whether a repeated POST is for the action that is already running
+func GetActionFingerprint(action string, params map[string]interface{}) (string, error) {
+	fingerprint := struct {
+		Action     string
+		Parameters map[string]string
+	}{
+		Action:     strings.ToLower(action),
+		Parameters: normaliseValues(params),
+	}
+	data, err := json.Marshal(fingerprint)
+	if err != nil {
+		return "", fmt.Errorf("Failed to serialise action fingerprint: %v", err)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data)), nil
+}
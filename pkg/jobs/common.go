@@ -1,21 +1,70 @@
 package jobs
 
 import (
+	"sync/atomic"
+
+	"github.com/cnabio/cnab-go/bundle"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/models"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/redact"
 	log "github.com/sirupsen/logrus"
 )
 
 var MaxJobs int = 2
 
+// workersRunning counts the workers for each queue that are receiving jobs
+var workersRunning struct {
+	put    int32
+	delete int32
+	post   int32
+}
+
+// QueueStatus describes the workers and jobs of a queue
+type QueueStatus struct {
+	Workers  int `json:"workers"`
+	Running  int `json:"running"`
+	Queued   int `json:"queued"`
+	Capacity int `json:"capacity"`
+}
+
+// Saturated returns true if the queue has no space for another job
+func (q QueueStatus) Saturated() bool {
+	return q.Queued >= q.Capacity
+}
+
+// Status returns the status of each job queue
+func Status() map[string]QueueStatus {
+	return map[string]QueueStatus{
+		"put":    {Workers: MaxJobs, Running: int(atomic.LoadInt32(&workersRunning.put)), Queued: len(PutJobs), Capacity: cap(PutJobs)},
+		"delete": {Workers: MaxJobs, Running: int(atomic.LoadInt32(&workersRunning.delete)), Queued: len(DeleteJobs), Capacity: cap(DeleteJobs)},
+		"post":   {Workers: MaxJobs, Running: int(atomic.LoadInt32(&workersRunning.post)), Queued: len(PostJobs), Capacity: cap(PostJobs)},
+	}
+}
+
+// Start starts the job workers and requeues the PUT and DELETE jobs that were interrupted by the last shutdown
 func Start() {
 	log.Debug("Starting Jobs")
 	startPutJob()
 	startDeleteJob()
 	startPostJob()
+	startRetentionJob()
+	startResourceCountJob()
+	go requeueInterrupted()
 }
 
+// Stop closes the queues so that the workers exit, jobs queued after Stop by requests that were still in progress are recorded as interrupted
 func Stop() {
 	log.Debug("Stopping Jobs")
+	stopRetention()
+	stopResourceCount()
+	queuesLock.Lock()
+	defer queuesLock.Unlock()
+	queuesClosed = true
 	close(PutJobs)
 	close(DeleteJobs)
 	close(PostJobs)
 }
+
+// redactOutput masks the credentials and sensitive parameters of the resource in porter output before it is stored
+func redactOutput(rpBundle *bundle.Bundle, properties *models.BundleCommandProperties, output string) string {
+	return redact.Text(output, rpBundle, properties.Parameters, properties.Credentials)
+}
@@ -1,15 +1,21 @@
 package jobs
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"sync/atomic"
+	"time"
 
 	"github.com/simongdavies/cnab-custom-resource-handler/pkg/azure"
 	"github.com/simongdavies/cnab-custom-resource-handler/pkg/common"
 	"github.com/simongdavies/cnab-custom-resource-handler/pkg/helpers"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/logging"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/metrics"
 	"github.com/simongdavies/cnab-custom-resource-handler/pkg/models"
 	"github.com/simongdavies/cnab-custom-resource-handler/pkg/settings"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/tracing"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -19,60 +25,83 @@ type DeleteJobData struct {
 	InstallationName string
 	OperationId      string
 	BundleInfo       *settings.BundleInformation
+	// TraceContext carries the trace of the request that queued the job
+	TraceContext map[string]string
+	// LogFields are the log fields of the request that queued the job
+	LogFields log.Fields
+}
+
+// withLogFields returns ctx with the log fields of the request that queued the job and the fields that identify the job
+func (jobData *DeleteJobData) withLogFields(ctx context.Context) context.Context {
+	ctx = logging.WithFields(ctx, jobData.LogFields)
+	return logging.WithFields(ctx, log.Fields{
+		logging.OperationIdField:      jobData.OperationId,
+		logging.ActionField:           "delete",
+		logging.InstallationNameField: jobData.InstallationName,
+	})
 }
 
 var DeleteJobs chan *DeleteJobData = make(chan *DeleteJobData, 20)
 
 func startDeleteJob() {
+	metrics.SetJobWorkers("delete", MaxJobs)
 	for i := 0; i < MaxJobs; i++ {
 		go func(deleteJobs chan *DeleteJobData, i int) {
 			log.Debugf("Starting Delete Job %d", i)
+			atomic.AddInt32(&workersRunning.delete, 1)
+			defer atomic.AddInt32(&workersRunning.delete, -1)
 			for jobData := range deleteJobs {
-				log.Debugf("Starting Delete Resource Job for %s", jobData.RPInput.Id)
-				deleteJob(jobData)
-				log.Debugf("Finished Delete Resource Job for %s", jobData.RPInput.Id)
+				if Draining() {
+					interruptDelete(jobData.withLogFields(context.Background()), jobData)
+					continue
+				}
+				done := metrics.JobStarted("delete")
+				ctx, span := tracing.StartJob(jobData.TraceContext, "DELETE job", jobData.RPInput.Id, jobData.OperationId)
+				ctx = jobData.withLogFields(ctx)
+				logging.FromContext(ctx).Debugf("Starting Delete Resource Job for %s", jobData.RPInput.Id)
+				stop, finished := trackJob(ctx, jobData.OperationId)
+				deleteJob(ctx, stop, jobData)
+				finished()
+				span.End()
+				done()
+				logging.FromContext(ctx).Debugf("Finished Delete Resource Job for %s", jobData.RPInput.Id)
 			}
 			log.Debugf("Stopped Delete Job %d", i)
 		}(DeleteJobs, i)
 	}
 }
 
-func deleteJob(jobData *DeleteJobData) {
+func deleteJob(ctx context.Context, stop context.Context, jobData *DeleteJobData) {
 
 	//TODO retry delete with last used Tag in case of errors
-	log.Debugf("Started processing DELETE request for %s", jobData.RPInput.Id)
+	logging.FromContext(ctx).Debugf("Started processing DELETE request for %s", jobData.RPInput.Id)
 	jobData.RPInput.Properties.ProvisioningState = helpers.ProvisioningStateFailed
 
 	dir, err := ioutil.TempDir("", "")
 	if err != nil {
 		responseError := helpers.ErrorInternalServerErrorFromError(fmt.Errorf("error creating temp dir: %v", err))
-		if err := azure.SetFailedProvisioningState(jobData.RPInput.SubscriptionId, jobData.RPInput.Id, responseError); err != nil {
-			log.Debugf("Failed to Merge RP State for response error %v: %v", responseError, err)
-		}
+		setDeleteFailed(ctx, jobData, responseError)
 		return
 	}
 	defer os.RemoveAll(dir)
 
-	properties, err := azure.GetRPState(jobData.RPInput.SubscriptionId, jobData.RPInput.Id)
+	properties, err := azure.GetRPState(ctx, jobData.RPInput.SubscriptionId, jobData.RPInput.Id)
 	if err != nil {
 		responseError := helpers.ErrorInternalServerErrorFromError(fmt.Errorf("Failed to get RPState for Delete: %v", err))
-		if err := azure.SetFailedProvisioningState(jobData.RPInput.SubscriptionId, jobData.RPInput.Id, responseError); err != nil {
-			log.Debugf("Failed to Merge RP State for response error %v: %v", responseError, err)
-		}
+		setDeleteFailed(ctx, jobData, responseError)
 		return
 	}
 
 	jobData.RPInput.Properties = properties
 
-	jobData.Args = append(jobData.Args, "uninstall", jobData.InstallationName, "--delete", "--reference", jobData.BundleInfo.BundlePullOptions.Tag, "--force-delete")
+	jobData.Args = append(jobData.Args, "uninstall", jobData.InstallationName, "--delete", "--force-delete")
+	jobData.Args = append(jobData.Args, jobData.BundleInfo.BundleArgs()...)
 
 	if len(jobData.RPInput.Properties.Parameters) > 0 {
 		paramFile, err := common.WriteParametersFile(jobData.BundleInfo.RPBundle, jobData.RPInput.Properties.Parameters, dir)
 		if err != nil {
 			responseError := helpers.ErrorInternalServerErrorFromError(err)
-			if err := azure.SetFailedProvisioningState(jobData.RPInput.SubscriptionId, jobData.RPInput.Id, responseError); err != nil {
-				log.Debugf("Failed to Merge RP State for response error %v: %v", responseError, err)
-			}
+			setDeleteFailed(ctx, jobData, responseError)
 			return
 		}
 		jobData.Args = append(jobData.Args, "-p", paramFile.Name())
@@ -83,36 +112,57 @@ func deleteJob(jobData *DeleteJobData) {
 		credFile, err := common.WriteCredentialsFile(jobData.BundleInfo.RPBundle, jobData.RPInput.Properties.Credentials, dir)
 		if err != nil {
 			responseError := helpers.ErrorInternalServerErrorFromError(err)
-			if err := azure.SetFailedProvisioningState(jobData.RPInput.SubscriptionId, jobData.RPInput.Id, responseError); err != nil {
-				log.Debugf("Failed to Merge RP State for response error %v: %v", responseError, err)
-			}
+			setDeleteFailed(ctx, jobData, responseError)
 			return
 		}
 		jobData.Args = append(jobData.Args, "-c", credFile.Name())
 		defer os.Remove(credFile.Name())
 	}
 
-	out, err := helpers.ExecutePorterCommand(jobData.Args)
+	out, err := helpers.ExecutePorterCommand(stop, jobData.Args)
+	if err != nil && stop.Err() != nil {
+		interruptDelete(ctx, jobData)
+		return
+	}
 	if err != nil {
-		responseError := helpers.ErrorInternalServerError(string(out))
-		if err := azure.SetFailedProvisioningState(jobData.RPInput.SubscriptionId, jobData.RPInput.Id, responseError); err != nil {
-			log.Debugf("Failed to Merge RP State for response error %v: %v", responseError, err)
-		}
+		responseError := helpers.ErrorInternalServerError(redactOutput(jobData.BundleInfo.RPBundle, jobData.RPInput.Properties, string(out)))
+		setDeleteFailed(ctx, jobData, responseError)
 		return
 	}
 
-	if err := azure.DeleteRPState(jobData.RPInput.SubscriptionId, jobData.RPInput.Id); err != nil {
+	if err := azure.DeleteRPState(ctx, jobData.RPInput.SubscriptionId, jobData.RPInput.Id); err != nil {
 		responseError := helpers.ErrorInternalServerErrorFromError(fmt.Errorf("Failed to delete RP state for %s error: %v", jobData.RPInput.Id, err))
-		if err := azure.SetFailedProvisioningState(jobData.RPInput.SubscriptionId, jobData.RPInput.Id, responseError); err != nil {
-			log.Debugf("Failed to Delete RP State for response error %v: %v", responseError, err)
-		}
+		setDeleteFailed(ctx, jobData, responseError)
+		return
 	}
 
-	if err := azure.PutAsyncOp(jobData.RPInput.SubscriptionId, jobData.OperationId, "delete", helpers.AsyncOperationComplete, nil); err != nil {
-		log.Debugf("Failed to update async op for %s error: %v", jobData.RPInput.Id, err)
+	asyncOp := azure.AsyncOperationState{
+		Action:  "delete",
+		Status:  helpers.AsyncOperationComplete,
+		EndTime: time.Now().UTC(),
+	}
+	if err := azure.PutAsyncOp(ctx, jobData.RPInput.SubscriptionId, jobData.OperationId, &asyncOp); err != nil {
+		logging.FromContext(ctx).Debugf("Failed to update async op for %s error: %v", jobData.RPInput.Id, err)
 		return
 	}
 
-	log.Debugf("Finished processing DELETE request for %s", jobData.RPInput.Id)
+	logging.FromContext(ctx).Debugf("Finished processing DELETE request for %s", jobData.RPInput.Id)
+
+}
 
+// setDeleteFailed records the failure in both the RP state and the async operation for the DELETE
+func setDeleteFailed(ctx context.Context, jobData *DeleteJobData, responseError *helpers.ErrorResponse) {
+	tracing.SetError(ctx, responseError.Message)
+	if err := azure.SetFailedProvisioningState(ctx, jobData.RPInput.SubscriptionId, jobData.RPInput.Id, responseError); err != nil {
+		logging.FromContext(ctx).Debugf("Failed to Merge RP State for response error %v: %v", responseError, err)
+	}
+	asyncOp := azure.AsyncOperationState{
+		Action:  "delete",
+		Status:  helpers.AsyncOperationFailed,
+		Error:   responseError.Message,
+		EndTime: time.Now().UTC(),
+	}
+	if err := azure.PutAsyncOp(ctx, jobData.RPInput.SubscriptionId, jobData.OperationId, &asyncOp); err != nil {
+		logging.FromContext(ctx).Debugf("Failed to update async op for %s error: %v", jobData.RPInput.Id, err)
+	}
 }
@@ -0,0 +1,89 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/cnabio/cnab-go/bundle"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/azure"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/helpers"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/models"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/settings"
+)
+
+func TestDeleteJobFailed(t *testing.T) {
+	const (
+		subscriptionId = "subscription"
+		resourceId     = "/subscriptions/subscription/resourceGroups/rg/providers/Microsoft.CustomProviders/resourceProviders/rp/test/failed"
+		operationId    = "operation"
+		secret         = "kubeconfig-secret-value"
+	)
+	store, err := azure.NewLocalStateStore("")
+	if err != nil {
+		t.Fatalf("Failed to create state store: %v", err)
+	}
+	azure.UseStateStore(store)
+	helpers.UsePorterRunner(func(ctx context.Context, args []string, env []string) ([]byte, error) {
+		return []byte("uninstall failed using " + secret), errors.New("exit status 1")
+	})
+
+	ctx := context.Background()
+	bundleInfo := &settings.BundleInformation{
+		ResourceProvider: "rp",
+		ResourceType:     "test",
+		BundleFile:       "bundle.json",
+		RPBundle: &bundle.Bundle{
+			Credentials: map[string]bundle.Credential{
+				"kubeconfig": {},
+			},
+		},
+	}
+	properties := &models.BundleCommandProperties{
+		Credentials:       map[string]interface{}{"kubeconfig": secret},
+		ProvisioningState: helpers.ProvisioningStateDeleting,
+		OperationId:       operationId,
+		BundleInformation: bundleInfo,
+	}
+	if err := store.PutRPState(ctx, subscriptionId, resourceId, properties); err != nil {
+		t.Fatalf("Failed to put state: %v", err)
+	}
+	if err := store.PutAsyncOp(ctx, subscriptionId, operationId, &azure.AsyncOperationState{ResourceId: resourceId, Action: "delete", Status: helpers.ProvisioningStateDeleting}); err != nil {
+		t.Fatalf("Failed to put async op: %v", err)
+	}
+
+	deleteJob(ctx, ctx, &DeleteJobData{
+		RPInput: &models.BundleRP{
+			RPProperties: models.RPProperties{
+				Id:             resourceId,
+				SubscriptionId: subscriptionId,
+			},
+			Properties: properties,
+		},
+		InstallationName: "installation",
+		OperationId:      operationId,
+		BundleInfo:       bundleInfo,
+	})
+
+	state, err := store.GetRPState(ctx, subscriptionId, resourceId)
+	if err != nil {
+		t.Fatalf("Failed to get state: %v", err)
+	}
+	if state.ProvisioningState != helpers.ProvisioningStateFailed {
+		t.Errorf("provisioning state %s, expected %s", state.ProvisioningState, helpers.ProvisioningStateFailed)
+	}
+	op, err := store.GetAsyncOp(ctx, subscriptionId, operationId)
+	if err != nil {
+		t.Fatalf("Failed to get async op: %v", err)
+	}
+	if op.Status != helpers.AsyncOperationFailed {
+		t.Errorf("operation status %s, expected %s", op.Status, helpers.AsyncOperationFailed)
+	}
+	if !strings.Contains(op.Error, "uninstall failed") || op.EndTime.IsZero() {
+		t.Errorf("operation has error %q and end time %v, expected the porter output and an end time", op.Error, op.EndTime)
+	}
+	if strings.Contains(op.Error, secret) {
+		t.Errorf("operation error %q contains the credential", op.Error)
+	}
+}
@@ -0,0 +1,117 @@
+package jobs
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/azure"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/logging"
+	log "github.com/sirupsen/logrus"
+)
+
+// interruptWait is how long Drain waits for the running jobs to stop after they are interrupted, porter is killed so they only need to record that they were interrupted
+const interruptWait = 2 * time.Second
+
+var draining int32
+
+// Draining returns true once Drain has been called, no new jobs are started when the handler is draining
+func Draining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+// Drain stops the workers starting new jobs and waits for the running jobs to finish, it returns within gracePeriod including the time the interrupted jobs are given to stop.
+// The queues are only held in memory so jobs that are queued or still running at the end of the grace period cannot be handed back, instead porter is stopped and their operations are recorded as interrupted.
+// The resources keep their provisioning state and the operations are left running so that PUT and DELETE jobs are requeued when the handler starts again
+func Drain(gracePeriod time.Duration) {
+	if !atomic.CompareAndSwapInt32(&draining, 0, 1) {
+		return
+	}
+	jobWait := gracePeriod - interruptWait
+	if jobWait < 0 {
+		jobWait = 0
+	}
+	log.Infof("Draining jobs, waiting up to %v for %d running jobs", jobWait, atomic.LoadInt32(&jobsRunning))
+	interruptQueued()
+	waitForJobs(jobWait)
+
+	// jobs could have been queued by requests that were in progress when draining started
+	interruptQueued()
+	interrupted := 0
+	registry.Range(func(key interface{}, value interface{}) bool {
+		job := value.(*trackedJob)
+		if job.info.State != JobStateRunning {
+			return true
+		}
+		logging.FromContext(job.ctx).Warnf("Job for operation %s did not finish in the grace period", key)
+		// the job records the interruption itself once porter has stopped so that it does not race with the job recording its result
+		job.stop()
+		interrupted++
+		return true
+	})
+	waitForJobs(interruptWait)
+	log.Infof("Finished draining jobs, %d running jobs were interrupted", interrupted)
+}
+
+// waitForJobs waits up to timeout for the running jobs to finish
+func waitForJobs(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for atomic.LoadInt32(&jobsRunning) > 0 && time.Now().Before(deadline) {
+		<-ticker.C
+	}
+}
+
+// interruptQueued removes the jobs waiting in the queues and marks them as interrupted
+func interruptQueued() {
+	for {
+		select {
+		case jobData, ok := <-PutJobs:
+			if !ok {
+				return
+			}
+			interruptPut(jobData.withLogFields(context.Background()), jobData)
+		case jobData, ok := <-DeleteJobs:
+			if !ok {
+				return
+			}
+			interruptDelete(jobData.withLogFields(context.Background()), jobData)
+		case jobData, ok := <-PostJobs:
+			if !ok {
+				return
+			}
+			interruptPost(jobData.withLogFields(context.Background()), jobData)
+		default:
+			return
+		}
+	}
+}
+
+// interruptPut records that a PUT job was interrupted, the resource keeps its provisioning state so that the job can be requeued
+func interruptPut(ctx context.Context, jobData *PutJobData) {
+	untrackJob(jobData.OperationId)
+	logging.FromContext(ctx).Warnf("Interrupted PUT operation %s for %s, it will be requeued when the handler starts", jobData.OperationId, jobData.RPInput.Id)
+	setInterrupted(ctx, jobData.RPInput.SubscriptionId, jobData.OperationId)
+}
+
+// interruptDelete records that a DELETE job was interrupted, the resource stays in the Deleting provisioning state so that the job can be requeued
+func interruptDelete(ctx context.Context, jobData *DeleteJobData) {
+	untrackJob(jobData.OperationId)
+	logging.FromContext(ctx).Warnf("Interrupted DELETE operation %s for %s, it will be requeued when the handler starts", jobData.OperationId, jobData.RPInput.Id)
+	setInterrupted(ctx, jobData.RPInput.SubscriptionId, jobData.OperationId)
+}
+
+// interruptPost records that a POST job was interrupted, the action parameters are not stored so the action cannot be requeued, the resource keeps the running action so that it can be failed with the admin API
+func interruptPost(ctx context.Context, jobData *PostJobData) {
+	untrackJob(jobData.OperationId)
+	logging.FromContext(ctx).Warnf("Interrupted POST operation %s for %s, it can be failed with the admin API", jobData.OperationId, jobData.RPInput.Id)
+	setInterrupted(ctx, jobData.RPInput.SubscriptionId, jobData.OperationId)
+}
+
+// setInterrupted marks the operation as interrupted without changing its status so that ARM keeps polling it
+func setInterrupted(ctx context.Context, subscriptionId string, operationId string) {
+	if err := azure.PutAsyncOp(ctx, subscriptionId, operationId, &azure.AsyncOperationState{Interrupted: true}); err != nil {
+		logging.FromContext(ctx).Errorf("Failed to record that operation %s was interrupted: %v", operationId, err)
+	}
+}
@@ -0,0 +1,197 @@
+package jobs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/azure"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/helpers"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/models"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/settings"
+)
+
+func TestInterruptedJobs(t *testing.T) {
+	const (
+		subscriptionId = "subscription"
+		resourceId     = "/subscriptions/subscription/resourceGroups/rg/providers/Microsoft.CustomProviders/resourceProviders/rp/test/interrupted"
+		operationId    = "operation"
+	)
+	bundleInfo := &settings.BundleInformation{
+		ResourceProvider: "rp",
+		ResourceType:     "test",
+		BundleFile:       "bundle.json",
+	}
+	rpInput := func(provisioningState string) *models.BundleRP {
+		return &models.BundleRP{
+			RPProperties: models.RPProperties{
+				Id:             resourceId,
+				SubscriptionId: subscriptionId,
+			},
+			Properties: &models.BundleCommandProperties{
+				ProvisioningState: provisioningState,
+				OperationId:       operationId,
+				BundleInformation: bundleInfo,
+			},
+		}
+	}
+
+	tests := []struct {
+		name              string
+		provisioningState string
+		status            string
+		run               func(ctx context.Context, stop context.Context)
+		// interrupted is true if the job is stopped while porter is running, otherwise it is stopped after porter has finished
+		interrupted bool
+		// expectedProvisioningState is the provisioning state of the resource after the job
+		expectedProvisioningState string
+		// expectedStatus is the status of the operation after the job
+		expectedStatus string
+	}{
+		{
+			name:              "put interrupted",
+			provisioningState: helpers.ProvisioningStateAccepted,
+			status:            "Runninginstall",
+			run: func(ctx context.Context, stop context.Context) {
+				putJob(ctx, stop, &PutJobData{RPInput: rpInput(helpers.ProvisioningStateAccepted), Args: []string{"install", "installation"}, OperationId: operationId, Action: "install"})
+			},
+			interrupted:               true,
+			expectedProvisioningState: helpers.ProvisioningStateAccepted,
+			expectedStatus:            "Runninginstall",
+		},
+		{
+			name:              "put finished before it was interrupted",
+			provisioningState: helpers.ProvisioningStateAccepted,
+			status:            "Runninginstall",
+			run: func(ctx context.Context, stop context.Context) {
+				putJob(ctx, stop, &PutJobData{RPInput: rpInput(helpers.ProvisioningStateAccepted), Args: []string{"install", "installation"}, OperationId: operationId, Action: "install"})
+			},
+			expectedProvisioningState: helpers.ProvisioningStateSucceeded,
+			expectedStatus:            helpers.AsyncOperationComplete,
+		},
+		{
+			name:              "delete interrupted",
+			provisioningState: helpers.ProvisioningStateDeleting,
+			status:            "Runninguninstall",
+			run: func(ctx context.Context, stop context.Context) {
+				deleteJob(ctx, stop, &DeleteJobData{RPInput: rpInput(helpers.ProvisioningStateDeleting), InstallationName: "installation", OperationId: operationId, BundleInfo: bundleInfo})
+			},
+			interrupted:               true,
+			expectedProvisioningState: helpers.ProvisioningStateDeleting,
+			expectedStatus:            "Runninguninstall",
+		},
+		{
+			name:              "post interrupted",
+			provisioningState: helpers.ProvisioningStateSucceeded,
+			status:            "Runningstatus",
+			run: func(ctx context.Context, stop context.Context) {
+				postJob(ctx, stop, &PostJobData{RPInput: rpInput(helpers.ProvisioningStateSucceeded), Args: []string{"invoke", "installation", "--action", "status"}, OperationId: operationId, Action: "status"})
+			},
+			interrupted:               true,
+			expectedProvisioningState: helpers.ProvisioningStateSucceeded,
+			expectedStatus:            "Runningstatus",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := azure.NewLocalStateStore("")
+			if err != nil {
+				t.Fatalf("Failed to create state store: %v", err)
+			}
+			azure.UseStateStore(store)
+			ctx := context.Background()
+			stop, cancel := context.WithCancel(ctx)
+			defer cancel()
+			helpers.UsePorterRunner(func(porterCtx context.Context, args []string, env []string) ([]byte, error) {
+				if tt.interrupted {
+					cancel()
+					<-porterCtx.Done()
+					return nil, porterCtx.Err()
+				}
+				// the job is stopped after porter finished so the result must still be recorded
+				defer cancel()
+				return []byte("succeeded"), nil
+			})
+
+			input := rpInput(tt.provisioningState)
+			if err := store.PutRPState(ctx, subscriptionId, resourceId, input.Properties); err != nil {
+				t.Fatalf("Failed to put state: %v", err)
+			}
+			if err := store.PutAsyncOp(ctx, subscriptionId, operationId, &azure.AsyncOperationState{ResourceId: resourceId, Action: "action", Status: tt.status}); err != nil {
+				t.Fatalf("Failed to put async op: %v", err)
+			}
+
+			tt.run(ctx, stop)
+
+			properties, err := store.GetRPState(ctx, subscriptionId, resourceId)
+			if err != nil {
+				t.Fatalf("Failed to get state: %v", err)
+			}
+			if properties.ProvisioningState != tt.expectedProvisioningState {
+				t.Errorf("provisioning state %s, expected %s", properties.ProvisioningState, tt.expectedProvisioningState)
+			}
+			op, err := store.GetAsyncOp(ctx, subscriptionId, operationId)
+			if err != nil {
+				t.Fatalf("Failed to get async op: %v", err)
+			}
+			if op.Status != tt.expectedStatus {
+				t.Errorf("operation status %s, expected %s", op.Status, tt.expectedStatus)
+			}
+			if op.Interrupted != tt.interrupted {
+				t.Errorf("operation interrupted %v, expected %v", op.Interrupted, tt.interrupted)
+			}
+			if tt.interrupted && (len(op.Error) > 0 || !op.EndTime.IsZero()) {
+				t.Errorf("interrupted operation has error %q and end time %v, expected it to still be running", op.Error, op.EndTime)
+			}
+		})
+	}
+}
+
+func TestQueueAfterStop(t *testing.T) {
+	const (
+		subscriptionId = "subscription"
+		resourceId     = "/subscriptions/subscription/resourceGroups/rg/providers/Microsoft.CustomProviders/resourceProviders/rp/test/stopped"
+		operationId    = "stopped"
+	)
+	store, err := azure.NewLocalStateStore("")
+	if err != nil {
+		t.Fatalf("Failed to create state store: %v", err)
+	}
+	azure.UseStateStore(store)
+	defer func() {
+		queuesClosed = false
+		PutJobs = make(chan *PutJobData, cap(PutJobs))
+		DeleteJobs = make(chan *DeleteJobData, cap(DeleteJobs))
+		PostJobs = make(chan *PostJobData, cap(PostJobs))
+	}()
+	ctx := context.Background()
+	if err := store.PutAsyncOp(ctx, subscriptionId, operationId, &azure.AsyncOperationState{ResourceId: resourceId, Action: "install", Status: "Runninginstall"}); err != nil {
+		t.Fatalf("Failed to put async op: %v", err)
+	}
+
+	Stop()
+	QueuePut(&PutJobData{
+		RPInput: &models.BundleRP{
+			RPProperties: models.RPProperties{
+				Id:             resourceId,
+				SubscriptionId: subscriptionId,
+			},
+			Properties: &models.BundleCommandProperties{
+				BundleInformation: &settings.BundleInformation{ResourceProvider: "rp", ResourceType: "test"},
+			},
+		},
+		OperationId: operationId,
+		Action:      "install",
+	})
+
+	if _, ok := FindByResource(subscriptionId, resourceId); ok {
+		t.Error("job is still registered after it was queued to a closed queue")
+	}
+	op, err := store.GetAsyncOp(ctx, subscriptionId, operationId)
+	if err != nil {
+		t.Fatalf("Failed to get async op: %v", err)
+	}
+	if !op.Interrupted || op.Status != "Runninginstall" {
+		t.Errorf("operation interrupted %v status %s, expected it to be interrupted and still running", op.Interrupted, op.Status)
+	}
+}
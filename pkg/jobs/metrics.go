@@ -0,0 +1,56 @@
+package jobs
+
+import (
+	"context"
+	"time"
+
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/azure"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// resourceCountInterval is how often the resource counts by provisioning state are refreshed
+const resourceCountInterval = time.Minute
+
+var stopResourceCountJob chan struct{}
+
+func init() {
+	metrics.QueueDepth("put", func() int { return len(PutJobs) })
+	metrics.QueueDepth("delete", func() int { return len(DeleteJobs) })
+	metrics.QueueDepth("post", func() int { return len(PostJobs) })
+}
+
+// startResourceCountJob periodically counts the resources in the state store so that the counts can be exposed as metrics without querying the table on every scrape
+func startResourceCountJob() {
+	stopResourceCountJob = make(chan struct{})
+	go func(stop chan struct{}) {
+		log.Debugf("Starting Resource Count Job interval %v", resourceCountInterval)
+		ticker := time.NewTicker(resourceCountInterval)
+		defer ticker.Stop()
+		for {
+			updateResourceCounts()
+			select {
+			case <-ticker.C:
+			case <-stop:
+				log.Debug("Stopped Resource Count Job")
+				return
+			}
+		}
+	}(stopResourceCountJob)
+}
+
+func stopResourceCount() {
+	if stopResourceCountJob != nil {
+		close(stopResourceCountJob)
+		stopResourceCountJob = nil
+	}
+}
+
+func updateResourceCounts() {
+	counts, err := azure.CountRPStateByProvisioningState(context.Background())
+	if err != nil {
+		log.Errorf("Failed to count resources: %v", err)
+		return
+	}
+	metrics.SetResourceCounts(counts)
+}
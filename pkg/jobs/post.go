@@ -1,14 +1,20 @@
 package jobs
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"sync/atomic"
+	"time"
 
 	"github.com/simongdavies/cnab-custom-resource-handler/pkg/azure"
 	"github.com/simongdavies/cnab-custom-resource-handler/pkg/common"
 	"github.com/simongdavies/cnab-custom-resource-handler/pkg/helpers"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/logging"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/metrics"
 	"github.com/simongdavies/cnab-custom-resource-handler/pkg/models"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/tracing"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -18,34 +24,63 @@ type PostJobData struct {
 	InstallationName string
 	OperationId      string
 	Action           string
+	Modifies         bool
+	// TraceContext carries the trace of the request that queued the job
+	TraceContext map[string]string
+	// LogFields are the log fields of the request that queued the job
+	LogFields log.Fields
+}
+
+// withLogFields returns ctx with the log fields of the request that queued the job and the fields that identify the job
+func (jobData *PostJobData) withLogFields(ctx context.Context) context.Context {
+	ctx = logging.WithFields(ctx, jobData.LogFields)
+	return logging.WithFields(ctx, log.Fields{
+		logging.OperationIdField:      jobData.OperationId,
+		logging.ActionField:           jobData.Action,
+		logging.InstallationNameField: jobData.InstallationName,
+	})
 }
 
 var PostJobs chan *PostJobData = make(chan *PostJobData, 20)
 
 func startPostJob() {
+	metrics.SetJobWorkers("post", MaxJobs)
 	for i := 0; i < MaxJobs; i++ {
 		go func(postJobs chan *PostJobData, i int) {
 			log.Debugf("Starting Post Job %d", i)
+			atomic.AddInt32(&workersRunning.post, 1)
+			defer atomic.AddInt32(&workersRunning.post, -1)
 			for jobData := range postJobs {
-				log.Debugf("Starting Post Resource Job for %s", jobData.RPInput.Id)
-				postJob(jobData)
-				log.Debugf("Finished Post Resource Job for %s", jobData.RPInput.Id)
+				if Draining() {
+					interruptPost(jobData.withLogFields(context.Background()), jobData)
+					continue
+				}
+				done := metrics.JobStarted("post")
+				ctx, span := tracing.StartJob(jobData.TraceContext, "POST job", jobData.RPInput.Id, jobData.OperationId)
+				ctx = jobData.withLogFields(ctx)
+				logging.FromContext(ctx).Debugf("Starting Post Resource Job for %s", jobData.RPInput.Id)
+				stop, finished := trackJob(ctx, jobData.OperationId)
+				postJob(ctx, stop, jobData)
+				finished()
+				span.End()
+				done()
+				logging.FromContext(ctx).Debugf("Finished Post Resource Job for %s", jobData.RPInput.Id)
 			}
 			log.Debugf("Stopped Post Job %d", i)
 		}(PostJobs, i)
 	}
 }
 
-func postJob(jobData *PostJobData) {
+func postJob(ctx context.Context, stop context.Context, jobData *PostJobData) {
 
-	log.Debugf("Started processing POST request for %s", jobData.RPInput.Id)
+	logging.FromContext(ctx).Debugf("Started processing POST request for %s", jobData.RPInput.Id)
 
 	//TODO Implement Timeouts
 	status := helpers.StatusFailed
 	dir, err := ioutil.TempDir("", "")
 	if err != nil {
 		responseError := fmt.Sprintf("error creating temp dir: %v", err)
-		updateStatus(jobData.RPInput, jobData.Action, status, jobData.OperationId, responseError)
+		updateStatus(ctx, jobData, status, responseError)
 		return
 	}
 	defer os.RemoveAll(dir)
@@ -53,7 +88,7 @@ func postJob(jobData *PostJobData) {
 	if len(jobData.RPInput.Properties.Parameters) > 0 {
 		paramFile, err := common.WriteParametersFile(jobData.RPInput.Properties.BundleInformation.RPBundle, jobData.RPInput.Properties.Parameters, dir)
 		if err != nil {
-			updateStatus(jobData.RPInput, jobData.Action, status, jobData.OperationId, err.Error())
+			updateStatus(ctx, jobData, status, err.Error())
 			return
 		}
 		jobData.Args = append(jobData.Args, "-p", paramFile.Name())
@@ -63,31 +98,65 @@ func postJob(jobData *PostJobData) {
 	if len(jobData.RPInput.Properties.Credentials) > 0 {
 		credFile, err := common.WriteCredentialsFile(jobData.RPInput.Properties.BundleInformation.RPBundle, jobData.RPInput.Properties.Credentials, dir)
 		if err != nil {
-			updateStatus(jobData.RPInput, jobData.Action, status, jobData.OperationId, err.Error())
+			updateStatus(ctx, jobData, status, err.Error())
 			return
 		}
 		jobData.Args = append(jobData.Args, "-c", credFile.Name())
 		defer os.Remove(credFile.Name())
 	}
-	jobData.Args = append(jobData.Args, "--reference", jobData.RPInput.Properties.BundleInformation.BundlePullOptions.Tag)
-	out, err := helpers.ExecutePorterCommand(jobData.Args)
+	jobData.Args = append(jobData.Args, jobData.RPInput.Properties.BundleInformation.BundleArgs()...)
+	out, err := helpers.ExecutePorterCommand(stop, jobData.Args)
+	if err != nil && stop.Err() != nil {
+		interruptPost(ctx, jobData)
+		return
+	}
 	if err == nil {
 		status = helpers.AsyncOperationComplete
 	}
 
-	updateStatus(jobData.RPInput, jobData.Action, status, jobData.OperationId, string(out))
+	updateStatus(ctx, jobData, status, string(out))
 
-	log.Debugf("Finished processing POST request for %s", jobData.RPInput.Id)
+	logging.FromContext(ctx).Debugf("Finished processing POST request for %s", jobData.RPInput.Id)
 
 }
 
-func updateStatus(rpInput *models.BundleRP, action string, status string, operationId string, result string) {
+func updateStatus(ctx context.Context, jobData *PostJobData, status string, result string) {
+	rpInput := jobData.RPInput
+	operationId := jobData.OperationId
+	result = redactOutput(rpInput.Properties.BundleInformation.RPBundle, rpInput.Properties, result)
+	if status == helpers.StatusFailed {
+		tracing.SetError(ctx, result)
+	}
 	// Always reset the RP status only ASyncOp will show final operation status
 
-	if err := azure.UpdateRPStatus(rpInput.SubscriptionId, rpInput.Id, ""); err != nil {
-		log.Debugf("Failed to update state:%v", err)
+	if err := azure.UpdateRPStatus(ctx, rpInput.SubscriptionId, rpInput.Id, "", "", ""); err != nil {
+		logging.FromContext(ctx).Debugf("Failed to update state:%v", err)
+	}
+
+	// An action that modifies the installation moved the resource to Updating, it needs to move to a terminal state
+	if jobData.Modifies {
+		if status == helpers.AsyncOperationComplete {
+			if err := azure.UpdateRPProvisioningState(ctx, rpInput.SubscriptionId, rpInput.Id, helpers.ProvisioningStateSucceeded); err != nil {
+				logging.FromContext(ctx).Debugf("Failed to update provisioning state:%v", err)
+			}
+		} else {
+			responseError := helpers.ErrorInternalServerError(result)
+			if err := azure.SetFailedProvisioningState(ctx, rpInput.SubscriptionId, rpInput.Id, responseError); err != nil {
+				logging.FromContext(ctx).Debugf("Failed to Merge RP State for response error %v: %v", responseError, err)
+			}
+		}
+	}
+
+	asyncOp := azure.AsyncOperationState{
+		Action:  jobData.Action,
+		Status:  status,
+		Output:  result,
+		EndTime: time.Now().UTC(),
+	}
+	if status == helpers.StatusFailed {
+		asyncOp.Error = result
 	}
-	if err := azure.PutAsyncOp(rpInput.SubscriptionId, operationId, action, status, result); err != nil {
-		log.Debugf("Failed to update Async Op for oeprationId %s: %v", operationId, err)
+	if err := azure.PutAsyncOp(ctx, rpInput.SubscriptionId, operationId, &asyncOp); err != nil {
+		logging.FromContext(ctx).Debugf("Failed to update Async Op for oeprationId %s: %v", operationId, err)
 	}
 }
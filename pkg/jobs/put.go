@@ -1,14 +1,20 @@
 package jobs
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"sync/atomic"
+	"time"
 
 	"github.com/simongdavies/cnab-custom-resource-handler/pkg/azure"
 	"github.com/simongdavies/cnab-custom-resource-handler/pkg/common"
 	"github.com/simongdavies/cnab-custom-resource-handler/pkg/helpers"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/logging"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/metrics"
 	"github.com/simongdavies/cnab-custom-resource-handler/pkg/models"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/tracing"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -16,36 +22,64 @@ type PutJobData struct {
 	RPInput          *models.BundleRP
 	Args             []string
 	InstallationName string
+	OperationId      string
+	Action           string
+	// TraceContext carries the trace of the request that queued the job
+	TraceContext map[string]string
+	// LogFields are the log fields of the request that queued the job
+	LogFields log.Fields
+}
+
+// withLogFields returns ctx with the log fields of the request that queued the job and the fields that identify the job
+func (jobData *PutJobData) withLogFields(ctx context.Context) context.Context {
+	ctx = logging.WithFields(ctx, jobData.LogFields)
+	return logging.WithFields(ctx, log.Fields{
+		logging.OperationIdField:      jobData.OperationId,
+		logging.ActionField:           jobData.Action,
+		logging.InstallationNameField: jobData.InstallationName,
+	})
 }
 
 var PutJobs chan *PutJobData = make(chan *PutJobData, 20)
 
 func startPutJob() {
+	metrics.SetJobWorkers("put", MaxJobs)
 	for i := 0; i < MaxJobs; i++ {
 		go func(putJobs chan *PutJobData, i int) {
 			log.Debugf("Starting Put Job %d", i)
+			atomic.AddInt32(&workersRunning.put, 1)
+			defer atomic.AddInt32(&workersRunning.put, -1)
 			for jobData := range putJobs {
-				log.Debugf("Starting Put Resource Job for %s", jobData.RPInput.Id)
-				putJob(jobData)
-				log.Debugf("Finished Put Resource Job for %s", jobData.RPInput.Id)
+				if Draining() {
+					interruptPut(jobData.withLogFields(context.Background()), jobData)
+					continue
+				}
+				done := metrics.JobStarted("put")
+				ctx, span := tracing.StartJob(jobData.TraceContext, "PUT job", jobData.RPInput.Id, jobData.OperationId)
+				ctx = jobData.withLogFields(ctx)
+				logging.FromContext(ctx).Debugf("Starting Put Resource Job for %s", jobData.RPInput.Id)
+				stop, finished := trackJob(ctx, jobData.OperationId)
+				putJob(ctx, stop, jobData)
+				finished()
+				span.End()
+				done()
+				logging.FromContext(ctx).Debugf("Finished Put Resource Job for %s", jobData.RPInput.Id)
 			}
 			log.Debugf("Stopped Put Job %d", i)
 		}(PutJobs, i)
 	}
 }
 
-func putJob(jobData *PutJobData) {
+func putJob(ctx context.Context, stop context.Context, jobData *PutJobData) {
 
-	log.Debugf("Started processing PUT request for %s", jobData.RPInput.Id)
+	logging.FromContext(ctx).Debugf("Started processing PUT request for %s", jobData.RPInput.Id)
 
 	//TODO Implement Timeouts
 	jobData.RPInput.Properties.ProvisioningState = helpers.ProvisioningStateFailed
 	dir, err := ioutil.TempDir("", "")
 	if err != nil {
 		responseError := helpers.ErrorInternalServerErrorFromError(fmt.Errorf("error creating temp dir: %v", err))
-		if err := azure.SetFailedProvisioningState(jobData.RPInput.SubscriptionId, jobData.RPInput.Id, responseError); err != nil {
-			log.Debugf("Failed to Merge RP State for response error %v: %v", responseError, err)
-		}
+		setPutFailed(ctx, jobData, responseError)
 		return
 	}
 	defer os.RemoveAll(dir)
@@ -54,9 +88,7 @@ func putJob(jobData *PutJobData) {
 		paramFile, err := common.WriteParametersFile(jobData.RPInput.Properties.BundleInformation.RPBundle, jobData.RPInput.Properties.Parameters, dir)
 		if err != nil {
 			responseError := helpers.ErrorInternalServerErrorFromError(err)
-			if err := azure.SetFailedProvisioningState(jobData.RPInput.SubscriptionId, jobData.RPInput.Id, responseError); err != nil {
-				log.Debugf("Failed to Merge RP State for response error %v: %v", responseError, err)
-			}
+			setPutFailed(ctx, jobData, responseError)
 			return
 		}
 		jobData.Args = append(jobData.Args, "-p", paramFile.Name())
@@ -67,32 +99,58 @@ func putJob(jobData *PutJobData) {
 		credFile, err := common.WriteCredentialsFile(jobData.RPInput.Properties.BundleInformation.RPBundle, jobData.RPInput.Properties.Credentials, dir)
 		if err != nil {
 			responseError := helpers.ErrorInternalServerErrorFromError(err)
-			if err := azure.SetFailedProvisioningState(jobData.RPInput.SubscriptionId, jobData.RPInput.Id, responseError); err != nil {
-				log.Debugf("Failed to Merge RP State for response error %v: %v", responseError, err)
-			}
+			setPutFailed(ctx, jobData, responseError)
 			return
 		}
 		jobData.Args = append(jobData.Args, "-c", credFile.Name())
 		defer os.Remove(credFile.Name())
 	}
 
-	if out, err := helpers.ExecutePorterCommand(jobData.Args); err != nil {
-		log.Debugf("Execut Porter Command failed: %v", err)
-		responseError := helpers.ErrorInternalServerError(string(out))
-		if err := azure.SetFailedProvisioningState(jobData.RPInput.SubscriptionId, jobData.RPInput.Id, responseError); err != nil {
-			log.Debugf("Failed to Merge RP State for response error %v: %v", responseError, err)
+	if out, err := helpers.ExecutePorterCommand(stop, jobData.Args); err != nil {
+		if stop.Err() != nil {
+			interruptPut(ctx, jobData)
+			return
 		}
+		logging.FromContext(ctx).Debugf("Execut Porter Command failed: %v", err)
+		responseError := helpers.ErrorInternalServerError(string(out))
+		setPutFailed(ctx, jobData, responseError)
 		return
 	}
-	log.Debugf("Porter Command for PUT request %s Succeeded", jobData.RPInput.Id)
+	logging.FromContext(ctx).Debugf("Porter Command for PUT request %s Succeeded", jobData.RPInput.Id)
 	jobData.RPInput.Properties.ProvisioningState = helpers.ProvisioningStateSucceeded
-	if err := azure.PutRPState(jobData.RPInput.SubscriptionId, jobData.RPInput.Id, jobData.RPInput.Properties); err != nil {
+	if err := azure.PutRPState(ctx, jobData.RPInput.SubscriptionId, jobData.RPInput.Id, jobData.RPInput.Properties); err != nil {
 		jobData.RPInput.Properties.ProvisioningState = helpers.ProvisioningStateFailed
 		responseError := helpers.ErrorInternalServerErrorFromError(fmt.Errorf("Failed to save RP state from put: %v", err))
-		if err := azure.SetFailedProvisioningState(jobData.RPInput.SubscriptionId, jobData.RPInput.Id, responseError); err != nil {
-			log.Debugf("Failed to Merge RP State for response error %v: %v", responseError, err)
-		}
+		setPutFailed(ctx, jobData, responseError)
+		return
 	}
 
-	log.Debugf("Finished processing PUT request for %s", jobData.RPInput.Id)
+	asyncOp := azure.AsyncOperationState{
+		Action:  jobData.Action,
+		Status:  helpers.AsyncOperationComplete,
+		EndTime: time.Now().UTC(),
+	}
+	if err := azure.PutAsyncOp(ctx, jobData.RPInput.SubscriptionId, jobData.OperationId, &asyncOp); err != nil {
+		logging.FromContext(ctx).Debugf("Failed to update Async Op for operationId %s: %v", jobData.OperationId, err)
+	}
+
+	logging.FromContext(ctx).Debugf("Finished processing PUT request for %s", jobData.RPInput.Id)
+}
+
+// setPutFailed records the failure in both the RP state and the async operation for the PUT
+func setPutFailed(ctx context.Context, jobData *PutJobData, responseError *helpers.ErrorResponse) {
+	responseError.Message = redactOutput(jobData.RPInput.Properties.BundleInformation.RPBundle, jobData.RPInput.Properties, responseError.Message)
+	tracing.SetError(ctx, responseError.Message)
+	if err := azure.SetFailedProvisioningState(ctx, jobData.RPInput.SubscriptionId, jobData.RPInput.Id, responseError); err != nil {
+		logging.FromContext(ctx).Debugf("Failed to Merge RP State for response error %v: %v", responseError, err)
+	}
+	asyncOp := azure.AsyncOperationState{
+		Action:  jobData.Action,
+		Status:  helpers.AsyncOperationFailed,
+		Error:   responseError.Message,
+		EndTime: time.Now().UTC(),
+	}
+	if err := azure.PutAsyncOp(ctx, jobData.RPInput.SubscriptionId, jobData.OperationId, &asyncOp); err != nil {
+		logging.FromContext(ctx).Debugf("Failed to update Async Op for operationId %s: %v", jobData.OperationId, err)
+	}
 }
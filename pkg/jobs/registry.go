@@ -0,0 +1,187 @@
+package jobs
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/settings"
+)
+
+const (
+	JobStateQueued  = "queued"
+	JobStateRunning = "running"
+)
+
+// JobInfo describes a job that is queued or running
+type JobInfo struct {
+	Queue            string     `json:"queue"`
+	OperationId      string     `json:"operationId"`
+	SubscriptionId   string     `json:"subscriptionId"`
+	ResourceId       string     `json:"resourceId"`
+	ResourceType     string     `json:"resourceType"`
+	Action           string     `json:"action"`
+	InstallationName string     `json:"installationName"`
+	State            string     `json:"state"`
+	QueuedAt         time.Time  `json:"queuedAt"`
+	StartedAt        *time.Time `json:"startedAt,omitempty"`
+	Age              string     `json:"age"`
+}
+
+// trackedJob is a job in the registry, stop cancels the context a running job runs porter with
+type trackedJob struct {
+	info JobInfo
+	ctx  context.Context
+	stop context.CancelFunc
+}
+
+// registry holds a trackedJob for each queued or running job keyed by operation id, entries are replaced rather than modified so they can be read without locking
+var registry sync.Map
+var jobsRunning int32
+
+// queuesLock is held to send to the queues and to close them, once the queues are closed by Stop jobs queued by requests that were still in progress are recorded as interrupted
+var queuesLock sync.RWMutex
+var queuesClosed bool
+
+// QueuePut adds a PUT job to the queue
+func QueuePut(jobData *PutJobData) {
+	register("put", jobData.OperationId, jobData.RPInput.SubscriptionId, jobData.RPInput.Id, bundleResourceType(jobData.RPInput.Properties.BundleInformation), jobData.Action, jobData.InstallationName)
+	queuesLock.RLock()
+	defer queuesLock.RUnlock()
+	if queuesClosed {
+		interruptPut(jobData.withLogFields(context.Background()), jobData)
+		return
+	}
+	PutJobs <- jobData
+}
+
+// QueueDelete adds a DELETE job to the queue
+func QueueDelete(jobData *DeleteJobData) {
+	register("delete", jobData.OperationId, jobData.RPInput.SubscriptionId, jobData.RPInput.Id, bundleResourceType(jobData.BundleInfo), "delete", jobData.InstallationName)
+	queuesLock.RLock()
+	defer queuesLock.RUnlock()
+	if queuesClosed {
+		interruptDelete(jobData.withLogFields(context.Background()), jobData)
+		return
+	}
+	DeleteJobs <- jobData
+}
+
+// QueuePost adds a POST job to the queue
+func QueuePost(jobData *PostJobData) {
+	register("post", jobData.OperationId, jobData.RPInput.SubscriptionId, jobData.RPInput.Id, bundleResourceType(jobData.RPInput.Properties.BundleInformation), jobData.Action, jobData.InstallationName)
+	queuesLock.RLock()
+	defer queuesLock.RUnlock()
+	if queuesClosed {
+		interruptPost(jobData.withLogFields(context.Background()), jobData)
+		return
+	}
+	PostJobs <- jobData
+}
+
+// List returns the queued and running jobs for each queue, oldest first
+func List() map[string][]JobInfo {
+	now := time.Now().UTC()
+	result := map[string][]JobInfo{
+		"put":    {},
+		"delete": {},
+		"post":   {},
+	}
+	registry.Range(func(key interface{}, value interface{}) bool {
+		info := value.(*trackedJob).info
+		info.Age = now.Sub(info.QueuedAt).Round(time.Second).String()
+		result[info.Queue] = append(result[info.Queue], info)
+		return true
+	})
+	for _, infos := range result {
+		sort.Slice(infos, func(i, j int) bool {
+			return infos[i].QueuedAt.Before(infos[j].QueuedAt)
+		})
+	}
+	return result
+}
+
+// FindByResource returns the queued or running job for a resource, resource ids are compared case insensitively
+func FindByResource(subscriptionId string, resourceId string) (*JobInfo, bool) {
+	var found *JobInfo
+	registry.Range(func(key interface{}, value interface{}) bool {
+		info := value.(*trackedJob).info
+		if strings.EqualFold(info.SubscriptionId, subscriptionId) && strings.EqualFold(info.ResourceId, resourceId) {
+			found = &info
+			return false
+		}
+		return true
+	})
+	return found, found != nil
+}
+
+// HasJobs returns true if there are queued or running jobs for the resource type in the form provider/type
+func HasJobs(rpType string) bool {
+	found := false
+	registry.Range(func(key interface{}, value interface{}) bool {
+		if strings.EqualFold(value.(*trackedJob).info.ResourceType, rpType) {
+			found = true
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+// bundleResourceType returns the provider/type handled by the bundle of a job
+func bundleResourceType(bundleInfo *settings.BundleInformation) string {
+	if bundleInfo == nil {
+		return ""
+	}
+	return settings.GetRPName(bundleInfo.ResourceProvider, bundleInfo.ResourceType)
+}
+
+func register(queue string, operationId string, subscriptionId string, resourceId string, resourceType string, action string, installationName string) {
+	registry.Store(operationId, &trackedJob{
+		info: JobInfo{
+			Queue:            queue,
+			OperationId:      operationId,
+			SubscriptionId:   subscriptionId,
+			ResourceId:       resourceId,
+			ResourceType:     resourceType,
+			Action:           action,
+			InstallationName: installationName,
+			State:            JobStateQueued,
+			QueuedAt:         time.Now().UTC(),
+		},
+	})
+}
+
+// trackJob records a job as running until the returned func is called, the returned context is cancelled if the job is interrupted by a shutdown
+func trackJob(ctx context.Context, operationId string) (context.Context, func()) {
+	atomic.AddInt32(&jobsRunning, 1)
+	stop, cancel := context.WithCancel(ctx)
+	job := trackedJob{
+		ctx:  ctx,
+		stop: cancel,
+	}
+	if value, ok := registry.Load(operationId); ok {
+		job.info = value.(*trackedJob).info
+	}
+	started := time.Now().UTC()
+	if job.info.QueuedAt.IsZero() {
+		job.info.QueuedAt = started
+	}
+	job.info.OperationId = operationId
+	job.info.State = JobStateRunning
+	job.info.StartedAt = &started
+	registry.Store(operationId, &job)
+	return stop, func() {
+		cancel()
+		registry.Delete(operationId)
+		atomic.AddInt32(&jobsRunning, -1)
+	}
+}
+
+// untrackJob removes a job that will not be run from the registry
+func untrackJob(operationId string) {
+	registry.Delete(operationId)
+}
@@ -0,0 +1,146 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	az "github.com/Azure/go-autorest/autorest/azure"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/azure"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/helpers"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/logging"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/models"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/settings"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrNotRequeueable is returned by Requeue for a resource that is not being created, updated or deleted
+var ErrNotRequeueable = errors.New("only resources that are being created, updated or deleted can be requeued")
+
+// Requeue queues the PUT or DELETE job again for a resource that is being created, updated or deleted but has no job such as a job that was interrupted by a shutdown, the job keeps the operation id so that ARM continues to poll the same operation.
+// Actions cannot be requeued as the action parameters are not stored, they can be failed instead
+func Requeue(ctx context.Context, rpInput *models.BundleRP, installationName string, bundleInfo *settings.BundleInformation) error {
+	properties := rpInput.Properties
+	switch properties.ProvisioningState {
+	case helpers.ProvisioningStateCreated, helpers.ProvisioningStateAccepted:
+		state, err := azure.GetAsyncOp(ctx, rpInput.SubscriptionId, properties.OperationId)
+		if err != nil {
+			return fmt.Errorf("Failed to get async op %s :%v", properties.OperationId, err)
+		}
+		QueuePut(&PutJobData{
+			RPInput:          rpInput,
+			Args:             append([]string{state.Action, installationName}, bundleInfo.BundleArgs()...),
+			InstallationName: installationName,
+			OperationId:      properties.OperationId,
+			Action:           state.Action,
+			LogFields:        logging.Fields(ctx),
+		})
+	case helpers.ProvisioningStateDeleting:
+		QueueDelete(&DeleteJobData{
+			RPInput:          rpInput,
+			InstallationName: installationName,
+			OperationId:      properties.OperationId,
+			BundleInfo:       bundleInfo,
+			LogFields:        logging.Fields(ctx),
+		})
+	default:
+		return fmt.Errorf("Resource Provisioning State is: %s, %w", properties.ProvisioningState, ErrNotRequeueable)
+	}
+	logging.FromContext(ctx).Infof("Requeued operation %s for resource %s", properties.OperationId, rpInput.Id)
+	return nil
+}
+
+// requeueInterrupted queues the PUT and DELETE jobs again for the operations that were interrupted by the last shutdown, interrupted actions are left for an operator to fail with the admin API
+func requeueInterrupted() {
+	operations, err := azure.ListInterruptedAsyncOps(context.Background())
+	if err != nil {
+		log.Errorf("Failed to list interrupted operations: %v", err)
+		return
+	}
+	for _, op := range operations {
+		ctx := logging.WithFields(context.Background(), log.Fields{
+			logging.SubscriptionIdField: op.SubscriptionId,
+			logging.ResourceIdField:     op.ResourceId,
+			logging.OperationIdField:    op.OperationId,
+		})
+		if err := requeueOperation(ctx, op); err != nil {
+			logging.FromContext(ctx).Warnf("Failed to requeue interrupted operation %s for %s: %v", op.OperationId, op.ResourceId, err)
+		}
+	}
+}
+
+// requeueOperation requeues the job for an interrupted operation if it is still the operation that is creating, updating or deleting its resource
+func requeueOperation(ctx context.Context, op *azure.AsyncOperationState) error {
+	if Draining() {
+		return errors.New("The handler is shutting down")
+	}
+	if _, ok := FindByResource(op.SubscriptionId, op.ResourceId); ok {
+		return nil
+	}
+	resourceId, action, err := findResourceId(ctx, op)
+	if err != nil {
+		return err
+	}
+	// the operation no longer has a resource to resume, the flag is cleared so that it is not looked at again
+	if len(resourceId) == 0 {
+		return clearInterrupted(ctx, op)
+	}
+	if action {
+		return errors.New("Actions cannot be requeued as the action parameters are not stored, the action can be failed with the admin API")
+	}
+	properties, err := azure.GetRPState(ctx, op.SubscriptionId, resourceId)
+	if err != nil {
+		return fmt.Errorf("Failed to get RPState: %v", err)
+	}
+	if azure.IsTerminalProvisioningState(properties.ProvisioningState) {
+		return clearInterrupted(ctx, op)
+	}
+	bundleInfo, err := azure.GetBundleInformation(resourceId)
+	if err != nil {
+		return err
+	}
+	parsed, err := az.ParseResourceID(resourceId)
+	if err != nil {
+		return fmt.Errorf("Failed to parse resource id %s: %v", resourceId, err)
+	}
+	properties.BundleInformation = bundleInfo
+	rpInput := &models.BundleRP{
+		RPProperties: models.RPProperties{
+			Id:             resourceId,
+			Name:           parsed.ResourceName,
+			Type:           settings.GetRPName(bundleInfo.ResourceProvider, bundleInfo.ResourceType),
+			SubscriptionId: op.SubscriptionId,
+			RequestPath:    resourceId,
+		},
+		Properties: properties,
+	}
+	// the flag is cleared before the job is queued so that the operation is only requeued once, it is set again if the job is interrupted
+	if err := clearInterrupted(ctx, op); err != nil {
+		return err
+	}
+	return Requeue(ctx, rpInput, helpers.GetInstallationName(bundleInfo.TrimmedBundleTag, resourceId), bundleInfo)
+}
+
+// findResourceId returns the id of the resource whose current operation or running action is op in the case it is stored in the state table as the async operation only records the id in lower case, action is true if op is an action. An empty id is returned if there is no such resource
+func findResourceId(ctx context.Context, op *azure.AsyncOperationState) (resourceId string, action bool, err error) {
+	entities, err := azure.QueryRPState(ctx, azure.RPStateFilter{SubscriptionId: op.SubscriptionId})
+	if err != nil {
+		return "", false, fmt.Errorf("Failed to query RPState: %v", err)
+	}
+	for _, entity := range entities {
+		if operationId, _ := entity.Properties["OperationId"].(string); operationId == op.OperationId {
+			return azure.GetResourceIdFromRowKey(entity.RowKey), false, nil
+		}
+		if operationId, _ := entity.Properties["ActionOperationId"].(string); operationId == op.OperationId {
+			return azure.GetResourceIdFromRowKey(entity.RowKey), true, nil
+		}
+	}
+	return "", false, nil
+}
+
+func clearInterrupted(ctx context.Context, op *azure.AsyncOperationState) error {
+	if err := azure.PutAsyncOp(ctx, op.SubscriptionId, op.OperationId, &azure.AsyncOperationState{}); err != nil {
+		return fmt.Errorf("Failed to clear the interrupted flag of operation %s: %v", op.OperationId, err)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package jobs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/azure"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/helpers"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/models"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/settings"
+)
+
+func TestRequeueInterrupted(t *testing.T) {
+	const (
+		subscriptionId = "subscription"
+		resourceType   = "/subscriptions/subscription/resourceGroups/RG/providers/Microsoft.CustomProviders/resourceProviders/rp/test/"
+	)
+	store, err := azure.NewLocalStateStore("")
+	if err != nil {
+		t.Fatalf("Failed to create state store: %v", err)
+	}
+	azure.UseStateStore(store)
+	bundleInfo := &settings.BundleInformation{
+		ResourceProvider: "Microsoft.CustomProviders",
+		ResourceType:     "rp",
+		BundleFile:       "bundle.json",
+		TrimmedBundleTag: "bundle",
+	}
+	providers := settings.RPToProvider
+	settings.RPToProvider = map[string]*settings.BundleInformation{
+		settings.GetRPName(bundleInfo.ResourceProvider, bundleInfo.ResourceType): bundleInfo,
+	}
+	defer func() {
+		settings.RPToProvider = providers
+	}()
+
+	tests := []struct {
+		name              string
+		provisioningState string
+		// stored is false if the resource has no state
+		stored bool
+		// action is true if the operation is an action on the resource
+		action bool
+		status string
+		// queue is the queue the job should be requeued to, no job should be queued if it is empty
+		queue string
+		// interrupted is true if the operation should still be marked as interrupted
+		interrupted bool
+	}{
+		{name: "put", provisioningState: helpers.ProvisioningStateAccepted, stored: true, status: "Runninginstall", queue: "put"},
+		{name: "delete", provisioningState: helpers.ProvisioningStateDeleting, stored: true, status: helpers.ProvisioningStateDeleting, queue: "delete"},
+		{name: "action", provisioningState: helpers.ProvisioningStateSucceeded, stored: true, action: true, status: "Runningstatus", interrupted: true},
+		{name: "finished", provisioningState: helpers.ProvisioningStateSucceeded, stored: true, status: "Runninginstall"},
+		{name: "resource deleted", status: helpers.ProvisioningStateDeleting},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		resourceId := resourceType + tt.name
+		operationId := tt.name + "-operation"
+		if tt.stored {
+			properties := &models.BundleCommandProperties{
+				ProvisioningState: tt.provisioningState,
+				OperationId:       operationId,
+				BundleInformation: bundleInfo,
+			}
+			if tt.action {
+				properties.OperationId = "install-operation"
+			}
+			if err := store.PutRPState(ctx, subscriptionId, resourceId, properties); err != nil {
+				t.Fatalf("Failed to put state: %v", err)
+			}
+			if tt.action {
+				if err := store.UpdateRPStatus(ctx, subscriptionId, resourceId, tt.status, operationId, ""); err != nil {
+					t.Fatalf("Failed to update status: %v", err)
+				}
+			}
+		}
+		if err := store.PutAsyncOp(ctx, subscriptionId, operationId, &azure.AsyncOperationState{ResourceId: resourceId, Action: "install", Status: tt.status, Interrupted: true}); err != nil {
+			t.Fatalf("Failed to put async op: %v", err)
+		}
+	}
+
+	requeueInterrupted()
+
+	queued := make(map[string]string)
+	for len(PutJobs) > 0 {
+		jobData := <-PutJobs
+		untrackJob(jobData.OperationId)
+		queued[jobData.OperationId] = "put"
+		if jobData.RPInput.Id != resourceType+"put" || jobData.Action != "install" {
+			t.Errorf("PUT job for %s action %s, expected %s action install", jobData.RPInput.Id, jobData.Action, resourceType+"put")
+		}
+	}
+	for len(DeleteJobs) > 0 {
+		jobData := <-DeleteJobs
+		untrackJob(jobData.OperationId)
+		queued[jobData.OperationId] = "delete"
+		if jobData.RPInput.Id != resourceType+"delete" {
+			t.Errorf("DELETE job for %s, expected %s", jobData.RPInput.Id, resourceType+"delete")
+		}
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			operationId := tt.name + "-operation"
+			if queued[operationId] != tt.queue {
+				t.Errorf("queued to %q, expected %q", queued[operationId], tt.queue)
+			}
+			op, err := store.GetAsyncOp(ctx, subscriptionId, operationId)
+			if err != nil {
+				t.Fatalf("Failed to get async op: %v", err)
+			}
+			if op.Interrupted != tt.interrupted {
+				t.Errorf("operation interrupted %v, expected %v", op.Interrupted, tt.interrupted)
+			}
+			if op.Status != tt.status {
+				t.Errorf("operation status %s, expected %s", op.Status, tt.status)
+			}
+		})
+	}
+}
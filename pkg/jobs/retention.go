@@ -0,0 +1,111 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/azure"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/settings"
+	log "github.com/sirupsen/logrus"
+)
+
+var stopRetentionJob chan struct{}
+
+// startRetentionJob starts the background sweeper that purges async operation records, operations are not removed when the resource is deleted as ARM polls the delete operation after the resource has gone so they are left for the sweeper
+func startRetentionJob() {
+	if settings.AsyncOpRetentionDays <= 0 && settings.AsyncOpRetentionCount <= 0 {
+		log.Debug("No retention policy set for async operations")
+		return
+	}
+	stopRetentionJob = make(chan struct{})
+	go func(stop chan struct{}) {
+		log.Debugf("Starting Retention Job interval %v", settings.AsyncOpSweepInterval)
+		ticker := time.NewTicker(settings.AsyncOpSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := PurgeAsyncOps(context.Background(), settings.AsyncOpRetentionDays, settings.AsyncOpRetentionCount); err != nil {
+					log.Errorf("Failed to purge async operations: %v", err)
+				}
+			case <-stop:
+				log.Debug("Stopped Retention Job")
+				return
+			}
+		}
+	}(stopRetentionJob)
+}
+
+func stopRetention() {
+	if stopRetentionJob != nil {
+		close(stopRetentionJob)
+		stopRetentionJob = nil
+	}
+}
+
+// PurgeAsyncOps deletes completed async operations that are older than retentionDays or are not in the latest retentionCount operations for their resource, a value of zero disables that rule. It returns the number of records deleted
+func PurgeAsyncOps(ctx context.Context, retentionDays int, retentionCount int) (int, error) {
+	if retentionDays <= 0 && retentionCount <= 0 {
+		return 0, fmt.Errorf("No retention policy set for async operations")
+	}
+
+	operations, err := azure.ListTerminalAsyncOps(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to list async operations: %v", err)
+	}
+
+	purged := 0
+	failed := 0
+	var lastErr error
+	for _, op := range purgeableAsyncOps(operations, time.Now().UTC(), retentionDays, retentionCount) {
+		if err := azure.DeleteAsyncOp(ctx, op.SubscriptionId, op.OperationId); err != nil {
+			log.Debugf("Failed to delete async op %s for resource %s: %v", op.OperationId, op.ResourceId, err)
+			failed++
+			lastErr = err
+			continue
+		}
+		purged++
+	}
+
+	log.Infof("Purged %d async operation records", purged)
+	if failed > 0 {
+		return purged, fmt.Errorf("Failed to delete %d async operation records: %v", failed, lastErr)
+	}
+	return purged, nil
+}
+
+// purgeableAsyncOps returns the operations that are older than retentionDays or are not in the latest retentionCount operations for their resource.
+// Operations recorded before the resource id was stored cannot be grouped by resource so only the age rule applies to them
+func purgeableAsyncOps(operations []*azure.AsyncOperationState, now time.Time, retentionDays int, retentionCount int) []*azure.AsyncOperationState {
+	cutoff := now.AddDate(0, 0, -retentionDays)
+	var purgeable []*azure.AsyncOperationState
+	resourceOperations := make(map[string][]*azure.AsyncOperationState)
+	for _, op := range operations {
+		if len(op.ResourceId) == 0 {
+			if retentionDays > 0 && op.LastUpdated.Before(cutoff) {
+				purgeable = append(purgeable, op)
+			}
+			continue
+		}
+		key := fmt.Sprintf("%s%s", op.SubscriptionId, strings.ToLower(op.ResourceId))
+		resourceOperations[key] = append(resourceOperations[key], op)
+	}
+
+	for _, ops := range resourceOperations {
+		// newest first so that the operations to keep are at the start
+		sort.Slice(ops, func(i, j int) bool {
+			return ops[i].LastUpdated.After(ops[j].LastUpdated)
+		})
+		for i, op := range ops {
+			expired := retentionDays > 0 && op.LastUpdated.Before(cutoff)
+			excess := retentionCount > 0 && i >= retentionCount
+			if expired || excess {
+				purgeable = append(purgeable, op)
+			}
+		}
+	}
+	return purgeable
+}
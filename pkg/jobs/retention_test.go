@@ -0,0 +1,78 @@
+package jobs
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/azure"
+)
+
+func TestPurgeableAsyncOps(t *testing.T) {
+	now := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	op := func(id string, resourceId string, age time.Duration) *azure.AsyncOperationState {
+		return &azure.AsyncOperationState{
+			SubscriptionId: "sub",
+			OperationId:    id,
+			ResourceId:     resourceId,
+			LastUpdated:    now.Add(-age),
+		}
+	}
+	day := 24 * time.Hour
+	operations := []*azure.AsyncOperationState{
+		op("a1", "/resources/a", 1*time.Hour),
+		op("a2", "/resources/a", 2*day),
+		op("a3", "/resources/A", 10*day),
+		op("b1", "/resources/b", 10*day),
+		// operations recorded before the resource id was stored
+		op("l1", "", 1*time.Hour),
+		op("l2", "", 2*day),
+		op("l3", "", 10*day),
+	}
+
+	tests := []struct {
+		name           string
+		retentionDays  int
+		retentionCount int
+		purged         []string
+	}{
+		{
+			name:          "age",
+			retentionDays: 7,
+			purged:        []string{"a3", "b1", "l3"},
+		},
+		{
+			name:           "count keeps the latest operations for each resource",
+			retentionCount: 1,
+			purged:         []string{"a2", "a3"},
+		},
+		{
+			name:           "count does not apply to operations without a resource id",
+			retentionCount: 2,
+			purged:         []string{"a3"},
+		},
+		{
+			name:           "age and count",
+			retentionDays:  1,
+			retentionCount: 2,
+			purged:         []string{"a2", "a3", "b1", "l2", "l3"},
+		},
+		{
+			name: "no policy",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var purged []string
+			for _, op := range purgeableAsyncOps(operations, now, tt.retentionDays, tt.retentionCount) {
+				purged = append(purged, op.OperationId)
+			}
+			sort.Strings(purged)
+			if !reflect.DeepEqual(purged, tt.purged) {
+				t.Errorf("purged %v, expected %v", purged, tt.purged)
+			}
+		})
+	}
+}
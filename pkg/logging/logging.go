@@ -0,0 +1,80 @@
+// Package logging configures the log format and carries log fields in a context so that every line logged for an ARM operation can be found
+package logging
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Log formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Field names added to log lines
+const (
+	CorrelationIdField    = "correlationId"
+	RequestIdField        = "requestId"
+	SubscriptionIdField   = "subscriptionId"
+	ResourceIdField       = "resourceId"
+	OperationIdField      = "operationId"
+	ActionField           = "action"
+	InstallationNameField = "installationName"
+	traceIdField          = "traceId"
+)
+
+type contextKey string
+
+const fieldsContextKey contextKey = "LogFields"
+
+// Configure sets the log format, format is either text or json
+func Configure(format string) error {
+	switch strings.ToLower(format) {
+	case "", FormatText:
+		logFormatter := new(log.TextFormatter)
+		logFormatter.TimestampFormat = "2006-01-02 15:04:05"
+		logFormatter.FullTimestamp = true
+		log.SetFormatter(logFormatter)
+	case FormatJSON:
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("Unknown log format %s, expected %s or %s", format, FormatText, FormatJSON)
+	}
+	return nil
+}
+
+// WithFields returns a context containing fields in addition to any fields already in ctx
+func WithFields(ctx context.Context, fields log.Fields) context.Context {
+	merged := log.Fields{}
+	if existing, ok := ctx.Value(fieldsContextKey).(log.Fields); ok {
+		for k, v := range existing {
+			merged[k] = v
+		}
+	}
+	for k, v := range fields {
+		if v != nil && v != "" {
+			merged[k] = v
+		}
+	}
+	return context.WithValue(ctx, fieldsContextKey, merged)
+}
+
+// Fields returns the fields in ctx
+func Fields(ctx context.Context) log.Fields {
+	fields, _ := ctx.Value(fieldsContextKey).(log.Fields)
+	return fields
+}
+
+// FromContext returns a logger that adds the fields in ctx and the trace id to every line
+func FromContext(ctx context.Context) *log.Entry {
+	entry := log.WithFields(Fields(ctx))
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.HasTraceID() {
+		entry = entry.WithField(traceIdField, spanContext.TraceID().String())
+	}
+	return entry
+}
@@ -0,0 +1,164 @@
+// Package metrics contains the Prometheus metrics exposed on /metrics
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	az "github.com/Azure/go-autorest/autorest/azure"
+	"github.com/go-chi/chi/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "cnab_custom_rp"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests by method, resource type and status code.",
+	}, []string{"method", "resource_type", "status"})
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of HTTP requests by method, resource type and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "resource_type", "status"})
+
+	jobWorkers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "job_workers",
+		Help:      "Number of workers for each job queue.",
+	}, []string{"queue"})
+	jobWorkersBusy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "job_workers_busy",
+		Help:      "Number of workers processing a job for each job queue.",
+	}, []string{"queue"})
+
+	porterExecutions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "porter_executions_total",
+		Help:      "Number of porter executions by action, bundle and exit code.",
+	}, []string{"action", "bundle", "exit_code"})
+	porterDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "porter_execution_duration_seconds",
+		Help:      "Duration of porter executions by action and bundle.",
+		Buckets:   []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200, 1800, 3600},
+	}, []string{"action", "bundle"})
+
+	stateStoreDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "state_store_request_duration_seconds",
+		Help:      "Latency of state store requests by table and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"table", "method"})
+	stateStoreErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "state_store_errors_total",
+		Help:      "Number of failed state store requests by table and method.",
+	}, []string{"table", "method"})
+
+	resourcesByProvisioningState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "resources",
+		Help:      "Number of resources by resource type and provisioning state.",
+	}, []string{"resource_type", "provisioning_state"})
+)
+
+// Handler returns the handler for the /metrics endpoint
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Middleware records the count and latency of requests
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		labels := prometheus.Labels{
+			"method":        r.Method,
+			"resource_type": resourceType(r.URL.Path),
+			"status":        strconv.Itoa(status),
+		}
+		httpRequests.With(labels).Inc()
+		httpRequestDuration.With(labels).Observe(time.Since(start).Seconds())
+	})
+}
+
+// resourceType returns the provider and resource type in the request path, custom provider requests include the custom resource type
+func resourceType(requestPath string) string {
+	resource, err := az.ParseResourceID(requestPath)
+	if err != nil {
+		return "unknown"
+	}
+	parts := strings.Split(requestPath, "/")
+	if strings.EqualFold(resource.Provider, "Microsoft.CustomProviders") && len(parts) > 8 {
+		return strings.ToLower(resource.Provider + "/" + parts[8])
+	}
+	return strings.ToLower(resource.Provider + "/" + resource.ResourceType)
+}
+
+// QueueDepth exposes the number of jobs waiting in a queue, depth is called each time the metrics are collected
+func QueueDepth(queue string, depth func() int) {
+	gauge := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "job_queue_depth",
+		Help:        "Number of jobs waiting in each job queue.",
+		ConstLabels: prometheus.Labels{"queue": queue},
+	}, func() float64 {
+		return float64(depth())
+	})
+	if err := prometheus.Register(gauge); err != nil {
+		if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+			panic(err)
+		}
+	}
+}
+
+// SetJobWorkers records the number of workers for a queue
+func SetJobWorkers(queue string, workers int) {
+	jobWorkers.WithLabelValues(queue).Set(float64(workers))
+}
+
+// JobStarted records that a worker has started processing a job, the returned function should be called when it has finished
+func JobStarted(queue string) func() {
+	jobWorkersBusy.WithLabelValues(queue).Inc()
+	return func() {
+		jobWorkersBusy.WithLabelValues(queue).Dec()
+	}
+}
+
+// ObservePorter records a porter execution
+func ObservePorter(action string, bundle string, exitCode int, duration time.Duration) {
+	porterExecutions.WithLabelValues(action, bundle, strconv.Itoa(exitCode)).Inc()
+	porterDuration.WithLabelValues(action, bundle).Observe(duration.Seconds())
+}
+
+// ObserveStateStore records a state store request, failed should be true if the request returned an error
+func ObserveStateStore(table string, method string, duration time.Duration, failed bool) {
+	stateStoreDuration.WithLabelValues(table, method).Observe(duration.Seconds())
+	if failed {
+		stateStoreErrors.WithLabelValues(table, method).Inc()
+	}
+}
+
+// SetResourceCounts replaces the resource counts, counts is keyed by resource type then provisioning state
+func SetResourceCounts(counts map[string]map[string]int) {
+	resourcesByProvisioningState.Reset()
+	for resourceType, states := range counts {
+		for state, count := range states {
+			resourcesByProvisioningState.WithLabelValues(resourceType, state).Set(float64(count))
+		}
+	}
+}
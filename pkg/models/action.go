@@ -0,0 +1,26 @@
+package models
+
+// Action describes a custom action that can be invoked on a resource
+type Action struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Stateless actions can be invoked when the resource exists but its installation failed
+	Stateless bool `json:"stateless"`
+	// Modifies is true if the action changes the installation, the provisioning state is Updating while it runs
+	Modifies   bool               `json:"modifies"`
+	Parameters []*ActionParameter `json:"parameters"`
+}
+
+// ActionParameter describes a parameter that applies to a custom action
+type ActionParameter struct {
+	Name        string      `json:"name"`
+	Type        interface{} `json:"type,omitempty"`
+	Description string      `json:"description,omitempty"`
+	Required    bool        `json:"required"`
+	Default     interface{} `json:"default,omitempty"`
+}
+
+// ActionList is the list of custom actions for a resource
+type ActionList struct {
+	Value []*Action `json:"value"`
+}
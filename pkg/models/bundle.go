@@ -27,6 +27,10 @@ type BundleCommandProperties struct {
 	CorrelationId               string `json:"-"`
 	Error                       string `json:"error,omitempty"`
 	Status                      string `json:"status,omitempty"`
+	ForceUpdateTag              string `json:"forceUpdateTag,omitempty"`
+	Fingerprint                 string `json:"-"`
+	ActionOperationId           string `json:"-"`
+	ActionFingerprint           string `json:"-"`
 }
 
 type BundleCommandOutputs struct {
@@ -39,6 +43,7 @@ type RPProperties struct {
 	SubscriptionId string `json:"-"`
 	RequestPath    string `json:"-"`
 	RequestId      string `json:"-"`
+	Caller         string `json:"-"`
 }
 
 type BundleRP struct {
@@ -51,6 +56,11 @@ type BundleRPOutput struct {
 	*BundleCommandOutputs
 }
 
+// BundleRPOutputList is the list of resources returned by a LIST request
+type BundleRPOutputList struct {
+	Value []*BundleRPOutput `json:"value"`
+}
+
 func BundleCtx(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		payload := r.Context().Value(BundleContext).(*BundleRP)
@@ -99,6 +109,7 @@ func (payload *BundleRP) setRequestProperties(r *http.Request) error {
 	payload.Name = resource.ResourceName
 	payload.SubscriptionId = resource.SubscriptionID
 	payload.Type = resource.ResourceType
+	payload.Caller = helpers.GetCaller(r)
 
 	return nil
 }
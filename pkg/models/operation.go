@@ -1,9 +1,13 @@
 package models
 
+import "time"
+
 type Operation struct {
 	Id         string                 `json:"id"`
 	Name       string                 `json:"name"`
 	Status     string                 `json:"status"`
+	StartTime  *time.Time             `json:"startTime,omitempty"`
+	EndTime    *time.Time             `json:"endTime,omitempty"`
 	Error      *OperationError        `json:"error,omitempty"`
 	Properties map[string]interface{} `json:"properties,omitempty"`
 }
@@ -12,3 +16,8 @@ type OperationError struct {
 	Code    string `json:"code,omitempty"`
 	Message string `json:"message,omitempty"`
 }
+
+// OperationList is the list of async operations for a resource
+type OperationList struct {
+	Value []*Operation `json:"value"`
+}
@@ -0,0 +1,206 @@
+package redact
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/cnabio/cnab-go/bundle"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/settings"
+)
+
+// Mask replaces redacted values
+const Mask = "*****"
+
+// minSecretLength stops short values such as true or 1 being masked everywhere they appear in text
+const minSecretLength = 4
+
+// defaultPatterns match tokens and connection string secrets, if a pattern has a group named secret only that group is masked otherwise the whole match is masked. Key names must not follow a letter so that names ending in a key name such as nonsecret are not masked
+var defaultPatterns = []string{
+	`(?i)(?:^|[^a-z])(?:accountkey|sharedaccesskey|sharedaccesssignature|password|passwd|pwd|secret|token|sig)"?\s*[=:]\s*"?(?P<secret>[^;&\s",}]+)`,
+	`(?i)bearer\s+(?P<secret>[a-z0-9\-_.~+/]+=*)`,
+	`eyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`,
+}
+
+var patterns = mustCompile(defaultPatterns)
+
+// Configure adds the patterns in the JSON array patternsJSON to the default patterns
+func Configure(patternsJSON string) error {
+	all := append([]string{}, defaultPatterns...)
+	if len(strings.TrimSpace(patternsJSON)) > 0 {
+		var additional []string
+		if err := json.Unmarshal([]byte(patternsJSON), &additional); err != nil {
+			return fmt.Errorf("Failed to parse redaction patterns, expected a JSON array of strings: %v", err)
+		}
+		all = append(all, additional...)
+	}
+	compiled, err := compile(all)
+	if err != nil {
+		return err
+	}
+	patterns = compiled
+	return nil
+}
+
+func compile(expressions []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(expressions))
+	for _, e := range expressions {
+		re, err := regexp.Compile(e)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to compile redaction pattern %s: %v", e, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+func mustCompile(expressions []string) []*regexp.Regexp {
+	compiled, err := compile(expressions)
+	if err != nil {
+		panic(err)
+	}
+	return compiled
+}
+
+// SensitiveNames returns the lower case names of the credentials and the sensitive parameters and outputs of the bundle
+func SensitiveNames(rpBundle *bundle.Bundle) map[string]bool {
+	names := make(map[string]bool)
+	if rpBundle == nil {
+		return names
+	}
+	for k := range rpBundle.Credentials {
+		names[strings.ToLower(k)] = true
+	}
+	for k, v := range rpBundle.Parameters {
+		if isSensitiveDefinition(rpBundle, v.Definition) {
+			names[strings.ToLower(k)] = true
+		}
+	}
+	for k, v := range rpBundle.Outputs {
+		if isSensitiveDefinition(rpBundle, v.Definition) {
+			names[strings.ToLower(k)] = true
+		}
+	}
+	return names
+}
+
+func isSensitiveDefinition(rpBundle *bundle.Bundle, name string) bool {
+	definition, ok := rpBundle.Definitions[name]
+	return ok && definition.WriteOnly != nil && *definition.WriteOnly
+}
+
+// Body masks the values of credentials and sensitive parameters in a JSON request or response body using the names from every loaded bundle, then applies the patterns
+func Body(body []byte) []byte {
+	var data interface{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return []byte(applyPatterns(string(body)))
+	}
+	names := make(map[string]bool)
+	for _, providers := range []map[string]*settings.BundleInformation{settings.Providers(), settings.RemovedProviders()} {
+		for _, bundleInfo := range providers {
+			for k := range SensitiveNames(bundleInfo.RPBundle) {
+				names[k] = true
+			}
+		}
+	}
+	data = maskValue(data, names, false)
+	out, err := json.Marshal(data)
+	if err != nil {
+		return []byte(Mask)
+	}
+	return []byte(applyPatterns(string(out)))
+}
+
+func maskValue(value interface{}, names map[string]bool, mask bool) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			key := strings.ToLower(k)
+			v[k] = maskValue(child, names, mask || key == "credentials" || names[key])
+		}
+		return v
+	case []interface{}:
+		for i := range v {
+			v[i] = maskValue(v[i], names, mask)
+		}
+		return v
+	default:
+		if mask && value != nil {
+			return Mask
+		}
+		return value
+	}
+}
+
+// Text masks any occurrence of the credential values and sensitive parameter values in text, then applies the patterns
+func Text(text string, rpBundle *bundle.Bundle, params map[string]interface{}, creds map[string]interface{}) string {
+	var secrets []string
+	for _, v := range creds {
+		secrets = appendSecret(secrets, v)
+	}
+	names := SensitiveNames(rpBundle)
+	for k, v := range params {
+		if names[strings.ToLower(k)] {
+			secrets = appendSecret(secrets, v)
+		}
+	}
+	// longest first so that a secret that contains another secret is masked completely
+	sort.Slice(secrets, func(i, j int) bool {
+		return len(secrets[i]) > len(secrets[j])
+	})
+	for _, s := range secrets {
+		text = strings.ReplaceAll(text, s, Mask)
+	}
+	return applyPatterns(text)
+}
+
+func appendSecret(secrets []string, value interface{}) []string {
+	if value == nil {
+		return secrets
+	}
+	secret := fmt.Sprintf("%v", value)
+	if len(secret) < minSecretLength {
+		return secrets
+	}
+	secrets = append(secrets, secret)
+	// file credentials are base64 encoded by ARM, porter output may contain the decoded value
+	if decoded, err := base64.StdEncoding.DecodeString(secret); err == nil && len(decoded) >= minSecretLength {
+		secrets = append(secrets, string(decoded))
+	}
+	return secrets
+}
+
+func applyPatterns(text string) string {
+	for _, p := range patterns {
+		text = replace(p, text)
+	}
+	return text
+}
+
+func replace(p *regexp.Regexp, text string) string {
+	group := -1
+	for i, name := range p.SubexpNames() {
+		if name == "secret" {
+			group = i
+		}
+	}
+	if group < 0 {
+		return p.ReplaceAllLiteralString(text, Mask)
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range p.FindAllStringSubmatchIndex(text, -1) {
+		start, end := m[2*group], m[2*group+1]
+		if start < 0 {
+			continue
+		}
+		b.WriteString(text[last:start])
+		b.WriteString(Mask)
+		last = end
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
@@ -0,0 +1,24 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/go-chi/render"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/helpers"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/jobs"
+)
+
+// drainRetryAfter is the number of seconds ARM is asked to wait before retrying a request rejected while draining, by then the request should reach another instance
+const drainRetryAfter = "30"
+
+// RejectWhileDraining returns 503 with a Retry-After header for requests that would start a job once the jobs are draining, GET requests are still served so that operations can be polled
+func RejectWhileDraining(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if jobs.Draining() && r.Method != http.MethodGet {
+			w.Header().Set("Retry-After", drainRetryAfter)
+			_ = render.Render(w, r, helpers.ErrorServiceUnavailable("The resource handler is shutting down"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
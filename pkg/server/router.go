@@ -0,0 +1,42 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	az "github.com/simongdavies/cnab-custom-resource-handler/pkg/azure"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/handlers"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/health"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// NewHandler returns the handler for the ARM endpoints with the metrics and health endpoints alongside, authenticate is the middleware that authenticates ARM requests. The settings must be loaded first, requests are only given an Azure credential when the storage account key is looked up using ARM
+func NewHandler(authenticate func(http.Handler) http.Handler) http.Handler {
+	log.Debug("Creating Router")
+	router := chi.NewRouter()
+	// RequestId is first so that everything logged for the request has the correlation fields
+	router.Use(az.RequestId)
+	router.Use(metrics.Middleware)
+	router.Use(RejectWhileDraining)
+	router.Use(middleware.RealIP)
+	router.Use(middleware.Logger)
+	router.Use(authenticate)
+	router.Use(az.LogRequestBody)
+	router.Use(az.LogResponseBody)
+	if az.CredentialsRequired() {
+		router.Use(az.Login)
+	}
+	router.Use(middleware.Timeout(10 * time.Minute))
+	router.Use(middleware.Recoverer)
+	log.Debug("Creating Handler")
+	router.Handle("/*", handlers.NewCustomResourceHandler())
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/healthz", health.Healthz)
+	mux.Handle("/readyz", health.Readyz(health.DefaultChecks))
+	mux.Handle("/", router)
+	return mux
+}
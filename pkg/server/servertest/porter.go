@@ -0,0 +1,217 @@
+package servertest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/helpers"
+)
+
+// errPorterFailed is returned for a porter command that fails, like porter the output describes the failure
+var errPorterFailed = errors.New("exit status 1")
+
+// FakePorter runs porter commands against installations kept in memory, bundle actions succeed unless they are set to fail and can be held to keep an operation running
+type FakePorter struct {
+	mu            sync.Mutex
+	installations map[string]map[string]string
+	outputs       map[string]string
+	failures      map[string]string
+	holds         map[string]chan struct{}
+	commands      [][]string
+}
+
+// NewFakePorter returns a FakePorter with no installations
+func NewFakePorter() *FakePorter {
+	p := &FakePorter{
+		installations: make(map[string]map[string]string),
+	}
+	p.Reset()
+	return p
+}
+
+// Reset clears the outputs, failures and holds, installations are kept. Held actions are released
+func (p *FakePorter) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, hold := range p.holds {
+		close(hold)
+	}
+	p.outputs = make(map[string]string)
+	p.failures = make(map[string]string)
+	p.holds = make(map[string]chan struct{})
+	p.commands = nil
+}
+
+// SetOutputs sets the outputs that installations have after an install or upgrade succeeds
+func (p *FakePorter) SetOutputs(outputs map[string]string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.outputs = make(map[string]string, len(outputs))
+	for k, v := range outputs {
+		p.outputs[k] = v
+	}
+}
+
+// Fail makes the action fail with the output until Reset is called, action is install, upgrade, uninstall or the name of a custom action
+func (p *FakePorter) Fail(action string, output string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failures[action] = output
+}
+
+// Hold makes the action wait until the returned function is called so that the operation stays running
+func (p *FakePorter) Hold(action string) (release func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	hold := make(chan struct{})
+	p.holds[action] = hold
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			if p.holds[action] == hold {
+				delete(p.holds, action)
+				close(hold)
+			}
+		})
+	}
+}
+
+// Installed returns true if the installation exists
+func (p *FakePorter) Installed(installationName string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.installations[installationName]
+	return ok
+}
+
+// Actions returns the bundle actions that have been run since Reset in the order they were run
+func (p *FakePorter) Actions() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var actions []string
+	for _, args := range p.commands {
+		if action, ok := bundleAction(args); ok {
+			actions = append(actions, action)
+		}
+	}
+	return actions
+}
+
+// Run runs a porter command, it is a helpers.PorterRunner
+func (p *FakePorter) Run(ctx context.Context, args []string, env []string) ([]byte, error) {
+	p.mu.Lock()
+	p.commands = append(p.commands, args)
+	p.mu.Unlock()
+	if action, ok := bundleAction(args); ok {
+		return p.runAction(ctx, action, args[1])
+	}
+	switch args[0] {
+	case "version":
+		return []byte("porter v0.0.0-servertest"), nil
+	case "plugins":
+		return []byte("azure"), nil
+	case "installations":
+		if len(args) >= 3 && args[1] == "show" {
+			return p.show(args[2])
+		}
+		if len(args) >= 5 && args[1] == "output" && args[2] == "list" {
+			return p.listOutputs(args[4])
+		}
+	}
+	return []byte(fmt.Sprintf("unsupported command %v", args)), errPorterFailed
+}
+
+func (p *FakePorter) runAction(ctx context.Context, action string, installationName string) ([]byte, error) {
+	p.mu.Lock()
+	// porter records the installation when an install starts and keeps it if the install fails
+	if _, ok := p.installations[installationName]; !ok && action == "install" {
+		p.installations[installationName] = make(map[string]string)
+	}
+	hold, held := p.holds[action]
+	p.mu.Unlock()
+	if held {
+		select {
+		case <-hold:
+		case <-ctx.Done():
+			return []byte(ctx.Err().Error()), ctx.Err()
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	output, failed := p.failures[action]
+	switch action {
+	case "install", "upgrade":
+		if !failed {
+			outputs := make(map[string]string, len(p.outputs))
+			for k, v := range p.outputs {
+				outputs[k] = v
+			}
+			p.installations[installationName] = outputs
+		}
+	case "uninstall":
+		if !failed {
+			delete(p.installations, installationName)
+		}
+	default:
+		if _, ok := p.installations[installationName]; !ok {
+			return []byte("installation does not exist"), errPorterFailed
+		}
+	}
+	if failed {
+		return []byte(output), errPorterFailed
+	}
+	return []byte(fmt.Sprintf("%s %s succeeded", action, installationName)), nil
+}
+
+func (p *FakePorter) show(installationName string) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.installations[installationName]; !ok {
+		return []byte("installation does not exist"), errPorterFailed
+	}
+	return []byte(installationName), nil
+}
+
+func (p *FakePorter) listOutputs(installationName string) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	outputs, ok := p.installations[installationName]
+	if !ok {
+		return []byte("installation does not exist"), errPorterFailed
+	}
+	names := make([]string, 0, len(outputs))
+	for k := range outputs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	result := make([]helpers.PorterOutput, 0, len(outputs))
+	for _, name := range names {
+		result = append(result, helpers.PorterOutput{Name: name, Value: outputs[name], Type: "string"})
+	}
+	return json.Marshal(result)
+}
+
+// bundleAction returns the action run by a porter command that runs a bundle
+func bundleAction(args []string) (string, bool) {
+	if len(args) < 2 {
+		return "", false
+	}
+	switch args[0] {
+	case "install", "upgrade", "uninstall":
+		return args[0], true
+	case "invoke":
+		for i := 2; i < len(args)-1; i++ {
+			if args[i] == "--action" {
+				return args[i+1], true
+			}
+		}
+	}
+	return "", false
+}
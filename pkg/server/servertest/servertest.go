@@ -0,0 +1,178 @@
+// Package servertest runs the handler in process with a local state store, a fake porter and a fake Azure credential so that the ARM flows can be tested without Azure, porter or a registry
+package servertest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/auth"
+	az "github.com/simongdavies/cnab-custom-resource-handler/pkg/azure"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/helpers"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/jobs"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/server"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/settings"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/simulator"
+)
+
+// ResourceProvider is the name of the Custom RP that the server handles requests for
+const ResourceProvider = "servertest"
+
+// ResourceType is the type of the resources the server handles
+const ResourceType = "Microsoft.CustomProviders/resourceProviders/installs"
+
+// Bundle is the bundle the server runs, it has a region parameter, a host output, a status action that reads the installation, a restart action that modifies it and a stateless diagnose action
+const Bundle = `{
+  "schemaVersion": "v1.0.0",
+  "name": "servertest",
+  "version": "0.1.0",
+  "description": "Bundle used to test the handler",
+  "invocationImages": [
+    {
+      "imageType": "docker",
+      "image": "example.com/servertest:0.1.0"
+    }
+  ],
+  "definitions": {
+    "string": {
+      "type": "string"
+    }
+  },
+  "parameters": {
+    "region": {
+      "definition": "string",
+      "destination": {
+        "env": "REGION"
+      }
+    }
+  },
+  "outputs": {
+    "host": {
+      "definition": "string",
+      "applyTo": ["install", "upgrade"],
+      "path": "/cnab/app/outputs/host"
+    }
+  },
+  "actions": {
+    "status": {
+      "description": "Reports the status of the installation"
+    },
+    "restart": {
+      "description": "Restarts the installation",
+      "modifies": true
+    },
+    "diagnose": {
+      "description": "Reports why the installation failed",
+      "stateless": true
+    }
+  }
+}`
+
+var setupOnce sync.Once
+var setupErr error
+
+// Server is the handler running in process
+type Server struct {
+	// URL is the base URL of the handler
+	URL    string
+	Porter *FakePorter
+	Store  *az.LocalStateStore
+	server *httptest.Server
+}
+
+// NewServer starts the handler with an empty state store and a FakePorter. The settings are loaded and the jobs are started the first time a server is created and are shared by every server in the process, the state store and porter are replaced for the process so only one server should be running at a time
+func NewServer() (*Server, error) {
+	store, err := az.NewLocalStateStore("")
+	if err != nil {
+		return nil, err
+	}
+	porter := NewFakePorter()
+	az.UseStateStore(store)
+	helpers.UsePorterRunner(porter.Run)
+	az.UseLoginInfo(&az.LoginInfo{
+		Authorizer: autorest.NullAuthorizer{},
+		Source:     "servertest",
+	})
+
+	setupOnce.Do(func() {
+		setupErr = setup()
+	})
+	if setupErr != nil {
+		return nil, setupErr
+	}
+
+	authenticate, err := auth.New(auth.Config{Mode: auth.ModeNone})
+	if err != nil {
+		return nil, err
+	}
+	httpServer := httptest.NewServer(server.NewHandler(authenticate))
+	return &Server{
+		URL:    httpServer.URL,
+		Porter: porter,
+		Store:  store,
+		server: httpServer,
+	}, nil
+}
+
+// setup loads the settings for the bundle from a temporary file and starts the jobs
+func setup() error {
+	dir, err := ioutil.TempDir("", "servertest")
+	if err != nil {
+		return err
+	}
+	bundleFile := filepath.Join(dir, "bundle.json")
+	if err := ioutil.WriteFile(bundleFile, []byte(Bundle), 0600); err != nil {
+		return err
+	}
+	for name, value := range map[string]string{
+		settings.RequiredSettings["StateTable"]:   "state",
+		settings.RequiredSettings["AsyncOpTable"]: "asyncoperations",
+		"RESOURCE_TYPE":   ResourceProvider,
+		"IS_RPAAS":        "false",
+		"CNAB_BUNDLE_TAG": "",
+	} {
+		if err := os.Setenv(name, value); err != nil {
+			return err
+		}
+	}
+	settings.LocalBundleFiles = map[string]string{"": bundleFile}
+	if err := settings.Load(); err != nil {
+		return fmt.Errorf("Failed to load settings: %w", err)
+	}
+	jobs.Start()
+	return nil
+}
+
+// Close stops the server, the jobs keep running for the next server
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// Client returns a simulated ARM client for the server that polls without waiting for the Retry-After time, subscriptionId partitions the state so that tests sharing a server do not see each other's resources
+func (s *Server) Client(subscriptionId string) *simulator.Client {
+	return simulator.NewClient(simulator.Config{
+		Endpoint:       s.URL,
+		SubscriptionId: subscriptionId,
+		ResourceGroup:  "servertest-rg",
+		MaxRetryAfter:  10 * time.Millisecond,
+		Timeout:        30 * time.Second,
+	})
+}
+
+// Resource returns a resource handled by the server with the bundle parameters
+func Resource(name string, parameters map[string]interface{}) simulator.Resource {
+	properties := map[string]interface{}{}
+	if parameters != nil {
+		properties["parameters"] = parameters
+	}
+	return simulator.Resource{
+		Type:       ResourceType,
+		Name:       fmt.Sprintf("%s/%s", ResourceProvider, name),
+		Properties: properties,
+	}
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/settings"
+	log "github.com/sirupsen/logrus"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSConfig contains the settings for serving HTTPS
+type TLSConfig struct {
+	CertFile     string
+	KeyFile      string
+	MinVersion   string
+	CipherSuites []string
+	// RedirectPort is the port for a HTTP listener that redirects to HTTPS, no listener is started if it is empty
+	RedirectPort string
+	// RequestClientCert asks the client for a certificate so that it can be used for authentication
+	RequestClientCert bool
+}
+
+// TLSConfigFromSettings returns the TLS config from the environment settings
+func TLSConfigFromSettings() TLSConfig {
+	config := TLSConfig{
+		CertFile:     settings.OptionalSettings["TLSCertFile"].(string),
+		KeyFile:      settings.OptionalSettings["TLSKeyFile"].(string),
+		MinVersion:   settings.OptionalSettings["TLSMinVersion"].(string),
+		RedirectPort: settings.OptionalSettings["TLSRedirectPort"].(string),
+	}
+	for _, c := range strings.Split(settings.OptionalSettings["TLSCipherSuites"].(string), ",") {
+		if c = strings.TrimSpace(c); len(c) > 0 {
+			config.CipherSuites = append(config.CipherSuites, c)
+		}
+	}
+	return config
+}
+
+// Enabled returns true if a certificate has been configured
+func (c TLSConfig) Enabled() bool {
+	return len(c.CertFile) > 0 || len(c.KeyFile) > 0
+}
+
+// NewTLSConfig returns a tls.Config that serves the certificate from reloader
+func NewTLSConfig(config TLSConfig, reloader *CertificateReloader) (*tls.Config, error) {
+	tlsConfig := tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if len(config.MinVersion) > 0 {
+		version, ok := tlsVersions[config.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("Unsupported minimum TLS version %s", config.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+	if len(config.CipherSuites) > 0 {
+		suites := make(map[string]uint16)
+		for _, s := range tls.CipherSuites() {
+			suites[s.Name] = s.ID
+		}
+		for _, name := range config.CipherSuites {
+			id, ok := suites[name]
+			if !ok {
+				return nil, fmt.Errorf("Unsupported TLS cipher suite %s", name)
+			}
+			tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+		}
+	}
+	if config.RequestClientCert {
+		// the certificate is validated by the authentication middleware
+		tlsConfig.ClientAuth = tls.RequestClientCert
+	}
+	return &tlsConfig, nil
+}
+
+// CertificateReloader loads a certificate and key and reloads them when the files change
+type CertificateReloader struct {
+	certFile string
+	keyFile  string
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	watcher  *fsnotify.Watcher
+}
+
+// NewCertificateReloader loads the certificate and starts watching the files, Close should be called to stop watching
+func NewCertificateReloader(certFile string, keyFile string) (*CertificateReloader, error) {
+	if len(certFile) == 0 || len(keyFile) == 0 {
+		return nil, errors.New("Both TLS_CERT_FILE and TLS_KEY_FILE should be set to enable TLS")
+	}
+	c := CertificateReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create certificate watcher: %v", err)
+	}
+	// Watch the directories as certificates are often rotated by replacing files or symlinks rather than writing to them
+	dirs := map[string]bool{
+		filepath.Dir(certFile): true,
+		filepath.Dir(keyFile):  true,
+	}
+	for dir := range dirs {
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, fmt.Errorf("Failed to watch %s: %v", dir, err)
+		}
+	}
+	c.watcher = watcher
+	go c.watch()
+	return &c, nil
+}
+
+func (c *CertificateReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("Failed to load certificate %s and key %s: %v", c.certFile, c.keyFile, err)
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+	log.Infof("Loaded certificate %s", c.certFile)
+	return nil
+}
+
+func (c *CertificateReloader) watch() {
+	for {
+		select {
+		case event, ok := <-c.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Rename|fsnotify.Remove) == 0 {
+				continue
+			}
+			log.Debugf("Certificate directory changed %s %v", event.Name, event.Op)
+			// keep serving the existing certificate if the new one cannot be loaded, the files may not have been completely written yet
+			if err := c.load(); err != nil {
+				log.Errorf("Failed to reload certificate: %v", err)
+			}
+		case err, ok := <-c.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Errorf("Certificate watcher error: %v", err)
+		}
+	}
+}
+
+// GetCertificate returns the current certificate, it is used as tls.Config.GetCertificate
+func (c *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// Close stops watching the certificate files
+func (c *CertificateReloader) Close() error {
+	return c.watcher.Close()
+}
+
+// RedirectHandler redirects HTTP requests to the same path on the HTTPS port
+func RedirectHandler(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		target := fmt.Sprintf("https://%s:%s%s", host, httpsPort, r.URL.RequestURI())
+		if httpsPort == "443" {
+			target = fmt.Sprintf("https://%s%s", host, r.URL.RequestURI())
+		}
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,199 @@
+package server_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/auth/authtest"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/server"
+)
+
+// reloadTimeout is how long a test waits for the reloader to see a rotated certificate
+const reloadTimeout = 5 * time.Second
+
+// certLayout creates the certificate and key files in dir and returns their paths and a function that rotates them to new contents
+type certLayout func(t *testing.T, dir string, cert []byte, key []byte) (certFile string, keyFile string, rotate func(cert []byte, key []byte))
+
+// plainFiles writes the certificate and key to files in dir
+func plainFiles(t *testing.T, dir string, cert []byte, key []byte) (string, string, func([]byte, []byte)) {
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	writeFile(t, certFile, cert)
+	writeFile(t, keyFile, key)
+	return certFile, keyFile, func(cert []byte, key []byte) {
+		writeFile(t, keyFile, key)
+		writeFile(t, certFile, cert)
+	}
+}
+
+// renamedFiles replaces the certificate and key by renaming new files over them
+func renamedFiles(t *testing.T, dir string, cert []byte, key []byte) (string, string, func([]byte, []byte)) {
+	certFile, keyFile, _ := plainFiles(t, dir, cert, key)
+	return certFile, keyFile, func(cert []byte, key []byte) {
+		writeFile(t, keyFile+".new", key)
+		writeFile(t, certFile+".new", cert)
+		rename(t, keyFile+".new", keyFile)
+		rename(t, certFile+".new", certFile)
+	}
+}
+
+// symlinkedFiles lays the files out the way Kubernetes mounts a secret, the files are symlinks through a ..data symlink to a versioned directory that is swapped when the secret changes
+func symlinkedFiles(t *testing.T, dir string, cert []byte, key []byte) (string, string, func([]byte, []byte)) {
+	version := 0
+	swap := func(cert []byte, key []byte) {
+		version++
+		versionDir := filepath.Join(dir, "..version"+strconv.Itoa(version))
+		if err := os.Mkdir(versionDir, 0700); err != nil {
+			t.Fatalf("Failed to create %s: %v", versionDir, err)
+		}
+		writeFile(t, filepath.Join(versionDir, "tls.crt"), cert)
+		writeFile(t, filepath.Join(versionDir, "tls.key"), key)
+		tmp := filepath.Join(dir, "..data_tmp")
+		if err := os.Symlink(filepath.Base(versionDir), tmp); err != nil {
+			t.Fatalf("Failed to create symlink %s: %v", tmp, err)
+		}
+		rename(t, tmp, filepath.Join(dir, "..data"))
+	}
+	swap(cert, key)
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	for _, file := range []string{certFile, keyFile} {
+		if err := os.Symlink(filepath.Join("..data", filepath.Base(file)), file); err != nil {
+			t.Fatalf("Failed to create symlink %s: %v", file, err)
+		}
+	}
+	return certFile, keyFile, swap
+}
+
+func TestCertificateReloader(t *testing.T) {
+	ca, err := authtest.NewCA()
+	if err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+	first, err := ca.IssueServerCertificate("localhost")
+	if err != nil {
+		t.Fatalf("Failed to issue certificate: %v", err)
+	}
+	second, err := ca.IssueServerCertificate("localhost")
+	if err != nil {
+		t.Fatalf("Failed to issue certificate: %v", err)
+	}
+	firstCert, firstKey := authtest.PEM(first)
+	secondCert, secondKey := authtest.PEM(second)
+
+	tests := []struct {
+		name   string
+		layout certLayout
+		cert   []byte
+		key    []byte
+		// expected is the certificate that should be served after the files are rotated
+		expected *tls.Certificate
+	}{
+		{name: "written in place", layout: plainFiles, cert: secondCert, key: secondKey, expected: second},
+		{name: "renamed", layout: renamedFiles, cert: secondCert, key: secondKey, expected: second},
+		{name: "symlink swapped", layout: symlinkedFiles, cert: secondCert, key: secondKey, expected: second},
+		{name: "bad certificate keeps the old one", layout: plainFiles, cert: []byte("not a certificate"), key: secondKey, expected: first},
+		{name: "bad symlink swap keeps the old one", layout: symlinkedFiles, cert: secondCert, key: firstKey, expected: first},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "certs")
+			if err != nil {
+				t.Fatalf("Failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			certFile, keyFile, rotate := tt.layout(t, dir, firstCert, firstKey)
+			reloader, err := server.NewCertificateReloader(certFile, keyFile)
+			if err != nil {
+				t.Fatalf("Failed to create reloader: %v", err)
+			}
+			defer reloader.Close()
+			if !serving(t, reloader, first) {
+				t.Fatal("reloader is not serving the initial certificate")
+			}
+
+			rotate(tt.cert, tt.key)
+
+			timeout := reloadTimeout
+			if tt.expected == first {
+				// there is no event to wait for when the reload fails so the reloader is given time to try
+				timeout = time.Second
+			}
+			if !waitForCertificate(t, reloader, tt.expected, timeout) {
+				t.Fatal("reloader is not serving the expected certificate after the files were rotated")
+			}
+			if tt.expected == first {
+				// the reloader must still pick up a good certificate after it failed to load a bad one
+				rotate(secondCert, secondKey)
+				if !waitForCertificate(t, reloader, second, reloadTimeout) {
+					t.Error("reloader did not load a good certificate after a bad one")
+				}
+			}
+		})
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	tests := []struct {
+		name      string
+		httpsPort string
+		url       string
+		expected  string
+	}{
+		{name: "host with port", httpsPort: "8443", url: "http://example.com:8080/subscriptions/sub?api-version=1", expected: "https://example.com:8443/subscriptions/sub?api-version=1"},
+		{name: "host without port", httpsPort: "8443", url: "http://example.com/path", expected: "https://example.com:8443/path"},
+		{name: "default https port", httpsPort: "443", url: "http://example.com:8080/path?a=b", expected: "https://example.com/path?a=b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			server.RedirectHandler(tt.httpsPort).ServeHTTP(rec, httptest.NewRequest(http.MethodPut, tt.url, nil))
+			if rec.Code != http.StatusPermanentRedirect {
+				t.Errorf("status %d, expected %d", rec.Code, http.StatusPermanentRedirect)
+			}
+			if location := rec.Header().Get("Location"); location != tt.expected {
+				t.Errorf("Location %s, expected %s", location, tt.expected)
+			}
+		})
+	}
+}
+
+// waitForCertificate returns true if the reloader is serving expected within timeout
+func waitForCertificate(t *testing.T, reloader *server.CertificateReloader, expected *tls.Certificate, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !serving(t, reloader, expected) && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	return serving(t, reloader, expected)
+}
+
+func serving(t *testing.T, reloader *server.CertificateReloader, expected *tls.Certificate) bool {
+	cert, err := reloader.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("GetCertificate failed: %v", err)
+	}
+	return cert != nil && bytes.Equal(cert.Certificate[0], expected.Certificate[0])
+}
+
+func writeFile(t *testing.T, name string, data []byte) {
+	if err := ioutil.WriteFile(name, data, 0600); err != nil {
+		t.Fatalf("Failed to write %s: %v", name, err)
+	}
+}
+
+func rename(t *testing.T, from string, to string) {
+	if err := os.Rename(from, to); err != nil {
+		t.Fatalf("Failed to rename %s to %s: %v", from, to, err)
+	}
+}
@@ -0,0 +1,167 @@
+package settings
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cnabio/cnab-go/bundle"
+	log "github.com/sirupsen/logrus"
+)
+
+// CustomRPProvider is the resource provider of the resource type when running as a Custom RP endpoint
+const CustomRPProvider = "Microsoft.CustomProviders"
+
+// CheckEnvironment returns an error for each required setting that is not set and each optional setting that is set to a value that cannot be parsed as its type, it must be called before the environment is loaded
+func CheckEnvironment() []error {
+	var errs []error
+	var names []string
+	for _, v := range RequiredSettings {
+		names = append(names, v)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if len(strings.TrimSpace(os.Getenv(name))) == 0 {
+			errs = append(errs, fmt.Errorf("Environment Variable %s is not set", name))
+		}
+	}
+
+	names = nil
+	for _, v := range OptionalSettings {
+		if spec, ok := v.(string); ok {
+			names = append(names, spec)
+		}
+	}
+	sort.Strings(names)
+	for _, spec := range names {
+		parts := strings.Split(spec, ":")
+		val := strings.TrimSpace(os.Getenv(parts[0]))
+		if len(val) == 0 {
+			continue
+		}
+		var err error
+		switch parts[1] {
+		case "bool":
+			_, err = strconv.ParseBool(val)
+		case "int":
+			_, err = strconv.Atoi(val)
+		case "duration":
+			_, err = time.ParseDuration(val)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Environment Variable %s should be a %s: %v", parts[0], parts[1], err))
+		}
+	}
+	return errs
+}
+
+// ConfiguredMappings returns the mappings that are handled, when running as a Custom RP endpoint this is a single mapping from CNAB_BUNDLE_TAG and RESOURCE_TYPE. The environment must be loaded first
+func ConfiguredMappings(configFile string) ([]Mapping, error) {
+	if IsRPaaS {
+		return ReadMappings(configFile)
+	}
+	return []Mapping{
+		{
+			Provider:              CustomRPProvider,
+			Type:                  OptionalSettings["ResourceType"].(string),
+			Tag:                   OptionalSettings["BundleTag"].(string),
+			ForcePull:             OptionalSettings["ForcePull"].(bool),
+			AllowInsecureRegistry: OptionalSettings["AllowInsecureRegistry"].(bool),
+		},
+	}, nil
+}
+
+// PullBundleInformation returns the bundle information for the mapping with the bundle pulled from the registry
+func PullBundleInformation(m Mapping) (*BundleInformation, error) {
+	return getBundleInfo(m.Provider, m.Type, m.Tag, m.ForcePull, m.AllowInsecureRegistry)
+}
+
+// ReadBundleInformation returns the bundle information for the mapping with the bundle read from a bundle.json file instead of the registry, if the mapping has no tag the bundle is given a tag from its name and version
+func ReadBundleInformation(m Mapping, bundleFile string) (*BundleInformation, error) {
+	rpBundle, err := ReadBundleFile(bundleFile)
+	if err != nil {
+		return nil, err
+	}
+	tag := m.Tag
+	if len(tag) == 0 {
+		tag = localBundleTag(rpBundle)
+	}
+	bundleInformation, err := newBundleInfo(m.Provider, m.Type, tag, m.ForcePull, m.AllowInsecureRegistry)
+	if err != nil {
+		return nil, err
+	}
+	// porter runs the bundle from the file so the path must not depend on the working directory
+	if bundleInformation.BundleFile, err = filepath.Abs(bundleFile); err != nil {
+		return nil, err
+	}
+	if err := setBundle(bundleInformation, rpBundle); err != nil {
+		return nil, err
+	}
+	return bundleInformation, nil
+}
+
+// ReadBundleFile reads and validates a bundle.json file
+func ReadBundleFile(bundleFile string) (*bundle.Bundle, error) {
+	data, err := ioutil.ReadFile(bundleFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read bundle file %s: %w", bundleFile, err)
+	}
+	rpBundle, err := bundle.Unmarshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse bundle file %s: %w", bundleFile, err)
+	}
+	if err := rpBundle.Validate(); err != nil {
+		return nil, fmt.Errorf("Bundle file %s is not valid: %w", bundleFile, err)
+	}
+	return rpBundle, nil
+}
+
+// LocalBundleFiles are bundle.json files that are used instead of pulling the bundle keyed by lower case provider/type, the bundle keyed by an empty string is used for the Custom RP resource type
+var LocalBundleFiles = make(map[string]string)
+
+// ParseBundleFiles returns the bundle files in the form provider/type=path or path keyed as in LocalBundleFiles
+func ParseBundleFiles(values []string) (map[string]string, error) {
+	files := make(map[string]string)
+	for _, v := range values {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) == 1 {
+			files[""] = parts[0]
+			continue
+		}
+		if len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return nil, fmt.Errorf("Invalid bundle file %s, expected provider/type=path or path", v)
+		}
+		files[strings.ToLower(parts[0])] = parts[1]
+	}
+	return files, nil
+}
+
+// LocalBundleFile returns the file in LocalBundleFiles for the mapping
+func LocalBundleFile(m Mapping) (string, bool) {
+	if bundleFile, ok := LocalBundleFiles[strings.ToLower(GetRPName(m.Provider, m.Type))]; ok {
+		return bundleFile, true
+	}
+	if bundleFile, ok := LocalBundleFiles[""]; ok && !IsRPaaS {
+		return bundleFile, true
+	}
+	return "", false
+}
+
+// LoadBundleInformation returns the bundle information for the mapping with the bundle read from its file in LocalBundleFiles or pulled from the registry
+func LoadBundleInformation(m Mapping) (*BundleInformation, error) {
+	if bundleFile, ok := LocalBundleFile(m); ok {
+		log.Debugf("Reading bundle for Provider %s Type %s from %s", m.Provider, m.Type, bundleFile)
+		return ReadBundleInformation(m, bundleFile)
+	}
+	return PullBundleInformation(m)
+}
+
+// localBundleTag returns a tag for a bundle that has not been published to a registry
+func localBundleTag(rpBundle *bundle.Bundle) string {
+	return fmt.Sprintf("localhost/%s:%s", strings.ToLower(rpBundle.Name), strings.ReplaceAll(rpBundle.Version, "+", "_"))
+}
@@ -0,0 +1,309 @@
+package settings
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// mappingReloadDelay is how long to wait after the last change to the mapping file before reloading it so that a file that is written in several steps is read once it is complete
+	mappingReloadDelay = 2 * time.Second
+	// removedCheckInterval is how often resource types that were removed from the mappings are checked for running jobs
+	removedCheckInterval = 10 * time.Second
+	// removedRetention is how long a removed resource type is kept after its last job finished so that ARM can poll the final state of the operation, it is longer than the Retry-After returned for operations
+	removedRetention = 5 * time.Minute
+)
+
+// providersLock guards RPToProvider, mappingConfiguration, removedProviders and mappingStatus. RPToProvider is replaced rather than modified so a map returned by Providers can be read without holding the lock
+var providersLock sync.RWMutex
+
+// removedProviders are the resource types that were removed from the mappings and are being drained, operations can still be polled but new requests are rejected
+var removedProviders = make(map[string]*removedProvider)
+
+// mappingStatus is the status of the mapping file, it is nil if the file is not being watched
+var mappingStatus *MappingStatus
+
+type removedProvider struct {
+	bundleInfo *BundleInformation
+	// idleSince is when the resource type was first seen without jobs, it is zero while it has jobs
+	idleSince time.Time
+}
+
+// MappingStatus describes the last reload of the provider mapping file
+type MappingStatus struct {
+	File       string    `json:"file"`
+	LastReload time.Time `json:"lastReload"`
+	// Error is set if the last reload failed, the mappings from the last successful load are still used
+	Error string `json:"error,omitempty"`
+	// Draining are the resource types that were removed from the mappings and still have jobs or operations that are being polled
+	Draining []string `json:"draining,omitempty"`
+}
+
+// Providers returns the bundle information for each resource type, the map must not be modified
+func Providers() map[string]*BundleInformation {
+	providersLock.RLock()
+	defer providersLock.RUnlock()
+	return RPToProvider
+}
+
+// ProviderFor returns the bundle information for a resource type in the form provider/type
+func ProviderFor(rpType string) (*BundleInformation, bool) {
+	providersLock.RLock()
+	defer providersLock.RUnlock()
+	bundleInfo, ok := RPToProvider[rpType]
+	return bundleInfo, ok
+}
+
+// RemovedProviderFor returns the bundle information for a resource type that was removed from the mappings and is being drained
+func RemovedProviderFor(rpType string) (*BundleInformation, bool) {
+	providersLock.RLock()
+	defer providersLock.RUnlock()
+	removed, ok := removedProviders[rpType]
+	if !ok {
+		return nil, false
+	}
+	return removed.bundleInfo, true
+}
+
+// RemovedProviders returns the bundle information for each resource type that is being drained
+func RemovedProviders() map[string]*BundleInformation {
+	providersLock.RLock()
+	defer providersLock.RUnlock()
+	providers := make(map[string]*BundleInformation, len(removedProviders))
+	for rpType, removed := range removedProviders {
+		providers[rpType] = removed.bundleInfo
+	}
+	return providers
+}
+
+// IsRemoved returns true if the bundle information is for a resource type that is being drained
+func IsRemoved(bundleInfo *BundleInformation) bool {
+	providersLock.RLock()
+	defer providersLock.RUnlock()
+	for _, removed := range removedProviders {
+		if removed.bundleInfo == bundleInfo {
+			return true
+		}
+	}
+	return false
+}
+
+// CurrentMappingStatus returns the status of the mapping file, it returns nil if the file is not being watched
+func CurrentMappingStatus() *MappingStatus {
+	providersLock.RLock()
+	defer providersLock.RUnlock()
+	if mappingStatus == nil {
+		return nil
+	}
+	status := *mappingStatus
+	status.Draining = nil
+	for rpType := range removedProviders {
+		status.Draining = append(status.Draining, rpType)
+	}
+	sort.Strings(status.Draining)
+	return &status
+}
+
+func currentMappings() []Mapping {
+	providersLock.RLock()
+	defer providersLock.RUnlock()
+	return mappingConfiguration.Mappings
+}
+
+// setProviders replaces the mappings and bundle information, resource types that are no longer mapped are drained and resource types that are mapped again stop draining
+func setProviders(mappings []Mapping, providers map[string]*BundleInformation) {
+	providersLock.Lock()
+	defer providersLock.Unlock()
+	for rpType, bundleInfo := range RPToProvider {
+		if _, ok := providers[rpType]; !ok {
+			log.Infof("Resource type %s was removed from the provider mappings, new requests are rejected while it is drained", rpType)
+			removedProviders[rpType] = &removedProvider{bundleInfo: bundleInfo}
+		}
+	}
+	for rpType := range providers {
+		delete(removedProviders, rpType)
+	}
+	RPToProvider = providers
+	mappingConfiguration.Mappings = mappings
+}
+
+// MappingReloader reloads the provider mappings when the mapping file changes, new and changed mappings are loaded before they replace the current mappings so requests keep being handled while bundles are pulled. Jobs keep the bundle information they were queued with so they finish with the bundle that started them
+type MappingReloader struct {
+	configFile string
+	// inUse returns true if a resource type has queued or running jobs
+	inUse   func(rpType string) bool
+	watcher *fsnotify.Watcher
+}
+
+// NewMappingReloader starts watching the mapping file that was read by Load, inUse is used to find when a removed resource type has been drained. Close should be called to stop watching
+func NewMappingReloader(inUse func(rpType string) bool) (*MappingReloader, error) {
+	configFile := viper.ConfigFileUsed()
+	if len(configFile) == 0 {
+		return nil, errors.New("The provider mappings were not read from a file")
+	}
+	configFile, err := filepath.Abs(configFile)
+	if err != nil {
+		return nil, err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create provider mapping watcher: %v", err)
+	}
+	// Watch the directory as ConfigMaps and editors replace the file rather than writing to it
+	if err := watcher.Add(filepath.Dir(configFile)); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("Failed to watch %s: %v", filepath.Dir(configFile), err)
+	}
+	m := MappingReloader{
+		configFile: configFile,
+		inUse:      inUse,
+		watcher:    watcher,
+	}
+	providersLock.Lock()
+	mappingStatus = &MappingStatus{
+		File:       configFile,
+		LastReload: time.Now().UTC(),
+	}
+	providersLock.Unlock()
+	go m.watch()
+	log.Infof("Watching provider mappings in %s", configFile)
+	return &m, nil
+}
+
+func (m *MappingReloader) watch() {
+	var reload <-chan time.Time
+	ticker := time.NewTicker(removedCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case event, ok := <-m.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Rename|fsnotify.Remove) == 0 {
+				continue
+			}
+			log.Debugf("Provider mapping directory changed %s %v", event.Name, event.Op)
+			reload = time.After(mappingReloadDelay)
+		case <-reload:
+			reload = nil
+			if err := m.reload(); err != nil {
+				log.Errorf("Failed to reload provider mappings from %s, the previous mappings are still used: %v", m.configFile, err)
+			}
+		case err, ok := <-m.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Errorf("Provider mapping watcher error: %v", err)
+		case <-ticker.C:
+			m.drainRemoved(time.Now())
+		}
+	}
+}
+
+// reload reads the mapping file and loads the bundles for new and changed mappings, the current mappings are only replaced if every bundle is loaded
+func (m *MappingReloader) reload() error {
+	err := m.loadMappings()
+	providersLock.Lock()
+	defer providersLock.Unlock()
+	mappingStatus.LastReload = time.Now().UTC()
+	mappingStatus.Error = ""
+	if err != nil {
+		mappingStatus.Error = err.Error()
+	}
+	return err
+}
+
+func (m *MappingReloader) loadMappings() error {
+	v := viper.New()
+	v.SetConfigFile(m.configFile)
+	mappings, err := readMappings(v)
+	if err != nil {
+		return err
+	}
+	if err := checkMappings(mappings); err != nil {
+		return err
+	}
+
+	current := Providers()
+	previous := make(map[string]Mapping)
+	for _, mapping := range currentMappings() {
+		previous[GetRPName(mapping.Provider, mapping.Type)] = mapping
+	}
+	providers := make(map[string]*BundleInformation)
+	changed := 0
+	for _, mapping := range mappings {
+		rpType := GetRPName(mapping.Provider, mapping.Type)
+		if bundleInfo, ok := current[rpType]; ok && previous[rpType] == mapping {
+			providers[rpType] = bundleInfo
+			continue
+		}
+		log.Infof("Loading bundle %s for resource type %s", mapping.Tag, rpType)
+		bundleInfo, err := LoadBundleInformation(mapping)
+		if err != nil {
+			return fmt.Errorf("Failed to load bundle %s for resource type %s: %w", mapping.Tag, rpType, err)
+		}
+		providers[rpType] = bundleInfo
+		changed++
+	}
+	if changed == 0 && len(providers) == len(current) {
+		log.Debugf("Provider mappings in %s are unchanged", m.configFile)
+		return nil
+	}
+	setProviders(mappings, providers)
+	log.Infof("Reloaded provider mappings from %s, %d resource types are mapped and %d were loaded", m.configFile, len(providers), changed)
+	return nil
+}
+
+// drainRemoved stops handling removed resource types once they have had no jobs for removedRetention
+func (m *MappingReloader) drainRemoved(now time.Time) {
+	providersLock.Lock()
+	defer providersLock.Unlock()
+	for rpType, removed := range removedProviders {
+		if m.inUse(rpType) {
+			removed.idleSince = time.Time{}
+			continue
+		}
+		if removed.idleSince.IsZero() {
+			removed.idleSince = now
+			continue
+		}
+		if now.Sub(removed.idleSince) >= removedRetention {
+			delete(removedProviders, rpType)
+			log.Infof("Finished draining resource type %s", rpType)
+		}
+	}
+}
+
+// Close stops watching the mapping file
+func (m *MappingReloader) Close() error {
+	return m.watcher.Close()
+}
+
+// checkMappings returns an error if the mappings would leave no resource types mapped or a mapping is incomplete or duplicated, a file that is being written or an invalid file should not remove the resource types that are being handled
+func checkMappings(mappings []Mapping) error {
+	if len(mappings) == 0 {
+		return errors.New("No resource types are mapped")
+	}
+	seen := make(map[string]bool)
+	for _, m := range mappings {
+		if len(m.Provider) == 0 || len(m.Type) == 0 {
+			return fmt.Errorf("Provider and type should be set for every mapping, got provider: %q type: %q", m.Provider, m.Type)
+		}
+		rpType := strings.ToLower(GetRPName(m.Provider, m.Type))
+		if seen[rpType] {
+			return fmt.Errorf("%s is mapped more than once", GetRPName(m.Provider, m.Type))
+		}
+		seen[rpType] = true
+	}
+	return nil
+}
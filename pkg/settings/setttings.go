@@ -1,12 +1,15 @@
 package settings
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"get.porter.sh/porter/pkg/porter"
 	"github.com/cnabio/cnab-go/bundle"
@@ -21,13 +24,30 @@ var IsRPaaS bool
 var LogRequestBody bool
 var LogResponseBody bool
 var Debug bool
+var AsyncOpRetentionDays int
+var AsyncOpRetentionCount int
+var AsyncOpSweepInterval time.Duration
+
+// ShutdownGracePeriod is the time from a termination signal to exiting, it covers draining the jobs and shutting down the servers
+var ShutdownGracePeriod time.Duration
+
+// DevMode is true when running locally without Azure, state is kept in a local store and bundles are read from files
+var DevMode bool
+
+// Driver is the CNAB driver porter uses to run bundle actions
+var Driver string
+
+// DefaultDriver is the driver used if CNAB_DRIVER is not set, the Azure CNAB driver runs actions in Azure Container Instances
+const DefaultDriver = "azure"
+
+const defaultAsyncOpSweepInterval = time.Hour
+
+// defaultShutdownGracePeriod leaves time to exit before porter is killed at the end of the default Kubernetes termination grace period of 30 seconds
+const defaultShutdownGracePeriod = 25 * time.Second
 
 var RequiredSettings = map[string]string{
-	"StorageAccountName":   "CNAB_AZURE_STATE_STORAGE_ACCOUNT_NAME",
-	"StorageResourceGroup": "CNAB_AZURE_STATE_STORAGE_RESOURCE_GROUP",
-	"SusbcriptionId":       "CNAB_AZURE_SUBSCRIPTION_ID",
-	"AsyncOpTable":         "CUSTOM_RP_ASYNC_OP_TABLE",
-	"StateTable":           "CUSTOM_RP_STATE_TABLE",
+	"AsyncOpTable": "CUSTOM_RP_ASYNC_OP_TABLE",
+	"StateTable":   "CUSTOM_RP_STATE_TABLE",
 }
 
 var OptionalSettings = map[string]interface{}{
@@ -38,6 +58,38 @@ var OptionalSettings = map[string]interface{}{
 	"IsRPaaS":               "IS_RPAAS:bool",
 	"ResourceType":          "RESOURCE_TYPE:string",
 	"BundleTag":             "CNAB_BUNDLE_TAG:string",
+	"AsyncOpRetentionDays":  "ASYNC_OP_RETENTION_DAYS:int",
+	"AsyncOpRetentionCount": "ASYNC_OP_RETENTION_COUNT:int",
+	"AsyncOpSweepInterval":  "ASYNC_OP_SWEEP_INTERVAL:duration",
+	"AuthMode":              "AUTH_MODE:string",
+	"AuthCertThumbprints":   "AUTH_CLIENT_CERT_THUMBPRINTS:string",
+	"AuthCertHeader":        "AUTH_CLIENT_CERT_HEADER:string",
+	"AuthCertHeaderTrusted": "AUTH_CLIENT_CERT_HEADER_TRUSTED:bool",
+	"AuthCertCAFile":        "AUTH_CLIENT_CERT_CA_FILE:string",
+	"AuthJWTIssuer":         "AUTH_JWT_ISSUER:string",
+	"AuthJWTAudience":       "AUTH_JWT_AUDIENCE:string",
+	"AuthJWKSURL":           "AUTH_JWKS_URL:string",
+	"AuthAPIKey":            "AUTH_API_KEY:string",
+	"TLSCertFile":           "TLS_CERT_FILE:string",
+	"TLSKeyFile":            "TLS_KEY_FILE:string",
+	"TLSMinVersion":         "TLS_MIN_VERSION:string",
+	"TLSCipherSuites":       "TLS_CIPHER_SUITES:string",
+	"TLSRedirectPort":       "TLS_REDIRECT_PORT:string",
+	"RedactPatterns":        "REDACT_PATTERNS:string",
+	"AzureCredentialOrder":  "AZURE_CREDENTIAL_ORDER:string",
+	"StorageAccountName":    "CNAB_AZURE_STATE_STORAGE_ACCOUNT_NAME:string",
+	"StorageAccountKey":     "CNAB_AZURE_STATE_STORAGE_ACCOUNT_KEY:string",
+	"StorageResourceGroup":  "CNAB_AZURE_STATE_STORAGE_RESOURCE_GROUP:string",
+	"SusbcriptionId":        "CNAB_AZURE_SUBSCRIPTION_ID:string",
+	"StorageConnection":     "AZURE_STORAGE_CONNECTION_STRING:string",
+	"StorageTableEndpoint":  "AZURE_STORAGE_TABLE_ENDPOINT:string",
+	"AzureEnvironment":      "AZURE_ENVIRONMENT:string",
+	"AzureEnvironmentFile":  "AZURE_ENVIRONMENT_FILEPATH:string",
+	"TracingExporter":       "TRACING_EXPORTER:string",
+	"ShutdownGracePeriod":   "SHUTDOWN_GRACE_PERIOD:duration",
+	"AdminAddress":          "ADMIN_ADDRESS:string",
+	"AdminAPIKey":           "ADMIN_API_KEY:string",
+	"Driver":                "CNAB_DRIVER:string",
 }
 
 type BundleInformation struct {
@@ -46,6 +98,17 @@ type BundleInformation struct {
 	BundlePullOptions *porter.BundlePullOptions
 	TrimmedBundleTag  string
 	RPBundle          *bundle.Bundle
+	BundleDigest      string
+	// BundleFile is a local bundle.json that porter runs instead of the bundle in the registry
+	BundleFile string
+}
+
+// BundleArgs returns the porter arguments that select the bundle
+func (b *BundleInformation) BundleArgs() []string {
+	if len(b.BundleFile) > 0 {
+		return []string{"--cnab-file", b.BundleFile}
+	}
+	return []string{"--reference", b.BundlePullOptions.Tag}
 }
 
 type Mapping struct {
@@ -56,6 +119,7 @@ type Mapping struct {
 	AllowInsecureRegistry bool   `mapstructure:"insecureregistry"`
 }
 
+// RPToProvider is the bundle information for each resource type keyed by provider/type, it is replaced when the provider mappings are reloaded so it should be read with Providers or ProviderFor
 var RPToProvider = make(map[string]*BundleInformation)
 
 type Config struct {
@@ -63,86 +127,188 @@ type Config struct {
 }
 
 var mappingConfiguration Config
+var environmentLoaded bool
+var optionalSettingsLoaded bool
+
+// invalidOptionalSettings are the optional settings that are set to a value that cannot be parsed as their type keyed by setting name
+var invalidOptionalSettings = make(map[string]error)
 
+// Load reads the settings from the environment and loads the bundle for each resource type that is handled
 func Load() error {
-	for k, v := range RequiredSettings {
-		val := os.Getenv(v)
-		if len(val) == 0 {
-			return fmt.Errorf("Environment Variable %s is not set", v)
-		}
-		RequiredSettings[k] = strings.TrimSpace(val)
-	}
-	for k, v := range OptionalSettings {
-		parts := strings.Split(v.(string), ":")
-		val := os.Getenv(parts[0])
-		switch parts[1] {
-		case "bool":
-			if boolVal, err := strconv.ParseBool(val); err == nil {
-				OptionalSettings[k] = boolVal
-			} else {
-				OptionalSettings[k] = false
-			}
-		case "string":
-			OptionalSettings[k] = strings.TrimSpace(val)
-		default:
-			OptionalSettings[k] = false
-		}
+	if err := LoadEnvironment(); err != nil {
+		return err
 	}
 
 	resourceTypeName := OptionalSettings["ResourceType"].(string)
-	IsRPaaS = OptionalSettings["IsRPaaS"].(bool)
 	if IsRPaaS {
 		log.Debug("Running as RPaaS Endpoint")
-		viper.SetConfigType("yaml")
-		viper.SetConfigName("providermapping")
-		viper.AddConfigPath("$HOME/.cnabrp")
-		viper.AddConfigPath(".")
-		err := viper.ReadInConfig()
-		if err != nil {
-			log.Errorf("Error reading config file: %v \n", err)
-			return err
-		}
-		err = viper.Unmarshal(&mappingConfiguration)
+		mappings, err := ReadMappings("")
 		if err != nil {
-			log.Errorf("Error decoding config file: %v \n", err)
 			return err
 		}
 
-		for _, m := range mappingConfiguration.Mappings {
+		providers := make(map[string]*BundleInformation)
+		for _, m := range mappings {
 			log.Debugf("Processing Mapping for Provider %s Type %s Tag %s", m.Provider, m.Type, m.Tag)
-			bundleInformation, err := getBundleInfo(m.Provider, m.Type, m.Tag, m.ForcePull, m.AllowInsecureRegistry)
+			bundleInformation, err := LoadBundleInformation(m)
 			if err != nil {
 				return err
 			}
 			rpType := GetRPName(m.Provider, m.Type)
-			RPToProvider[rpType] = bundleInformation
+			providers[rpType] = bundleInformation
 		}
+		setProviders(mappings, providers)
 
 	} else {
 		log.Debug("Running as CustomRP Endpoint")
-		resourceProviderName := "Microsoft.CustomProviders"
+		resourceProviderName := CustomRPProvider
 
-		bundleTag, ok := OptionalSettings["BundleTag"].(string)
-		if !ok || len(bundleTag) == 0 {
+		m := Mapping{
+			Provider:              resourceProviderName,
+			Type:                  resourceTypeName,
+			Tag:                   OptionalSettings["BundleTag"].(string),
+			ForcePull:             OptionalSettings["ForcePull"].(bool),
+			AllowInsecureRegistry: OptionalSettings["AllowInsecureRegistry"].(bool),
+		}
+		if _, ok := LocalBundleFile(m); !ok && len(m.Tag) == 0 {
 			return errors.New("Environment Variable CNAB_BUNDLE_TAG should be set when running as Custom RP ")
 		}
 
-		bundleInformation, err := getBundleInfo(resourceProviderName, resourceTypeName, bundleTag, OptionalSettings["ForcePull"].(bool), OptionalSettings["AllowInsecureRegistry"].(bool))
+		bundleInformation, err := LoadBundleInformation(m)
 		if err != nil {
 			return err
 		}
 		rpType := GetRPName(resourceProviderName, resourceTypeName)
-		RPToProvider[rpType] = bundleInformation
+		setProviders(nil, map[string]*BundleInformation{rpType: bundleInformation})
 		log.Debugf("Processing Requests for Type %s Tag %s", bundleInformation.ResourceType, bundleInformation.BundlePullOptions.Tag)
 	}
 
-	LogRequestBody = OptionalSettings["LogRequestBody"].(bool)
-	LogResponseBody = OptionalSettings["LogResponseBody"].(bool)
+	return nil
+}
 
+// CheckBundlesLoaded returns an error if the bundle for any of the configured resource types has not been loaded
+func CheckBundlesLoaded() error {
+	var rpTypes []string
+	if IsRPaaS {
+		for _, m := range currentMappings() {
+			rpTypes = append(rpTypes, GetRPName(m.Provider, m.Type))
+		}
+	} else {
+		rpTypes = append(rpTypes, GetRPName(CustomRPProvider, OptionalSettings["ResourceType"].(string)))
+	}
+	if len(rpTypes) == 0 {
+		return errors.New("No resource types are configured")
+	}
+	providers := Providers()
+	for _, rpType := range rpTypes {
+		if bundleInfo, ok := providers[rpType]; !ok || bundleInfo.RPBundle == nil {
+			return fmt.Errorf("Bundle for %s is not loaded", rpType)
+		}
+	}
 	return nil
 }
 
+// LoadEnvironment reads the settings from the environment without loading any bundles
+func LoadEnvironment() error {
+	if environmentLoaded {
+		return nil
+	}
+	loadOptionalSettings()
+	if err := checkRetentionSettings(); err != nil {
+		return err
+	}
+	for k, v := range RequiredSettings {
+		val := os.Getenv(v)
+		if len(val) == 0 {
+			return fmt.Errorf("Environment Variable %s is not set", v)
+		}
+		RequiredSettings[k] = strings.TrimSpace(val)
+	}
+	environmentLoaded = true
+
+	return nil
+}
+
+// checkRetentionSettings returns an error if the async operation retention policy is set to a value that cannot be used, the policy would otherwise be silently disabled
+func checkRetentionSettings() error {
+	for _, k := range []string{"AsyncOpRetentionDays", "AsyncOpRetentionCount", "AsyncOpSweepInterval"} {
+		if err, ok := invalidOptionalSettings[k]; ok {
+			return err
+		}
+	}
+	if AsyncOpRetentionDays < 0 || AsyncOpRetentionCount < 0 {
+		return errors.New("Environment Variables ASYNC_OP_RETENTION_DAYS and ASYNC_OP_RETENTION_COUNT should not be negative")
+	}
+	return nil
+}
+
+// loadOptionalSettings replaces the variable name and type of each optional setting with its value, settings that are not set or cannot be parsed get the zero value of the type and settings that cannot be parsed are logged
+func loadOptionalSettings() {
+	if optionalSettingsLoaded {
+		return
+	}
+	for k, v := range OptionalSettings {
+		parts := strings.Split(v.(string), ":")
+		val := os.Getenv(parts[0])
+		var err error
+		switch parts[1] {
+		case "bool":
+			var boolVal bool
+			boolVal, err = strconv.ParseBool(val)
+			OptionalSettings[k] = boolVal
+		case "string":
+			OptionalSettings[k] = strings.TrimSpace(val)
+		case "int":
+			var intVal int
+			intVal, err = strconv.Atoi(strings.TrimSpace(val))
+			OptionalSettings[k] = intVal
+		case "duration":
+			var durationVal time.Duration
+			durationVal, err = time.ParseDuration(strings.TrimSpace(val))
+			OptionalSettings[k] = durationVal
+		default:
+			OptionalSettings[k] = false
+		}
+		if err != nil && len(strings.TrimSpace(val)) > 0 {
+			invalidOptionalSettings[k] = fmt.Errorf("Environment Variable %s should be a %s: %v", parts[0], parts[1], err)
+			log.Warnf("Environment Variable %s should be a %s, it is ignored: %v", parts[0], parts[1], err)
+		}
+	}
+
+	IsRPaaS = OptionalSettings["IsRPaaS"].(bool)
+	LogRequestBody = OptionalSettings["LogRequestBody"].(bool)
+	LogResponseBody = OptionalSettings["LogResponseBody"].(bool)
+	AsyncOpRetentionDays = OptionalSettings["AsyncOpRetentionDays"].(int)
+	AsyncOpRetentionCount = OptionalSettings["AsyncOpRetentionCount"].(int)
+	AsyncOpSweepInterval = OptionalSettings["AsyncOpSweepInterval"].(time.Duration)
+	if AsyncOpSweepInterval <= 0 {
+		AsyncOpSweepInterval = defaultAsyncOpSweepInterval
+	}
+	ShutdownGracePeriod = OptionalSettings["ShutdownGracePeriod"].(time.Duration)
+	if ShutdownGracePeriod <= 0 {
+		ShutdownGracePeriod = defaultShutdownGracePeriod
+	}
+	Driver = OptionalSettings["Driver"].(string)
+	if len(Driver) == 0 {
+		Driver = DefaultDriver
+	}
+	optionalSettingsLoaded = true
+}
+
 func getBundleInfo(resourceProviderName string, resourceTypeName string, bundleTag string, force bool, allowInsecureRegistry bool) (*BundleInformation, error) {
+	bundleInformation, err := newBundleInfo(resourceProviderName, resourceTypeName, bundleTag, force, allowInsecureRegistry)
+	if err != nil {
+		return nil, err
+	}
+	if err := pullBundle(bundleInformation); err != nil {
+		log.Errorf("Error pulling bundle %v", err)
+		return nil, err
+	}
+	return bundleInformation, nil
+}
+
+// newBundleInfo returns the bundle information for a resource type without the bundle
+func newBundleInfo(resourceProviderName string, resourceTypeName string, bundleTag string, force bool, allowInsecureRegistry bool) (*BundleInformation, error) {
 
 	bundleInformation := BundleInformation{
 		ResourceProvider: resourceProviderName,
@@ -168,13 +334,37 @@ func getBundleInfo(resourceProviderName string, resourceTypeName string, bundleT
 		Force:            force,
 		InsecureRegistry: allowInsecureRegistry,
 	}
+	return &bundleInformation, nil
 
-	if err := pullBundle(&bundleInformation); err != nil {
-		log.Errorf("Error pulling bundle %v", err)
-		return nil, err
+}
+
+// ReadMappings reads the resource type to bundle mappings from configFile, if configFile is empty providermapping.yaml is read from $HOME/.cnabrp or the current directory
+func ReadMappings(configFile string) ([]Mapping, error) {
+	if len(configFile) > 0 {
+		viper.SetConfigFile(configFile)
+	} else {
+		viper.SetConfigType("yaml")
+		viper.SetConfigName("providermapping")
+		viper.AddConfigPath("$HOME/.cnabrp")
+		viper.AddConfigPath(".")
 	}
-	return &bundleInformation, nil
+	return readMappings(viper.GetViper())
+}
 
+// readMappings reads the mappings from the config file set on v
+func readMappings(v *viper.Viper) ([]Mapping, error) {
+	err := v.ReadInConfig()
+	if err != nil {
+		log.Errorf("Error reading config file: %v \n", err)
+		return nil, err
+	}
+	var config Config
+	err = v.Unmarshal(&config)
+	if err != nil {
+		log.Errorf("Error decoding config file: %v \n", err)
+		return nil, err
+	}
+	return config.Mappings, nil
 }
 
 // GetRPName returns the RP Name
@@ -198,7 +388,18 @@ func pullBundle(bundleInfo *BundleInformation) error {
 	if err != nil {
 		return fmt.Errorf("Unable to pull remote bundle %w", err)
 	}
-	bundleInfo.RPBundle = bundle
+	return setBundle(bundleInfo, bundle)
+}
+
+// setBundle sets the bundle and its digest, the digest of the canonical bundle json identifies the version of the bundle that was loaded
+func setBundle(bundleInfo *BundleInformation, rpBundle *bundle.Bundle) error {
+	bundleInfo.RPBundle = rpBundle
+	var buf bytes.Buffer
+	if _, err := rpBundle.WriteTo(&buf); err != nil {
+		return fmt.Errorf("Unable to serialise bundle %w", err)
+	}
+	bundleInfo.BundleDigest = fmt.Sprintf("sha256:%x", sha256.Sum256(buf.Bytes()))
+	log.Debugf("Bundle Digest: %s", bundleInfo.BundleDigest)
 	return nil
 }
 
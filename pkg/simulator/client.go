@@ -0,0 +1,285 @@
+// Package simulator sends requests to the handler the way ARM does and checks the responses against the ARM RPC contract, it is used to exercise the handler without deploying it behind ARM
+package simulator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/auth"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/helpers"
+)
+
+const (
+	userAgent = "cnab-custom-resource-handler-simulator"
+	// defaultRetryAfter is how long to wait between polls if a response does not have a Retry-After header
+	defaultRetryAfter = 10 * time.Second
+	defaultTimeout    = 30 * time.Minute
+)
+
+// Config contains the settings for the simulated ARM client
+type Config struct {
+	// Endpoint is the base URL of the handler such as http://localhost:8080
+	Endpoint       string
+	SubscriptionId string
+	ResourceGroup  string
+	Location       string
+	APIVersion     string
+	// RPaaS adds the headers that RPaaS adds to requests, otherwise the headers that Custom Providers add are sent
+	RPaaS               bool
+	TenantId            string
+	ClientObjectId      string
+	ClientPrincipalName string
+	// APIKey and BearerToken authenticate requests when the handler is configured with API key or JWT authentication
+	APIKey      string
+	BearerToken string
+	// MaxRetryAfter caps the time waited between polls, zero honours the Retry-After header
+	MaxRetryAfter time.Duration
+	// Timeout is how long to poll an async operation for
+	Timeout    time.Duration
+	HTTPClient *http.Client
+	// Log receives a line for each request and response, it can be nil
+	Log io.Writer
+}
+
+// Client sends ARM requests to the handler
+type Client struct {
+	config Config
+	http   *http.Client
+	// sleep waits between polls, it returns early if the context is done
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// Response is a response from the handler
+type Response struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// NewClient returns a client for the handler, unset settings get defaults
+func NewClient(config Config) *Client {
+	if len(config.APIVersion) == 0 {
+		config.APIVersion = helpers.APIVersion
+	}
+	if len(config.Location) == 0 {
+		config.Location = "eastus"
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultTimeout
+	}
+	if len(config.TenantId) == 0 {
+		config.TenantId = uuid.Nil.String()
+	}
+	if len(config.ClientObjectId) == 0 {
+		config.ClientObjectId = uuid.Nil.String()
+	}
+	if len(config.ClientPrincipalName) == 0 {
+		config.ClientPrincipalName = "simulator@example.com"
+	}
+	httpClient := config.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: time.Minute}
+	}
+	config.Endpoint = strings.TrimSuffix(config.Endpoint, "/")
+	return &Client{
+		config: config,
+		http:   httpClient,
+		sleep:  sleep,
+	}
+}
+
+// Config returns the settings the client uses including defaults
+func (c *Client) Config() Config {
+	return c.config
+}
+
+// Do sends a request for the resource path, correlationId should be the same for every request that is part of one operation
+func (c *Client) Do(ctx context.Context, method string, path string, body interface{}, correlationId string) (*Response, error) {
+	requestURL := fmt.Sprintf("%s%s?api-version=%s", c.config.Endpoint, path, url.QueryEscape(c.config.APIVersion))
+	return c.do(ctx, method, requestURL, path, body, correlationId)
+}
+
+func (c *Client) do(ctx context.Context, method string, requestURL string, path string, body interface{}, correlationId string) (*Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to serialise request body: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, requestURL, reader)
+	if err != nil {
+		return nil, err
+	}
+	c.setHeaders(req, path, correlationId)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s failed: %w", method, requestURL, err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read response to %s %s: %w", method, requestURL, err)
+	}
+	response := &Response{
+		Method:     method,
+		URL:        requestURL,
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       data,
+	}
+	c.logf("%s %s -> %d%s", method, requestURL, resp.StatusCode, retryAfterText(resp.Header))
+	return response, nil
+}
+
+// setHeaders sets the headers that ARM adds when it forwards a request to a resource provider
+func (c *Client) setHeaders(req *http.Request, path string, correlationId string) {
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Accept-Language", "en-US")
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Referer", req.URL.String())
+	req.Header.Set("X-Ms-Correlation-Request-Id", correlationId)
+	req.Header.Set("X-Ms-Client-Request-Id", uuid.New().String())
+	req.Header.Set("X-Ms-Client-Tenant-Id", c.config.TenantId)
+	req.Header.Set("X-Ms-Client-Object-Id", c.config.ClientObjectId)
+	req.Header.Set("X-Ms-Client-Principal-Name", c.config.ClientPrincipalName)
+	if c.config.RPaaS {
+		req.Header.Set("X-Ms-Home-Tenant-Id", c.config.TenantId)
+	} else {
+		req.Header.Set("X-Ms-CustomProviders-RequestPath", path)
+	}
+	if len(c.config.APIKey) > 0 {
+		req.Header.Set(auth.APIKeyHeader, c.config.APIKey)
+	}
+	if len(c.config.BearerToken) > 0 {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.config.BearerToken))
+	}
+}
+
+// Poll follows the Azure-AsyncOperation header of the response or the Location header if there is no Azure-AsyncOperation header until the operation finishes, waiting for the time in the Retry-After header between requests. It returns every poll response, the last one is the final result
+func (c *Client) Poll(ctx context.Context, resp *Response, correlationId string) ([]*Response, error) {
+	pollURL := resp.Header.Get("Azure-AsyncOperation")
+	asyncOperation := len(pollURL) > 0
+	if !asyncOperation {
+		pollURL = resp.Header.Get("Location")
+	}
+	if len(pollURL) == 0 {
+		return nil, fmt.Errorf("%s %s returned %d without an Azure-AsyncOperation or Location header", resp.Method, resp.URL, resp.StatusCode)
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.config.Timeout)
+	defer cancel()
+	var responses []*Response
+	previous := resp
+	for {
+		if err := c.sleep(ctx, c.retryAfter(previous)); err != nil {
+			return responses, fmt.Errorf("Operation did not finish within %v: %w", c.config.Timeout, err)
+		}
+		parsed, err := url.Parse(pollURL)
+		if err != nil {
+			return responses, fmt.Errorf("Invalid poll URL %s: %w", pollURL, err)
+		}
+		// the handler builds the poll URL from the host header it received, the request is sent to the configured endpoint so that the simulator works through port forwards and proxies
+		next, err := c.do(ctx, http.MethodGet, c.pollRequestURL(parsed), parsed.Path, nil, correlationId)
+		if err != nil {
+			return responses, err
+		}
+		responses = append(responses, next)
+		if next.StatusCode != http.StatusAccepted {
+			if !asyncOperation || next.StatusCode != http.StatusOK || IsTerminalStatus(operationStatus(next)) {
+				return responses, nil
+			}
+		}
+		if location := next.Header.Get("Location"); len(location) > 0 && !asyncOperation {
+			pollURL = location
+		}
+		previous = next
+	}
+}
+
+func (c *Client) pollRequestURL(pollURL *url.URL) string {
+	endpoint, err := url.Parse(c.config.Endpoint)
+	if err != nil {
+		return pollURL.String()
+	}
+	requestURL := *pollURL
+	requestURL.Scheme = endpoint.Scheme
+	requestURL.Host = endpoint.Host
+	requestURL.Path = strings.TrimSuffix(endpoint.Path, "/") + pollURL.Path
+	return requestURL.String()
+}
+
+// retryAfter returns the time to wait before the next poll capped at MaxRetryAfter
+func (c *Client) retryAfter(resp *Response) time.Duration {
+	wait := defaultRetryAfter
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+		wait = time.Duration(seconds) * time.Second
+	}
+	if c.config.MaxRetryAfter > 0 && wait > c.config.MaxRetryAfter {
+		wait = c.config.MaxRetryAfter
+	}
+	return wait
+}
+
+func (c *Client) logf(format string, args ...interface{}) {
+	if c.config.Log != nil {
+		fmt.Fprintf(c.config.Log, format+"\n", args...)
+	}
+}
+
+// JSON returns the body of the response decoded as a JSON object, it returns nil if the body is not an object
+func (r *Response) JSON() map[string]interface{} {
+	var body map[string]interface{}
+	if err := json.Unmarshal(r.Body, &body); err != nil {
+		return nil
+	}
+	return body
+}
+
+// IsTerminalStatus returns true if the status of an async operation or provisioning state is terminal
+func IsTerminalStatus(status string) bool {
+	for _, s := range []string{helpers.StatusSucceeded, helpers.StatusFailed, "Canceled"} {
+		if strings.EqualFold(status, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func operationStatus(resp *Response) string {
+	status, _ := resp.JSON()["status"].(string)
+	return status
+}
+
+func retryAfterText(header http.Header) string {
+	if retryAfter := header.Get("Retry-After"); len(retryAfter) > 0 {
+		return fmt.Sprintf(" (Retry-After %s)", retryAfter)
+	}
+	return ""
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
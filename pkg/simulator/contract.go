@@ -0,0 +1,279 @@
+package simulator
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// The ARM RPC rules that responses are checked against (see https://github.com/Azure/azure-resource-manager-rpc/blob/master/v1.0/resource-api-reference.md and https://github.com/Azure/azure-resource-manager-rpc/blob/master/v1.0/async-api-reference.md)
+const (
+	RulePutStatus         = "put-status"
+	RuleDeleteStatus      = "delete-status"
+	RulePostStatus        = "post-status"
+	RuleGetStatus         = "get-status"
+	RuleResourceBody      = "resource-body"
+	RuleProvisioningState = "provisioning-state"
+	RuleAsyncHeader       = "async-header"
+	RuleRetryAfter        = "retry-after"
+	RuleOperationStatus   = "operation-status"
+	RuleErrorBody         = "error-body"
+	RuleNotFound          = "not-found"
+	RuleListEnvelope      = "list-envelope"
+	RuleContentType       = "content-type"
+)
+
+// Violation is a response that does not follow an ARM RPC rule
+type Violation struct {
+	Rule    string
+	Request string
+	Message string
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%s: %s: %s", v.Rule, v.Request, v.Message)
+}
+
+func violation(resp *Response, rule string, format string, args ...interface{}) Violation {
+	return Violation{
+		Rule:    rule,
+		Request: fmt.Sprintf("%s %s", resp.Method, resp.URL),
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+// CheckPut checks the response to a PUT, a resource that is not in a terminal provisioning state must return an Azure-AsyncOperation header to track the operation
+func CheckPut(resp *Response, resourceId string) []Violation {
+	if resp.StatusCode >= 400 {
+		return CheckError(resp)
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return []Violation{violation(resp, RulePutStatus, "status should be 200 or 201 but is %d", resp.StatusCode)}
+	}
+	violations := CheckResource(resp, resourceId)
+	state, ok := ProvisioningState(resp)
+	if ok && !IsTerminalStatus(state) {
+		violations = append(violations, checkAsyncURL(resp, "Azure-AsyncOperation")...)
+		violations = append(violations, checkRetryAfter(resp)...)
+	}
+	return violations
+}
+
+// CheckGet checks the response to a GET of a resource
+func CheckGet(resp *Response, resourceId string) []Violation {
+	if resp.StatusCode >= 400 {
+		return CheckError(resp)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return []Violation{violation(resp, RuleGetStatus, "status should be 200 but is %d", resp.StatusCode)}
+	}
+	return CheckResource(resp, resourceId)
+}
+
+// CheckDelete checks the response to a DELETE, 202 must return a Location header to track the operation
+func CheckDelete(resp *Response) []Violation {
+	if resp.StatusCode >= 400 {
+		return CheckError(resp)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return nil
+	case http.StatusAccepted:
+		return append(checkAsyncURL(resp, "Location"), checkRetryAfter(resp)...)
+	default:
+		return []Violation{violation(resp, RuleDeleteStatus, "status should be 200, 202 or 204 but is %d", resp.StatusCode)}
+	}
+}
+
+// CheckPost checks the response to a POST action, 202 must return a Location or Azure-AsyncOperation header to track the operation
+func CheckPost(resp *Response) []Violation {
+	if resp.StatusCode >= 400 {
+		return CheckError(resp)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return nil
+	case http.StatusAccepted:
+		header := "Location"
+		if len(resp.Header.Get("Azure-AsyncOperation")) > 0 {
+			header = "Azure-AsyncOperation"
+		}
+		return append(checkAsyncURL(resp, header), checkRetryAfter(resp)...)
+	default:
+		return []Violation{violation(resp, RulePostStatus, "status should be 200, 202 or 204 but is %d", resp.StatusCode)}
+	}
+}
+
+// CheckOperation checks a response to a poll of an async operation, asyncOperation is true if the poll URL came from an Azure-AsyncOperation header which must return 200 with the status of the operation
+func CheckOperation(resp *Response, asyncOperation bool) []Violation {
+	if resp.StatusCode >= 400 {
+		return CheckError(resp)
+	}
+	var violations []Violation
+	if resp.StatusCode == http.StatusAccepted {
+		violations = append(violations, checkRetryAfter(resp)...)
+		if !asyncOperation {
+			return append(violations, checkAsyncURL(resp, "Location")...)
+		}
+	}
+	if !asyncOperation {
+		return violations
+	}
+	body := resp.JSON()
+	status, ok := body["status"].(string)
+	if !ok || len(status) == 0 {
+		return append(violations, violation(resp, RuleOperationStatus, "operation should have a status"))
+	}
+	if IsTerminalStatus(status) && resp.StatusCode != http.StatusOK {
+		violations = append(violations, violation(resp, RuleOperationStatus, "status should be 200 for a %s operation but is %d", status, resp.StatusCode))
+	}
+	if strings.EqualFold(status, "Failed") {
+		violations = append(violations, checkErrorObject(resp, body["error"])...)
+	}
+	return violations
+}
+
+// CheckList checks the response to a LIST, resources are returned in the value array of an envelope
+func CheckList(resp *Response, collectionId string) []Violation {
+	if resp.StatusCode >= 400 {
+		return CheckError(resp)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return []Violation{violation(resp, RuleGetStatus, "status should be 200 but is %d", resp.StatusCode)}
+	}
+	violations := checkContentType(resp)
+	body := resp.JSON()
+	value, ok := body["value"].([]interface{})
+	if !ok {
+		return append(violations, violation(resp, RuleListEnvelope, "body should be an object with a value array"))
+	}
+	for i, v := range value {
+		resource, ok := v.(map[string]interface{})
+		if !ok {
+			violations = append(violations, violation(resp, RuleListEnvelope, "value %d should be an object", i))
+			continue
+		}
+		id, _ := resource["id"].(string)
+		if !strings.HasPrefix(strings.ToLower(id), strings.ToLower(collectionId)+"/") {
+			violations = append(violations, violation(resp, RuleResourceBody, "value %d id %q should be in collection %s", i, id, collectionId))
+		}
+		for _, name := range []string{"name", "type"} {
+			if s, _ := resource[name].(string); len(s) == 0 {
+				violations = append(violations, violation(resp, RuleResourceBody, "value %d should have a %s", i, name))
+			}
+		}
+	}
+	return violations
+}
+
+// CheckNotFound checks that a resource that does not exist returns 404 with an error body
+func CheckNotFound(resp *Response) []Violation {
+	if resp.StatusCode != http.StatusNotFound {
+		return []Violation{violation(resp, RuleNotFound, "status should be 404 for a resource that does not exist but is %d", resp.StatusCode)}
+	}
+	return CheckError(resp)
+}
+
+// CheckError checks that an error response has a body with an error object containing a code and message
+func CheckError(resp *Response) []Violation {
+	body := resp.JSON()
+	if body == nil {
+		return []Violation{violation(resp, RuleErrorBody, "%d response should have a JSON body with an error object", resp.StatusCode)}
+	}
+	return checkErrorObject(resp, body["error"])
+}
+
+func checkErrorObject(resp *Response, v interface{}) []Violation {
+	errorObject, ok := v.(map[string]interface{})
+	if !ok {
+		return []Violation{violation(resp, RuleErrorBody, "body should have an error object")}
+	}
+	var violations []Violation
+	for _, name := range []string{"code", "message"} {
+		if s, _ := errorObject[name].(string); len(s) == 0 {
+			violations = append(violations, violation(resp, RuleErrorBody, "error should have a %s", name))
+		}
+	}
+	return violations
+}
+
+// CheckResource checks that the body of a response is the resource with the id in the request
+func CheckResource(resp *Response, resourceId string) []Violation {
+	violations := checkContentType(resp)
+	body := resp.JSON()
+	if body == nil {
+		return append(violations, violation(resp, RuleResourceBody, "body should be a JSON object"))
+	}
+	id, _ := body["id"].(string)
+	if !strings.EqualFold(id, resourceId) {
+		violations = append(violations, violation(resp, RuleResourceBody, "id should be %s but is %q", resourceId, id))
+	}
+	name, _ := body["name"].(string)
+	if !strings.EqualFold(name, resourceId[strings.LastIndex(resourceId, "/")+1:]) {
+		violations = append(violations, violation(resp, RuleResourceBody, "name should be the last segment of the id but is %q", name))
+	}
+	if t, _ := body["type"].(string); len(t) == 0 {
+		violations = append(violations, violation(resp, RuleResourceBody, "body should have a type"))
+	}
+	if _, ok := ProvisioningState(resp); !ok {
+		violations = append(violations, violation(resp, RuleProvisioningState, "properties should have a provisioningState"))
+	}
+	return violations
+}
+
+// ProvisioningState returns the provisioning state in the properties of a resource, property names are compared case insensitively as they are by ARM
+func ProvisioningState(resp *Response) (string, bool) {
+	properties, ok := resp.JSON()["properties"].(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	for k, v := range properties {
+		if strings.EqualFold(k, "provisioningState") {
+			state, ok := v.(string)
+			return state, ok
+		}
+	}
+	return "", false
+}
+
+// checkAsyncURL checks that the header is an absolute URL
+func checkAsyncURL(resp *Response, header string) []Violation {
+	value := resp.Header.Get(header)
+	if len(value) == 0 {
+		return []Violation{violation(resp, RuleAsyncHeader, "%d response should have a %s header", resp.StatusCode, header)}
+	}
+	parsed, err := url.Parse(value)
+	if err != nil || !parsed.IsAbs() || len(parsed.Host) == 0 {
+		return []Violation{violation(resp, RuleAsyncHeader, "%s header %q should be an absolute URL", header, value)}
+	}
+	if len(parsed.Query().Get("api-version")) == 0 {
+		return []Violation{violation(resp, RuleAsyncHeader, "%s header %q should have an api-version", header, value)}
+	}
+	return nil
+}
+
+// checkRetryAfter checks that the Retry-After header is a number of seconds if it is set
+func checkRetryAfter(resp *Response) []Violation {
+	value := resp.Header.Get("Retry-After")
+	if len(value) == 0 {
+		return nil
+	}
+	if seconds, err := strconv.Atoi(value); err != nil || seconds < 0 {
+		return []Violation{violation(resp, RuleRetryAfter, "Retry-After %q should be a number of seconds", value)}
+	}
+	return nil
+}
+
+func checkContentType(resp *Response) []Violation {
+	if len(resp.Body) == 0 {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return []Violation{violation(resp, RuleContentType, "Content-Type should be application/json but is %q", resp.Header.Get("Content-Type"))}
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package simulator
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg/helpers"
+)
+
+// Simulator runs the ARM flows for a resource against the handler and checks each response against the ARM RPC contract
+type Simulator struct {
+	client *Client
+}
+
+// Result is the outcome of a flow
+type Result struct {
+	Responses  []*Response
+	Violations []Violation
+	// Status is the provisioning state of the resource or the status of the operation at the end of the flow
+	Status string
+}
+
+// New returns a Simulator that uses the client
+func New(client *Client) *Simulator {
+	return &Simulator{client: client}
+}
+
+func (r *Result) add(resp *Response, violations []Violation) {
+	r.Responses = append(r.Responses, resp)
+	r.Violations = append(r.Violations, violations...)
+}
+
+func (r *Result) merge(other *Result) {
+	r.Responses = append(r.Responses, other.Responses...)
+	r.Violations = append(r.Violations, other.Violations...)
+	r.Status = other.Status
+}
+
+func (s *Simulator) resourceId(resource Resource) string {
+	config := s.client.Config()
+	return resource.ResourceId(config.SubscriptionId, config.ResourceGroup)
+}
+
+// Put creates or updates the resource, polls the operation until it finishes and then gets the resource
+func (s *Simulator) Put(ctx context.Context, resource Resource) (*Result, error) {
+	resourceId := s.resourceId(resource)
+	correlationId := uuid.New().String()
+	location := resource.Location
+	if len(location) == 0 {
+		location = s.client.Config().Location
+	}
+	body := map[string]interface{}{
+		"location":   location,
+		"properties": resource.Properties,
+	}
+	resp, err := s.client.Do(ctx, http.MethodPut, resourceId, body, correlationId)
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{}
+	result.add(resp, CheckPut(resp, resourceId))
+	if resp.StatusCode >= 400 {
+		result.Status = fmt.Sprintf("%d", resp.StatusCode)
+		return result, nil
+	}
+	state, _ := ProvisioningState(resp)
+	result.Status = state
+	if IsTerminalStatus(state) || len(resp.Header.Get("Azure-AsyncOperation")) == 0 {
+		return result, nil
+	}
+	if err := s.poll(ctx, resp, correlationId, result); err != nil {
+		return result, err
+	}
+	get, err := s.Get(ctx, resource)
+	if err != nil {
+		return result, err
+	}
+	result.merge(get)
+	return result, nil
+}
+
+// Get gets the resource
+func (s *Simulator) Get(ctx context.Context, resource Resource) (*Result, error) {
+	resourceId := s.resourceId(resource)
+	resp, err := s.client.Do(ctx, http.MethodGet, resourceId, nil, uuid.New().String())
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{}
+	result.add(resp, CheckGet(resp, resourceId))
+	result.Status, _ = ProvisioningState(resp)
+	if resp.StatusCode >= 400 {
+		result.Status = fmt.Sprintf("%d", resp.StatusCode)
+	}
+	return result, nil
+}
+
+// GetMissing gets a resource of the same type that does not exist and checks that it is not found
+func (s *Simulator) GetMissing(ctx context.Context, resource Resource) (*Result, error) {
+	missing := resource
+	missing.Name = fmt.Sprintf("%s-%s", resource.Name, uuid.New().String()[:8])
+	resp, err := s.client.Do(ctx, http.MethodGet, s.resourceId(missing), nil, uuid.New().String())
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{Status: fmt.Sprintf("%d", resp.StatusCode)}
+	result.add(resp, CheckNotFound(resp))
+	return result, nil
+}
+
+// List lists the resources in the collection that the resource is in
+func (s *Simulator) List(ctx context.Context, resource Resource) (*Result, error) {
+	config := s.client.Config()
+	collectionId := resource.CollectionId(config.SubscriptionId, config.ResourceGroup)
+	resp, err := s.client.Do(ctx, http.MethodGet, collectionId, nil, uuid.New().String())
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{Status: fmt.Sprintf("%d", resp.StatusCode)}
+	result.add(resp, CheckList(resp, collectionId))
+	return result, nil
+}
+
+// Post invokes an action on the resource and polls the operation until it finishes, body can be nil
+func (s *Simulator) Post(ctx context.Context, resource Resource, action string, body interface{}) (*Result, error) {
+	correlationId := uuid.New().String()
+	resp, err := s.client.Do(ctx, http.MethodPost, fmt.Sprintf("%s/%s", s.resourceId(resource), action), body, correlationId)
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{Status: fmt.Sprintf("%d", resp.StatusCode)}
+	result.add(resp, CheckPost(resp))
+	if resp.StatusCode != http.StatusAccepted {
+		return result, nil
+	}
+	return result, s.poll(ctx, resp, correlationId, result)
+}
+
+// Delete deletes the resource, polls the operation until it finishes and then checks that the resource is not found
+func (s *Simulator) Delete(ctx context.Context, resource Resource) (*Result, error) {
+	resourceId := s.resourceId(resource)
+	correlationId := uuid.New().String()
+	resp, err := s.client.Do(ctx, http.MethodDelete, resourceId, nil, correlationId)
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{Status: fmt.Sprintf("%d", resp.StatusCode)}
+	result.add(resp, CheckDelete(resp))
+	if resp.StatusCode >= 400 {
+		return result, nil
+	}
+	if resp.StatusCode == http.StatusAccepted {
+		if err := s.poll(ctx, resp, correlationId, result); err != nil {
+			return result, err
+		}
+		// a Location poll that finished returns 200 or 204 which may not have a body, the resource is only kept if the operation did not succeed
+		if strings.EqualFold(result.Status, helpers.StatusFailed) || strings.EqualFold(result.Status, "Canceled") {
+			return result, nil
+		}
+	}
+	get, err := s.client.Do(ctx, http.MethodGet, resourceId, nil, uuid.New().String())
+	if err != nil {
+		return result, err
+	}
+	result.add(get, CheckNotFound(get))
+	return result, nil
+}
+
+// Lifecycle runs the flows that ARM runs over the life of a resource: get before it exists, create, get, list and delete
+func (s *Simulator) Lifecycle(ctx context.Context, resource Resource) (*Result, error) {
+	result := &Result{}
+	steps := []func(ctx context.Context, resource Resource) (*Result, error){
+		s.GetMissing,
+		s.Put,
+		s.Get,
+		s.List,
+		s.Delete,
+	}
+	for _, step := range steps {
+		stepResult, err := step(ctx, resource)
+		if stepResult != nil {
+			result.merge(stepResult)
+		}
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// poll follows the async headers of the response and sets the result status to the status of the operation
+func (s *Simulator) poll(ctx context.Context, resp *Response, correlationId string, result *Result) error {
+	asyncOperation := len(resp.Header.Get("Azure-AsyncOperation")) > 0
+	responses, err := s.client.Poll(ctx, resp, correlationId)
+	for _, poll := range responses {
+		result.add(poll, CheckOperation(poll, asyncOperation))
+	}
+	if err != nil {
+		return err
+	}
+	if len(responses) > 0 {
+		last := responses[len(responses)-1]
+		result.Status = operationStatus(last)
+		if len(result.Status) == 0 {
+			result.Status = fmt.Sprintf("%d", last.StatusCode)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,409 @@
+package simulator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// Resource is a resource read from a template
+type Resource struct {
+	// Type is the full resource type such as Microsoft.CustomProviders/resourceProviders/installs
+	Type string
+	// Name is the full resource name with a segment for each nested type such as provider/install
+	Name       string
+	Location   string
+	Properties map[string]interface{}
+}
+
+type template struct {
+	Parameters map[string]templateParameter `json:"parameters"`
+	Variables  map[string]interface{}       `json:"variables"`
+	Resources  []templateResource           `json:"resources"`
+}
+
+type templateParameter struct {
+	Type         string      `json:"type"`
+	DefaultValue interface{} `json:"defaultValue"`
+}
+
+type templateResource struct {
+	Type       string                 `json:"type"`
+	Name       string                 `json:"name"`
+	Location   string                 `json:"location"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// TemplateValues are the values used to evaluate the expressions in a template
+type TemplateValues struct {
+	// Parameters are the values of the template parameters, parameters that are not set use their default value
+	Parameters map[string]string
+	// Overrides replace properties before they are evaluated keyed by dotted path such as credentials.kubeconfig, they are used for expressions that cannot be evaluated outside of ARM
+	Overrides map[string]interface{}
+	// ResourceGroup and Location are returned by resourceGroup(), SubscriptionId is returned by subscription()
+	ResourceGroup  string
+	Location       string
+	SubscriptionId string
+}
+
+// ReadResources reads the resources from a deployment template, the parameters, variables, concat, resourceGroup and subscription functions are evaluated, any other function is an error unless the property is overridden
+func ReadResources(file string, values TemplateValues) ([]Resource, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read template %s: %w", file, err)
+	}
+	var t template
+	if err := json.Unmarshal(data, &t); err != nil {
+		return nil, fmt.Errorf("Unable to parse template %s: %w", file, err)
+	}
+	if len(t.Resources) == 0 {
+		return nil, fmt.Errorf("Template %s has no resources", file)
+	}
+	e := &evaluator{
+		template: &t,
+		values:   values,
+	}
+	resources := make([]Resource, 0, len(t.Resources))
+	for i, r := range t.Resources {
+		properties := r.Properties
+		if properties == nil {
+			properties = make(map[string]interface{})
+		}
+		for path, value := range values.Overrides {
+			setPath(properties, strings.Split(path, "."), value)
+		}
+		resource := Resource{
+			Type: r.Type,
+		}
+		if resource.Name, err = e.evaluateString(r.Name); err != nil {
+			return nil, fmt.Errorf("resource %d name: %w", i, err)
+		}
+		if resource.Location, err = e.evaluateString(r.Location); err != nil {
+			return nil, fmt.Errorf("resource %s location: %w", resource.Name, err)
+		}
+		evaluated, err := e.evaluateValue(properties)
+		if err != nil {
+			return nil, fmt.Errorf("resource %s properties: %w", resource.Name, err)
+		}
+		resource.Properties = evaluated.(map[string]interface{})
+		if len(strings.Split(resource.Type, "/")) != len(strings.Split(resource.Name, "/"))+1 {
+			return nil, fmt.Errorf("resource %s should have a name segment for each type segment of %s", resource.Name, resource.Type)
+		}
+		resources = append(resources, resource)
+	}
+	return resources, nil
+}
+
+// ResourceId returns the id of the resource in a subscription and resource group
+func (r Resource) ResourceId(subscriptionId string, resourceGroup string) string {
+	types := strings.Split(r.Type, "/")
+	names := strings.Split(r.Name, "/")
+	id := fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/%s", subscriptionId, resourceGroup, types[0])
+	for i, name := range names {
+		id = fmt.Sprintf("%s/%s/%s", id, types[i+1], name)
+	}
+	return id
+}
+
+// CollectionId returns the id of the collection the resource is listed in
+func (r Resource) CollectionId(subscriptionId string, resourceGroup string) string {
+	id := r.ResourceId(subscriptionId, resourceGroup)
+	return id[:strings.LastIndex(id, "/")]
+}
+
+func setPath(properties map[string]interface{}, path []string, value interface{}) {
+	if len(path) == 1 {
+		properties[path[0]] = value
+		return
+	}
+	child, ok := properties[path[0]].(map[string]interface{})
+	if !ok {
+		child = make(map[string]interface{})
+		properties[path[0]] = child
+	}
+	setPath(child, path[1:], value)
+}
+
+type evaluator struct {
+	template *template
+	values   TemplateValues
+}
+
+func (e *evaluator) evaluateString(s string) (string, error) {
+	v, err := e.evaluateValue(s)
+	if err != nil {
+		return "", err
+	}
+	if v == nil {
+		return "", nil
+	}
+	return fmt.Sprintf("%v", v), nil
+}
+
+// evaluateValue evaluates the expressions in a value, strings in square brackets are expressions and a leading [[ escapes a literal [
+func (e *evaluator) evaluateValue(v interface{}) (interface{}, error) {
+	switch value := v.(type) {
+	case string:
+		if strings.HasPrefix(value, "[[") {
+			return value[1:], nil
+		}
+		if strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]") {
+			return e.evaluateExpression(value[1 : len(value)-1])
+		}
+		return value, nil
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(value))
+		for k, child := range value {
+			evaluated, err := e.evaluateValue(child)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+			result[k] = evaluated
+		}
+		return result, nil
+	case []interface{}:
+		result := make([]interface{}, 0, len(value))
+		for i, child := range value {
+			evaluated, err := e.evaluateValue(child)
+			if err != nil {
+				return nil, fmt.Errorf("%d: %w", i, err)
+			}
+			result = append(result, evaluated)
+		}
+		return result, nil
+	default:
+		return value, nil
+	}
+}
+
+func (e *evaluator) evaluateExpression(expression string) (interface{}, error) {
+	p := &parser{input: expression}
+	v, err := p.parse(e)
+	if err != nil {
+		return nil, fmt.Errorf("%w in expression [%s], set the value with an override", err, expression)
+	}
+	return v, nil
+}
+
+func (e *evaluator) call(name string, args []interface{}) (interface{}, error) {
+	switch strings.ToLower(name) {
+	case "parameters":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("parameters takes one argument")
+		}
+		return e.parameter(fmt.Sprintf("%v", args[0]))
+	case "variables":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("variables takes one argument")
+		}
+		v, ok := e.template.Variables[fmt.Sprintf("%v", args[0])]
+		if !ok {
+			return nil, fmt.Errorf("variable %v is not defined", args[0])
+		}
+		return e.evaluateValue(v)
+	case "concat":
+		var sb strings.Builder
+		for _, arg := range args {
+			fmt.Fprintf(&sb, "%v", arg)
+		}
+		return sb.String(), nil
+	case "resourcegroup":
+		return map[string]interface{}{
+			"name":     e.values.ResourceGroup,
+			"location": e.values.Location,
+		}, nil
+	case "subscription":
+		return map[string]interface{}{
+			"subscriptionId": e.values.SubscriptionId,
+		}, nil
+	default:
+		return nil, fmt.Errorf("function %s is not supported", name)
+	}
+}
+
+func (e *evaluator) parameter(name string) (interface{}, error) {
+	if value, ok := e.values.Parameters[name]; ok {
+		return value, nil
+	}
+	p, ok := e.template.Parameters[name]
+	if !ok {
+		return nil, fmt.Errorf("parameter %s is not defined", name)
+	}
+	if p.DefaultValue == nil {
+		return nil, fmt.Errorf("parameter %s has no value", name)
+	}
+	return e.evaluateValue(p.DefaultValue)
+}
+
+// parser parses the subset of the template expression language that is needed to build resource definitions: function calls, string and integer literals and property access
+type parser struct {
+	input string
+	pos   int
+}
+
+func (p *parser) parse(e *evaluator) (interface{}, error) {
+	v, err := p.expression(e)
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos != len(p.input) {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.input[p.pos:], p.pos)
+	}
+	return v, nil
+}
+
+func (p *parser) expression(e *evaluator) (interface{}, error) {
+	p.skipSpace()
+	if p.pos >= len(p.input) {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	var v interface{}
+	var err error
+	c := p.input[p.pos]
+	switch {
+	case c == '\'':
+		v, err = p.stringLiteral()
+	case c == '-' || (c >= '0' && c <= '9'):
+		v, err = p.integerLiteral()
+	default:
+		v, err = p.functionCall(e)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p.accessors(e, v)
+}
+
+func (p *parser) stringLiteral() (string, error) {
+	var sb strings.Builder
+	p.pos++
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		p.pos++
+		if c != '\'' {
+			sb.WriteByte(c)
+			continue
+		}
+		// a quote is escaped by doubling it
+		if p.pos < len(p.input) && p.input[p.pos] == '\'' {
+			sb.WriteByte(c)
+			p.pos++
+			continue
+		}
+		return sb.String(), nil
+	}
+	return "", fmt.Errorf("unterminated string")
+}
+
+func (p *parser) integerLiteral() (int, error) {
+	start := p.pos
+	p.pos++
+	for p.pos < len(p.input) && p.input[p.pos] >= '0' && p.input[p.pos] <= '9' {
+		p.pos++
+	}
+	return strconv.Atoi(p.input[start:p.pos])
+}
+
+func (p *parser) functionCall(e *evaluator) (interface{}, error) {
+	start := p.pos
+	for p.pos < len(p.input) && isIdentifier(p.input[p.pos]) {
+		p.pos++
+	}
+	name := p.input[start:p.pos]
+	if len(name) == 0 {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.input[p.pos:], p.pos)
+	}
+	p.skipSpace()
+	if p.pos >= len(p.input) || p.input[p.pos] != '(' {
+		return nil, fmt.Errorf("expected ( after %s", name)
+	}
+	p.pos++
+	var args []interface{}
+	for {
+		p.skipSpace()
+		if p.pos < len(p.input) && p.input[p.pos] == ')' {
+			p.pos++
+			break
+		}
+		if len(args) > 0 {
+			if p.pos >= len(p.input) || p.input[p.pos] != ',' {
+				return nil, fmt.Errorf("expected , or ) in arguments of %s", name)
+			}
+			p.pos++
+		}
+		arg, err := p.expression(e)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return e.call(name, args)
+}
+
+// accessors applies .property and [index] accessors to a value
+func (p *parser) accessors(e *evaluator, v interface{}) (interface{}, error) {
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.input) {
+			return v, nil
+		}
+		switch p.input[p.pos] {
+		case '.':
+			p.pos++
+			start := p.pos
+			for p.pos < len(p.input) && isIdentifier(p.input[p.pos]) {
+				p.pos++
+			}
+			name := p.input[start:p.pos]
+			object, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("cannot get property %s of %v", name, v)
+			}
+			if v, ok = object[name]; !ok {
+				return nil, fmt.Errorf("property %s does not exist", name)
+			}
+		case '[':
+			p.pos++
+			index, err := p.expression(e)
+			if err != nil {
+				return nil, err
+			}
+			p.skipSpace()
+			if p.pos >= len(p.input) || p.input[p.pos] != ']' {
+				return nil, fmt.Errorf("expected ]")
+			}
+			p.pos++
+			switch container := v.(type) {
+			case []interface{}:
+				i, ok := index.(int)
+				if !ok || i < 0 || i >= len(container) {
+					return nil, fmt.Errorf("index %v is out of range", index)
+				}
+				v = container[i]
+			case map[string]interface{}:
+				value, ok := container[fmt.Sprintf("%v", index)]
+				if !ok {
+					return nil, fmt.Errorf("property %v does not exist", index)
+				}
+				v = value
+			default:
+				return nil, fmt.Errorf("cannot index %v", v)
+			}
+		default:
+			return v, nil
+		}
+	}
+}
+
+func (p *parser) skipSpace() {
+	for p.pos < len(p.input) && p.input[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+func isIdentifier(c byte) bool {
+	return c == '_' || c == '-' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
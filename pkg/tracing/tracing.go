@@ -0,0 +1,194 @@
+// Package tracing configures OpenTelemetry tracing and carries trace context between the HTTP handlers, jobs and porter
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/simongdavies/cnab-custom-resource-handler/pkg"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	serviceName = "cnab-custom-resource-handler"
+	tracerName  = "github.com/simongdavies/cnab-custom-resource-handler"
+	// ExporterOTLP exports spans using OTLP over gRPC, the endpoint is set using the standard OTEL_EXPORTER_OTLP_ENDPOINT environment variable
+	ExporterOTLP = "otlp"
+	// ExporterStdout writes spans to stdout for local use
+	ExporterStdout = "stdout"
+)
+
+func init() {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+}
+
+// Configure sets up the exporter, if exporter is empty spans are not exported but trace context is still propagated. The returned function flushes and stops the exporter
+func Configure(exporter string) (func(context.Context) error, error) {
+	var spanExporter sdktrace.SpanExporter
+	var err error
+	switch strings.ToLower(exporter) {
+	case "":
+		log.Debug("No trace exporter configured")
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLP:
+		spanExporter, err = otlptracegrpc.New(context.Background())
+	case ExporterStdout:
+		spanExporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("Unknown trace exporter %s, expected %s or %s", exporter, ExporterOTLP, ExporterStdout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create %s trace exporter: %v", exporter, err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceNameKey.String(serviceName),
+			semconv.ServiceVersionKey.String(pkg.Version),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	log.Infof("Exporting traces using %s", exporter)
+	return provider.Shutdown, nil
+}
+
+// Start starts a span that is a child of the span in ctx
+func Start(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// End records err on the span if it is not nil and ends the span
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// StartJob starts a span for a job that continues the trace of the request that queued it
+func StartJob(traceContext map[string]string, name string, resourceId string, operationId string) (context.Context, trace.Span) {
+	return Start(Extract(traceContext), name, attribute.String("resource.id", resourceId), attribute.String("operation.id", operationId))
+}
+
+// SetError marks the span in ctx as failed
+func SetError(ctx context.Context, message string) {
+	trace.SpanFromContext(ctx).SetStatus(codes.Error, message)
+}
+
+// StartRequest starts a server span for an incoming request using the traceparent header as the parent if it is present
+func StartRequest(r *http.Request, correlationId string) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	return otel.Tracer(tracerName).Start(ctx, fmt.Sprintf("HTTP %s", r.Method),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(r.Method),
+			semconv.HTTPTargetKey.String(r.URL.Path),
+			attribute.String("ms.correlation_request_id", correlationId),
+		),
+	)
+}
+
+// SetStatusCode records the response status code on a server span, server errors mark the span as failed
+func SetStatusCode(span trace.Span, statusCode int) {
+	if statusCode == 0 {
+		statusCode = http.StatusOK
+	}
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(statusCode))
+	if statusCode >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(statusCode))
+	}
+}
+
+// mapCarrier is a propagation.TextMapCarrier that stores the trace context in a map so that it can be carried to a job
+type mapCarrier map[string]string
+
+func (c mapCarrier) Get(key string) string {
+	return c[key]
+}
+
+func (c mapCarrier) Set(key string, value string) {
+	c[key] = value
+}
+
+func (c mapCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Inject returns the trace context in ctx so that it can be carried to a job
+func Inject(ctx context.Context) map[string]string {
+	carrier := mapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return carrier
+}
+
+// Extract returns a context containing the trace context returned by Inject
+func Extract(traceContext map[string]string) context.Context {
+	return otel.GetTextMapPropagator().Extract(context.Background(), mapCarrier(traceContext))
+}
+
+// Environment returns the environment with the trace context in ctx set in TRACEPARENT and TRACESTATE so that it is passed to a child process
+func Environment(ctx context.Context, env []string) []string {
+	for k, v := range Inject(ctx) {
+		if k == "traceparent" || k == "tracestate" {
+			env = append(env, fmt.Sprintf("%s=%s", strings.ToUpper(k), v))
+		}
+	}
+	return env
+}
+
+// Transport returns a http.RoundTripper that creates a client span for each request as a child of the span in ctx
+func Transport(ctx context.Context, name string, next http.RoundTripper) http.RoundTripper {
+	return &transport{
+		ctx:  ctx,
+		name: name,
+		next: next,
+	}
+}
+
+type transport struct {
+	ctx  context.Context
+	name string
+	next http.RoundTripper
+}
+
+func (t *transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	ctx, span := otel.Tracer(tracerName).Start(t.ctx, fmt.Sprintf("%s %s", t.name, r.Method),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(r.Method),
+			semconv.HTTPHostKey.String(r.URL.Host),
+			semconv.HTTPTargetKey.String(r.URL.Path),
+		),
+	)
+	defer span.End()
+	resp, err := t.next.RoundTrip(r.WithContext(ctx))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(resp.StatusCode))
+	// not found is the expected result of many lookups so it is not marked as an error
+	if resp.StatusCode >= 400 && resp.StatusCode != http.StatusNotFound {
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	return resp, nil
+}